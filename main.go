@@ -2,9 +2,15 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/criteo/traffic-mirroring/mirror"
 	"github.com/criteo/traffic-mirroring/mirror/config"
+	"github.com/criteo/traffic-mirroring/mirror/graph"
 	_ "github.com/criteo/traffic-mirroring/mirror/modules/control"
 	_ "github.com/criteo/traffic-mirroring/mirror/modules/sink"
 	_ "github.com/criteo/traffic-mirroring/mirror/modules/source"
@@ -15,6 +21,7 @@ import (
 func main() {
 	cfgPath := flag.String("c", "config.json", "Config file path")
 	logLevel := flag.String("log-level", "info", "Log level")
+	validate := flag.Bool("validate", false, "Check the config file and print the pipeline graph without starting it")
 	flag.Parse()
 
 	l, err := log.ParseLevel(*logLevel)
@@ -24,18 +31,40 @@ func main() {
 
 	log.SetLevel(l)
 
+	// a module with the fail policy stops the pipeline
+	failures := make(chan error, 1)
+	config.OnFail = func(ctx *mirror.ModuleContext, err error) {
+		select {
+		case failures <- fmt.Errorf("%s: %w", ctx.Name, err):
+		default:
+		}
+	}
+
 	f, err := os.Open(*cfgPath)
 	if err != nil {
 		log.Fatalf("cannot open config file: %s", err)
 	}
 
 	cfg, err := config.Create(f)
+	if *validate {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		// modules only start their I/O in Start, so nothing is bound or
+		// opened here
+		fmt.Print(graph.FromModule(cfg.Root()).String())
+		return
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	reloader := config.NewReloader(*cfgPath, cfg)
+
 	if cfg.ListenAddr != "" {
-		srv := server.New(cfg.ListenAddr, cfg.Pipeline)
+		srv := server.New(cfg.ListenAddr, cfg.Root(), reloader)
 		go func() {
 			err := srv.Run()
 			if err != nil {
@@ -44,6 +73,60 @@ func main() {
 		}()
 	}
 
-	for range cfg.Pipeline.Output() {
+	done := make(chan struct{})
+	go func() {
+		for range cfg.Root().Output() {
+		}
+		close(done)
+	}()
+
+	err = cfg.Root().Start()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+
+	exitCode := 0
+wait:
+	for {
+		select {
+		case <-done:
+			return
+		case <-reloads:
+			log.Infof("received SIGHUP, reloading %s", *cfgPath)
+			err := reloader.Reload()
+			if err != nil {
+				log.Errorf("config reload failed:\n%s", err)
+			}
+		case sig := <-signals:
+			log.Infof("received %s, stopping the sources and draining the pipeline", sig)
+			break wait
+		case err := <-failures:
+			log.Errorf("pipeline failed: %s, stopping the sources and draining the pipeline", err)
+			exitCode = 1
+			break wait
+		}
+	}
+
+	// the shutdown timeout can be changed by a reload
+	shutdownTimeout, _ := reloader.Config().ShutdownDuration()
+
+	// stopping the sources closes their output, which closes the input of
+	// the next modules, up to the sinks which flush before closing theirs
+	cfg.Root().Stop()
+
+	select {
+	case <-done:
+		log.Info("pipeline drained")
+		os.Exit(exitCode)
+	case <-time.After(shutdownTimeout):
+		log.Fatalf("pipeline not drained after %s", shutdownTimeout)
+	case sig := <-signals:
+		log.Fatalf("received %s while draining the pipeline", sig)
 	}
 }
@@ -0,0 +1,199 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	FormatJSON  = "json"
+	FormatProto = "proto"
+	FormatAuto  = "auto"
+)
+
+// MaxRecordSize is the size above which a proto record is considered
+// corrupted rather than allocated.
+const MaxRecordSize = 64 << 20
+
+// CheckFormat returns an error if the format is unknown. FormatAuto and the
+// empty string are only accepted when decoding.
+func CheckFormat(format string, decode bool) error {
+	switch format {
+	case FormatJSON, FormatProto:
+		return nil
+	case "", FormatAuto:
+		if decode {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// Marshal encodes a single request, e.g. a message in a queue.
+func Marshal(format string, req mirror.Request) ([]byte, error) {
+	switch format {
+	case FormatJSON:
+		return json.Marshal(req)
+	case FormatProto:
+		return proto.Marshal(&req)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// Unmarshal decodes a single request encoded with Marshal.
+func Unmarshal(format string, b []byte, req *mirror.Request) error {
+	if format == "" || format == FormatAuto {
+		// a proto message never starts with '{', which would be the
+		// start of a group for field 15
+		format = FormatProto
+		if len(b) > 0 && b[0] == '{' {
+			format = FormatJSON
+		}
+	}
+
+	switch format {
+	case FormatJSON:
+		return json.Unmarshal(b, req)
+	case FormatProto:
+		return proto.Unmarshal(b, req)
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
+
+type Encoder interface {
+	Encode(req mirror.Request) error
+}
+
+type Decoder interface {
+	Decode(req *mirror.Request) error
+}
+
+// NewEncoder returns an encoder writing a stream of requests, as JSON lines
+// or varint-delimited proto messages.
+func NewEncoder(w io.Writer, format string) (Encoder, error) {
+	switch format {
+	case FormatJSON:
+		return jsonEncoder{enc: json.NewEncoder(w)}, nil
+	case FormatProto:
+		return &protoEncoder{w: w, sizeBuf: make([]byte, binary.MaxVarintLen64)}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// FormatFromPath returns the format matching the extension of a file, or
+// FormatAuto if the extension is unknown.
+func FormatFromPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json", ".jsonl":
+		return FormatJSON
+	case ".proto", ".pb":
+		return FormatProto
+	default:
+		return FormatAuto
+	}
+}
+
+// NewDecoder returns a decoder reading a stream written by an Encoder. With
+// FormatAuto, the format is detected from the first bytes of the stream,
+// callers knowing the file name should try FormatFromPath first.
+// Decode returns io.EOF at the end of the stream.
+func NewDecoder(r *bufio.Reader, format string) (Decoder, error) {
+	if format == "" || format == FormatAuto {
+		format = detectFormat(r)
+	}
+
+	switch format {
+	case FormatJSON:
+		return jsonDecoder{dec: json.NewDecoder(r)}, nil
+	case FormatProto:
+		return protoDecoder{r: r}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// detectFormat relies on JSON records starting with '{"' or '{}'. A proto
+// record of 123 bytes starting with field 4 has the same first bytes, so this
+// is only a fallback.
+func detectFormat(r *bufio.Reader) string {
+	b, _ := r.Peek(2)
+	if len(b) == 2 && b[0] == '{' && (b[1] == '"' || b[1] == '}') {
+		return FormatJSON
+	}
+
+	return FormatProto
+}
+
+type jsonEncoder struct {
+	enc *json.Encoder
+}
+
+func (e jsonEncoder) Encode(req mirror.Request) error {
+	return e.enc.Encode(req)
+}
+
+type protoEncoder struct {
+	w       io.Writer
+	buf     []byte
+	sizeBuf []byte
+}
+
+func (e *protoEncoder) Encode(req mirror.Request) error {
+	var err error
+	e.buf, err = proto.MarshalOptions{}.MarshalAppend(e.buf[:0], &req)
+	if err != nil {
+		return err
+	}
+
+	n := binary.PutUvarint(e.sizeBuf, uint64(len(e.buf)))
+
+	_, err = e.w.Write(e.sizeBuf[:n])
+	if err != nil {
+		return err
+	}
+
+	_, err = e.w.Write(e.buf)
+	return err
+}
+
+type jsonDecoder struct {
+	dec *json.Decoder
+}
+
+func (d jsonDecoder) Decode(req *mirror.Request) error {
+	return d.dec.Decode(req)
+}
+
+type protoDecoder struct {
+	r *bufio.Reader
+}
+
+func (d protoDecoder) Decode(req *mirror.Request) error {
+	size, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return err
+	}
+	if size > MaxRecordSize {
+		return fmt.Errorf("record of %d bytes is larger than the maximum of %d bytes", size, MaxRecordSize)
+	}
+
+	buf := make([]byte, size)
+	_, err = io.ReadFull(d.r, buf)
+	if err != nil {
+		return err
+	}
+
+	return proto.Unmarshal(buf, req)
+}
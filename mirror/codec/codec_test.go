@@ -0,0 +1,32 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatFromPath(t *testing.T) {
+	require.Equal(t, FormatJSON, FormatFromPath("/tmp/requests.json"))
+	require.Equal(t, FormatJSON, FormatFromPath("requests.JSONL"))
+	require.Equal(t, FormatProto, FormatFromPath("/tmp/requests.proto"))
+	require.Equal(t, FormatProto, FormatFromPath("requests.pb"))
+	require.Equal(t, FormatAuto, FormatFromPath("/tmp/requests"))
+	require.Equal(t, FormatAuto, FormatFromPath("/tmp/requests.log"))
+}
+
+func TestProtoDecoderMaxRecordSize(t *testing.T) {
+	b := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(b, MaxRecordSize+1)
+
+	dec, err := NewDecoder(bufio.NewReader(bytes.NewReader(b[:n])), FormatProto)
+	require.NoError(t, err)
+
+	err = dec.Decode(&mirror.Request{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "larger than the maximum")
+}
@@ -2,56 +2,104 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"time"
 
 	"github.com/criteo/traffic-mirroring/mirror"
-	"github.com/criteo/traffic-mirroring/mirror/registry"
 )
 
-type pipeline struct {
-	inner mirror.Module
-}
+const (
+	defaultShutdownTimeout = 30 * time.Second
+)
 
-func (p *pipeline) Context() *mirror.ModuleContext {
-	return p.inner.Context()
-}
+type Config struct {
+	ListenAddr string `json:"listen_addr,omitempty"`
+	// ShutdownTimeout is how long to wait for the pipeline to drain once
+	// the sources are stopped
+	ShutdownTimeout string `json:"shutdown_timeout,omitempty"`
 
-func (p *pipeline) Children() [][]mirror.Module {
-	return p.inner.Children()
-}
+	Pipeline  *pipeline `json:"pipeline,omitempty"`
+	Pipelines pipelines `json:"pipelines,omitempty"`
 
-func (p *pipeline) SetInput(c <-chan mirror.Request) {
-	p.inner.SetInput(c)
-}
-func (p *pipeline) Output() <-chan mirror.Request {
-	return p.inner.Output()
+	root mirror.Module
 }
-func (p *pipeline) UnmarshalJSON(b []byte) error {
-	ctx := &mirror.ModuleContext{
-		Name: "Pipeline",
-		Type: "virtual.pipeline",
-	}
-	m, err := registry.Create("control.seq", ctx, b)
-	if err != nil {
-		return err
-	}
 
-	p.inner = m
-	return nil
+// Root returns the module running all the pipelines of the configuration.
+func (c Config) Root() mirror.Module {
+	return c.root
 }
 
-type Config struct {
-	ListenAddr string `json:"listen_addr,omitempty"`
-
-	Pipeline *pipeline `json:"pipeline,omitempty"`
+// all returns the top level pipelines, the unnamed one first.
+func (c Config) all() []*pipeline {
+	res := []*pipeline{}
+	if c.Pipeline != nil {
+		res = append(res, c.Pipeline)
+	}
+	for _, name := range c.Pipelines.sortedNames() {
+		res = append(res, c.Pipelines[name])
+	}
+	return res
 }
 
+// Create builds the pipeline of the configuration without starting it. The
+// errors found in the modules are returned together as Errors.
 func Create(r io.Reader) (Config, error) {
 	cfg := Config{}
 	err := json.NewDecoder(r).Decode(&cfg)
 	if err != nil {
 		return cfg, fmt.Errorf("error reading config: %w", err)
 	}
+
+	errs := Errors{}
+	if cfg.Pipeline == nil && len(cfg.Pipelines) == 0 {
+		errs = append(errs, &Error{Path: "pipeline", Module: "Pipeline", Err: errors.New("pipeline or pipelines is required")})
+	}
+	for _, p := range cfg.all() {
+		errs = append(errs, p.errs...)
+	}
+
+	errs = append(errs, cfg.check()...)
+	if len(errs) > 0 {
+		return cfg, errs
+	}
+
+	ps := cfg.all()
+	if len(ps) == 1 {
+		cfg.root = ps[0]
+	} else {
+		cfg.root = newRoot(ps)
+	}
+
 	return cfg, nil
 }
+
+// check validates the settings outside of the pipeline.
+func (c Config) check() Errors {
+	errs := Errors{}
+
+	if c.ListenAddr != "" {
+		_, _, err := net.SplitHostPort(c.ListenAddr)
+		if err != nil {
+			errs = append(errs, &Error{Path: "listen_addr", Module: "server", Err: err})
+		}
+	}
+
+	_, err := c.ShutdownDuration()
+	if err != nil {
+		errs = append(errs, &Error{Path: "shutdown_timeout", Module: "server", Err: err})
+	}
+
+	return errs
+}
+
+// ShutdownDuration returns the parsed shutdown timeout, or its default.
+func (c Config) ShutdownDuration() (time.Duration, error) {
+	if c.ShutdownTimeout == "" {
+		return defaultShutdownTimeout, nil
+	}
+
+	return time.ParseDuration(c.ShutdownTimeout)
+}
@@ -0,0 +1,83 @@
+package config_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/criteo/traffic-mirroring/mirror/config"
+	_ "github.com/criteo/traffic-mirroring/mirror/modules/control"
+	_ "github.com/criteo/traffic-mirroring/mirror/modules/sink"
+	_ "github.com/criteo/traffic-mirroring/mirror/modules/source"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateErrors(t *testing.T) {
+	_, err := config.Create(strings.NewReader(`{
+		"shutdown_timeout": "soon",
+		"pipeline": [
+			{"type": "source.file", "config": {"path": "/nonexistent/*.json"}},
+			{"type": "control.unknown"},
+			{"type": "control.filter", "name": "bad-filter", "config": {"keep": "{req.path + 1}"}},
+			{
+				"type": "control.split_by",
+				"config": {
+					"expr": "{req.path}",
+					"pipeline": {"type": "control.seq", "config": [
+						{"type": "control.rate_limit", "config": {}}
+					]}
+				}
+			},
+			{"type": "sink.file", "config": {"path": "/nonexistent/out.json", "format": "xml"}}
+		]
+	}`))
+
+	var errs config.Errors
+	require.True(t, errors.As(err, &errs), "expected config.Errors, got %v", err)
+
+	paths := []string{}
+	for _, e := range errs {
+		paths = append(paths, e.Path)
+	}
+	require.Equal(t, []string{
+		"pipeline[0]",
+		"pipeline[1]",
+		"pipeline[2]",
+		"pipeline[3].config.pipeline.config[0]",
+		"pipeline[4]",
+		"shutdown_timeout",
+	}, paths)
+
+	// the keep expression is ill-typed, not missing
+	require.Equal(t, "pipeline[2]", errs[2].Path)
+	require.Equal(t, "bad-filter", errs[2].Module)
+	require.Contains(t, errs[2].Error(), "found no matching overload for '_+_'")
+	require.Contains(t, errs[1].Error(), "control.unknown")
+}
+
+func TestCreateRestart(t *testing.T) {
+	_, err := config.Create(strings.NewReader(`{
+		"pipeline": [
+			{"type": "control.filter", "on_error": "restart", "config": {"keep": "{true}"}},
+			{"type": "sink.file", "on_error": "restart", "config": {"path": "/nonexistent/out.json", "format": "json"}}
+		]
+	}`))
+
+	var errs config.Errors
+	require.True(t, errors.As(err, &errs), "expected config.Errors, got %v", err)
+	require.Len(t, errs, 1)
+	require.Equal(t, "pipeline[0].on_error", errs[0].Path)
+	require.Contains(t, errs[0].Error(), "control.filter cannot restart")
+}
+
+func TestCreateNoIO(t *testing.T) {
+	// the sink file is only created by Start
+	cfg, err := config.Create(strings.NewReader(`{
+		"pipeline": [
+			{"type": "control.rate_limit", "config": {"rps": 10}},
+			{"type": "sink.file", "config": {"path": "/nonexistent/out.json", "format": "json"}}
+		]
+	}`))
+	require.NoError(t, err)
+	require.Error(t, cfg.Pipeline.Start())
+}
@@ -0,0 +1,51 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Error is an error in the configuration of a module, located by the JSON
+// path of the module in the configuration file.
+type Error struct {
+	Path   string
+	Module string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%s): %s", e.Path, e.Module, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Errors holds all the errors found in a configuration, so that they can be
+// fixed at once.
+type Errors []*Error
+
+func (e Errors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// appendErrors adds err to errs, keeping the location of errors returned by
+// the creation of nested modules.
+func appendErrors(errs Errors, err error, path, module string) Errors {
+	var nested Errors
+	if errors.As(err, &nested) {
+		return append(errs, nested...)
+	}
+
+	var single *Error
+	if errors.As(err, &single) {
+		return append(errs, single)
+	}
+
+	return append(errs, &Error{Path: path, Module: module, Err: err})
+}
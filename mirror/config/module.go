@@ -3,58 +3,98 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"sync"
 
 	"github.com/criteo/traffic-mirroring/mirror"
 	"github.com/criteo/traffic-mirroring/mirror/registry"
 )
 
-var moduleIndex = map[string]int{}
+var (
+	// moduleIndex is shared by the modules created at runtime by
+	// control.split_by and by reloads
+	moduleIndex     = map[string]int{}
+	moduleIndexLock sync.Mutex
+)
+
+// OnFail is called when a module with the fail error policy reports an
+// error.
+var OnFail func(ctx *mirror.ModuleContext, err error)
 
 type Module struct {
-	Type   string
-	Name   string
-	Config json.RawMessage
+	Type    string
+	Name    string
+	OnError string `json:"on_error,omitempty"`
+	Config  json.RawMessage
 }
 
-func CreateModule(b []byte) (mirror.Module, error) {
+// CreateModule creates the module configured at the given JSON path. All
+// the errors found in the module and its children are returned as Errors.
+func CreateModule(path string, b []byte) (mirror.Module, error) {
 	mc := Module{}
 	err := json.Unmarshal(b, &mc)
 	if err != nil {
-		return nil, fmt.Errorf("error reading module config: %w", err)
+		return nil, Errors{{Path: path, Module: "unknown", Err: err}}
 	}
 
+	moduleIndexLock.Lock()
 	name := mc.Name
 	if name == "" {
 		name = fmt.Sprintf("%s.%d", mc.Type, moduleIndex[mc.Type])
 	}
 	moduleIndex[mc.Type]++
+	moduleIndexLock.Unlock()
+
+	policy, err := mirror.ParseErrorPolicy(mc.OnError)
+	if err != nil {
+		return nil, Errors{{Path: path + ".on_error", Module: name, Err: err}}
+	}
 
 	ctx := &mirror.ModuleContext{
-		Type: mc.Type,
-		Name: name,
+		Type:        mc.Type,
+		Name:        name,
+		ConfigPath:  path + ".config",
+		ErrorPolicy: policy,
+		OnFail:      OnFail,
+	}
+
+	mod, err := registry.Create(mc.Type, ctx, mc.Config)
+	if err != nil {
+		return nil, appendErrors(nil, err, path, name)
+	}
+
+	if _, ok := mod.(mirror.Restartable); policy == mirror.ErrorPolicyRestart && !ok {
+		return nil, Errors{{Path: path + ".on_error", Module: name, Err: fmt.Errorf("%s cannot restart", mc.Type)}}
 	}
-	go ctx.Run()
 
-	return registry.Create(mc.Type, ctx, mc.Config)
+	return mod, nil
 }
 
-func CreateModules(b []byte) ([]mirror.Module, error) {
+// CreateModules creates the list of modules configured at the given JSON
+// path. It keeps going after an error to report the errors of all the
+// modules.
+func CreateModules(path string, b []byte) ([]mirror.Module, error) {
 	res := []mirror.Module{}
 
 	c := []json.RawMessage{}
 	err := json.Unmarshal(b, &c)
 	if err != nil {
-		return nil, fmt.Errorf("error reading module config: %w", err)
+		return nil, Errors{{Path: path, Module: "unknown", Err: err}}
 	}
 
-	for _, mc := range c {
-		mod, err := CreateModule(mc)
+	errs := Errors{}
+	for i, mc := range c {
+		mod, err := CreateModule(fmt.Sprintf("%s[%d]", path, i), mc)
 		if err != nil {
-			return nil, err
+			errs = appendErrors(errs, err, path, "unknown")
+			continue
 		}
 
 		res = append(res, mod)
 	}
 
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
 	return res, nil
 }
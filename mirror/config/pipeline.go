@@ -0,0 +1,581 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/criteo/traffic-mirroring/mirror/pubsub"
+)
+
+// node is a module of the top level pipeline, or one of its two ends.
+type node struct {
+	// raw is the compacted configuration of the module, used to find the
+	// modules left unchanged by a reload
+	raw string
+	mod mirror.Module
+	// in is nil for sources and for the input of the pipeline
+	in  chan mirror.Request
+	out <-chan mirror.Request
+
+	// ended is set once out is closed
+	ended int32
+	// inClosed is set once in is closed, protected by the lock of the
+	// pipeline
+	inClosed bool
+}
+
+func (n *node) name() string {
+	return n.mod.Context().Name
+}
+
+// pump forwards the output of a node to the input of the next one. Unlike a
+// direct connection, it can be halted during a reload without losing the
+// request it holds.
+type pump struct {
+	src, dst *node
+
+	stop    chan struct{}
+	done    chan struct{}
+	pending *mirror.Request
+	// closeOnEOF is protected by the lock of the pipeline. It is unset while
+	// a removed module drains into a module which is kept.
+	closeOnEOF bool
+}
+
+func (pm *pump) run(onEOF func(pm *pump)) {
+	if pm.pending != nil {
+		select {
+		case pm.dst.in <- *pm.pending:
+			pm.pending = nil
+		case <-pm.stop:
+			close(pm.done)
+			return
+		}
+	}
+
+	for {
+		select {
+		case r, ok := <-pm.src.out:
+			if !ok {
+				atomic.StoreInt32(&pm.src.ended, 1)
+				// done is closed first, so that a reload can halt the pump
+				// while holding the lock of the pipeline
+				close(pm.done)
+				onEOF(pm)
+				return
+			}
+
+			select {
+			case pm.dst.in <- r:
+			case <-pm.stop:
+				pm.pending = &r
+				close(pm.done)
+				return
+			}
+		case <-pm.stop:
+			close(pm.done)
+			return
+		}
+	}
+}
+
+func (pm *pump) halt() {
+	close(pm.stop)
+	<-pm.done
+}
+
+// pipeline is the top level sequence of modules. Unlike control.seq, its
+// modules can be replaced while it is running.
+type pipeline struct {
+	ctx *mirror.ModuleContext
+	out chan mirror.Request
+
+	// reloadLock serializes reloads with Start and Stop
+	reloadLock sync.Mutex
+	started    bool
+	stopped    bool
+
+	lock sync.Mutex
+	// nodes starts with the input of the pipeline and ends with its output
+	nodes []*node
+	pumps map[*node]*pump
+
+	// errs are reported by Create along with the other errors of the
+	// configuration, instead of stopping the decoding
+	errs Errors
+}
+
+// reloadPlan holds the modules of a new configuration, created but not
+// connected yet.
+type reloadPlan struct {
+	nodes []*node
+	kept  map[*node]bool
+	added []*node
+}
+
+// reloadChanges lists the names of the modules affected by a reload.
+type reloadChanges struct {
+	Kept    []string
+	Added   []string
+	Removed []string
+}
+
+func (p *pipeline) UnmarshalJSON(b []byte) error {
+	p.build("Pipeline", "pipeline", b)
+	return nil
+}
+
+// build creates the modules of the pipeline, the errors are kept in errs.
+func (p *pipeline) build(name, path string, b []byte) {
+	p.ctx = &mirror.ModuleContext{
+		Name:       name,
+		Type:       "virtual.pipeline",
+		ConfigPath: path,
+	}
+	p.out = make(chan mirror.Request)
+	p.pumps = map[*node]*pump{}
+	p.nodes = []*node{{}, {in: p.out}}
+
+	plan, err := p.prepare(b)
+	if err != nil {
+		p.errs = appendErrors(nil, err, path, name)
+		return
+	}
+
+	p.apply(plan)
+}
+
+func (p *pipeline) Context() *mirror.ModuleContext {
+	return p.ctx
+}
+
+func (p *pipeline) Children() [][]mirror.Module {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	mods := []mirror.Module{}
+	for _, n := range p.nodes[1 : len(p.nodes)-1] {
+		mods = append(mods, n.mod)
+	}
+	return [][]mirror.Module{mods}
+}
+
+// Start starts the last modules first, so that sources only produce
+// requests once the rest of the pipeline is running.
+func (p *pipeline) Start() error {
+	p.reloadLock.Lock()
+	defer p.reloadLock.Unlock()
+
+	nodes := p.modules()
+	for i := len(nodes) - 1; i >= 0; i-- {
+		err := nodes[i].mod.Start()
+		if err != nil {
+			return err
+		}
+	}
+
+	p.started = true
+	return nil
+}
+
+func (p *pipeline) Stop() {
+	p.reloadLock.Lock()
+	defer p.reloadLock.Unlock()
+
+	p.stopped = true
+	for _, n := range p.modules() {
+		resume(n.mod)
+		n.mod.Stop()
+	}
+}
+
+// resume resumes the module and its children if they were paused through
+// the admin API, so that they can be drained.
+func resume(m mirror.Module) {
+	mirror.Walk(m, func(m mirror.Module) {
+		m.Context().SetPaused(false)
+	})
+}
+
+func (p *pipeline) SetInput(c <-chan mirror.Request) {
+	p.reloadLock.Lock()
+	defer p.reloadLock.Unlock()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	input := p.nodes[0]
+	input.out = c
+	p.connect(input, p.nodes[1], nil)
+}
+
+func (p *pipeline) Output() <-chan mirror.Request {
+	return p.out
+}
+
+// modules returns the nodes of the modules, without the ends of the
+// pipeline.
+func (p *pipeline) modules() []*node {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.nodes[1 : len(p.nodes)-1]
+}
+
+// plan creates the modules of a new configuration of the running pipeline.
+// Nothing is changed until the plan is applied by reload, or released by
+// discard.
+func (p *pipeline) plan(b []byte) (*reloadPlan, error) {
+	p.reloadLock.Lock()
+	defer p.reloadLock.Unlock()
+
+	if !p.started || p.stopped {
+		return nil, errors.New("the pipeline is not running")
+	}
+
+	return p.prepare(b)
+}
+
+// reload replaces the modules whose configuration changed. Nothing is
+// changed if the pipeline stopped since the plan was made, or if a new
+// module cannot be started.
+func (p *pipeline) reload(plan *reloadPlan) (*reloadChanges, error) {
+	p.reloadLock.Lock()
+	defer p.reloadLock.Unlock()
+
+	if p.stopped {
+		plan.discard()
+		return nil, errors.New("the pipeline is not running")
+	}
+
+	return p.apply(plan)
+}
+
+// prepare creates the modules of the new configuration which are not
+// already running.
+func (p *pipeline) prepare(b []byte) (*reloadPlan, error) {
+	errs := Errors{}
+	entries := []json.RawMessage{}
+	err := json.Unmarshal(b, &entries)
+	if err != nil {
+		return nil, append(errs, &Error{Path: p.ctx.ConfigPath, Module: p.ctx.Name, Err: err})
+	}
+
+	raws := make([]string, len(entries))
+	for i, entry := range entries {
+		buf := bytes.Buffer{}
+		err := json.Compact(&buf, entry)
+		if err != nil {
+			return nil, append(errs, &Error{Path: fmt.Sprintf("%s[%d]", p.ctx.ConfigPath, i), Module: "unknown", Err: err})
+		}
+		raws[i] = buf.String()
+	}
+
+	current := p.modules()
+	currentRaws := make([]string, len(current))
+	for i, n := range current {
+		currentRaws[i] = n.raw
+	}
+
+	plan := &reloadPlan{
+		nodes: []*node{p.nodes[0]},
+		kept:  map[*node]bool{p.nodes[0]: true, p.nodes[len(p.nodes)-1]: true},
+	}
+
+	for i, match := range matchModules(currentRaws, raws) {
+		path := fmt.Sprintf("%s[%d]", p.ctx.ConfigPath, i)
+
+		n := &node{raw: raws[i]}
+		if match >= 0 {
+			n = current[match]
+			plan.kept[n] = true
+		} else {
+			mod, err := CreateModule(path, entries[i])
+			if err != nil {
+				errs = appendErrors(errs, err, path, "unknown")
+				continue
+			}
+
+			n.mod = mod
+			n.out = mod.Output()
+			if mod.Context().Role() != "source" {
+				n.in = make(chan mirror.Request)
+				mod.SetInput(n.in)
+			}
+			plan.added = append(plan.added, n)
+		}
+
+		if i > 0 && n.mod.Context().Role() == "source" {
+			errs = append(errs, &Error{Path: path, Module: n.name(), Err: errors.New("a source can only be the first module of a pipeline")})
+		}
+
+		plan.nodes = append(plan.nodes, n)
+	}
+	plan.nodes = append(plan.nodes, p.nodes[len(p.nodes)-1])
+
+	if len(errs) > 0 {
+		plan.discard()
+		return nil, errs
+	}
+
+	return plan, nil
+}
+
+// apply starts the new modules, drains the removed modules into the modules
+// kept after them, then connects the new modules. The connections between modules which are kept
+// next to each other are left running.
+func (p *pipeline) apply(plan *reloadPlan) (*reloadChanges, error) {
+	changes := &reloadChanges{}
+
+	p.lock.Lock()
+	for _, n := range p.nodes {
+		if plan.kept[n] && (atomic.LoadInt32(&n.ended) == 1 || n.inClosed) {
+			p.lock.Unlock()
+			plan.discard()
+			return nil, errors.New("the pipeline is stopping")
+		}
+	}
+	current := p.nodes
+	p.lock.Unlock()
+
+	// the new modules are started while the old ones still run, so that
+	// nothing is replaced if one of them fails
+	if p.started {
+		err := plan.start()
+		if err != nil {
+			plan.discard()
+			return nil, err
+		}
+	}
+
+	// each run of removed modules is drained in turn, from the first one.
+	// The modules after a run are still connected as before, so what is in
+	// flight reaches them.
+	halted := map[*node]*pump{}
+	for i := 1; i < len(current)-1; i++ {
+		prev := current[i-1]
+		if plan.kept[current[i]] || !plan.kept[prev] {
+			continue
+		}
+
+		end := i
+		for !plan.kept[current[end]] {
+			end++
+		}
+
+		for _, n := range current[i:end] {
+			resume(n.mod)
+		}
+
+		p.lock.Lock()
+		if pm := p.pumps[prev]; pm != nil {
+			pm.closeOnEOF = false
+			pm.halt()
+			halted[prev] = pm
+		}
+
+		first := current[i]
+		if first.in == nil {
+			first.mod.Stop()
+		} else if !first.inClosed {
+			close(first.in)
+			first.inClosed = true
+		}
+
+		last := p.pumps[current[end-1]]
+		if last != nil {
+			last.closeOnEOF = false
+		}
+		p.lock.Unlock()
+
+		if last != nil {
+			<-last.done
+		}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, n := range current[1 : len(current)-1] {
+		if plan.kept[n] {
+			changes.Kept = append(changes.Kept, n.name())
+		} else {
+			changes.Removed = append(changes.Removed, n.name())
+			delete(p.pumps, n)
+		}
+	}
+
+	for i := 0; i < len(plan.nodes)-1; i++ {
+		src, dst := plan.nodes[i], plan.nodes[i+1]
+
+		pm := p.pumps[src]
+		if pm != nil && halted[src] == nil {
+			if pm.dst == dst {
+				continue
+			}
+			pm.closeOnEOF = false
+			pm.halt()
+			halted[src] = pm
+		}
+
+		var pending *mirror.Request
+		if pm := halted[src]; pm != nil {
+			pending = pm.pending
+		}
+		p.connect(src, dst, pending)
+	}
+
+	p.nodes = plan.nodes
+
+	for _, n := range plan.added {
+		changes.Added = append(changes.Added, n.name())
+	}
+
+	return changes, nil
+}
+
+// connect starts a pump from src to dst, if requests can flow between
+// them. It is called with the lock held.
+func (p *pipeline) connect(src, dst *node, pending *mirror.Request) {
+	delete(p.pumps, src)
+	if src.out == nil || dst.in == nil {
+		return
+	}
+
+	// the pipeline started stopping during a reload, what src still
+	// outputs cannot go anywhere
+	if dst.inClosed {
+		go func() {
+			for range src.out {
+			}
+		}()
+		return
+	}
+
+	pm := &pump{
+		src:        src,
+		dst:        dst,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+		pending:    pending,
+		closeOnEOF: true,
+	}
+	p.pumps[src] = pm
+	go pm.run(p.onEOF)
+}
+
+// onEOF closes the input of the next module once the output of a module is
+// closed, so that stopping the sources drains the whole pipeline.
+func (p *pipeline) onEOF(pm *pump) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	// the pump was halted by a reload, which connected its source again
+	if p.pumps[pm.src] != pm || !pm.closeOnEOF || pm.dst.inClosed {
+		return
+	}
+
+	close(pm.dst.in)
+	pm.dst.inClosed = true
+}
+
+// start starts the new modules, from the last one. If one of them fails,
+// the ones already started are stopped.
+func (plan *reloadPlan) start() error {
+	for i := len(plan.added) - 1; i >= 0; i-- {
+		n := plan.added[i]
+		err := n.mod.Start()
+		if err == nil {
+			continue
+		}
+
+		for _, started := range plan.added[i+1:] {
+			// discard stops the sources
+			if started.in != nil {
+				started.mod.Stop()
+			}
+		}
+
+		path := strings.TrimSuffix(n.mod.Context().ConfigPath, ".config")
+		return appendErrors(nil, err, path, n.name())
+	}
+
+	return nil
+}
+
+// discard releases the modules created for a rejected reload, they are not
+// running.
+func (plan *reloadPlan) discard() {
+	for _, n := range plan.added {
+		if n.in == nil {
+			n.mod.Stop()
+			continue
+		}
+
+		close(n.in)
+		go func(out <-chan mirror.Request) {
+			for range out {
+			}
+		}(n.out)
+	}
+}
+
+// subscribedTopic returns the topic the pipeline is fed by, if its source
+// is a subscription.
+func (p *pipeline) subscribedTopic() string {
+	mods := p.modules()
+	if len(mods) == 0 {
+		return ""
+	}
+
+	sub, ok := mods[0].mod.(pubsub.Subscriber)
+	if !ok {
+		return ""
+	}
+	return sub.SubscribedTopic()
+}
+
+// matchModules finds the longest common subsequence of the current and new
+// module configurations. It returns, for each new module, the index of the
+// current module it matches, or -1.
+func matchModules(current, new []string) []int {
+	lengths := make([][]int, len(current)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(new)+1)
+	}
+
+	for i := len(current) - 1; i >= 0; i-- {
+		for j := len(new) - 1; j >= 0; j-- {
+			if current[i] == new[j] {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else if lengths[i+1][j] >= lengths[i][j+1] {
+				lengths[i][j] = lengths[i+1][j]
+			} else {
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+
+	res := make([]int, len(new))
+	i, j := 0, 0
+	for j < len(new) {
+		switch {
+		case i < len(current) && current[i] == new[j]:
+			res[j] = i
+			i++
+			j++
+		case i < len(current) && lengths[i+1][j] >= lengths[i][j+1]:
+			i++
+		default:
+			res[j] = -1
+			j++
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,167 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/criteo/traffic-mirroring/mirror/pubsub"
+)
+
+const (
+	// subscribedStopInterval is how often the publishers of the topics are
+	// checked when stopping the pipelines subscribed to them
+	subscribedStopInterval = 100 * time.Millisecond
+)
+
+// pipelines are the named top level pipelines.
+type pipelines map[string]*pipeline
+
+func (ps *pipelines) UnmarshalJSON(b []byte) error {
+	raws := map[string]json.RawMessage{}
+	err := json.Unmarshal(b, &raws)
+	if err != nil {
+		return err
+	}
+
+	*ps = pipelines{}
+	for name, raw := range raws {
+		p := &pipeline{}
+		p.build("Pipeline "+name, "pipelines."+name, raw)
+		(*ps)[name] = p
+	}
+
+	return nil
+}
+
+// sortedNames returns the names of the pipelines in a stable order.
+func (ps pipelines) sortedNames() []string {
+	names := make([]string, 0, len(ps))
+	for name := range ps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// root groups the top level pipelines of the configuration in a single
+// module, whose output is closed once all the pipelines are drained.
+type root struct {
+	ctx       *mirror.ModuleContext
+	out       chan mirror.Request
+	pipelines []*pipeline
+
+	stopOnce sync.Once
+}
+
+func newRoot(ps []*pipeline) *root {
+	r := &root{
+		ctx: &mirror.ModuleContext{
+			Name: "Pipelines",
+			Type: "virtual.pipelines",
+		},
+		out:       make(chan mirror.Request),
+		pipelines: ps,
+	}
+
+	wg := sync.WaitGroup{}
+	for _, p := range ps {
+		wg.Add(1)
+		go func(p *pipeline) {
+			defer wg.Done()
+			for req := range p.Output() {
+				r.out <- req
+			}
+		}(p)
+	}
+
+	go func() {
+		wg.Wait()
+		close(r.out)
+	}()
+
+	return r
+}
+
+func (r *root) Context() *mirror.ModuleContext {
+	return r.ctx
+}
+
+func (r *root) Children() [][]mirror.Module {
+	res := [][]mirror.Module{}
+	for _, p := range r.pipelines {
+		res = append(res, []mirror.Module{p})
+	}
+	return res
+}
+
+// Start starts the pipelines subscribed to a topic first, so that they
+// receive everything published by the others.
+func (r *root) Start() error {
+	for _, subscribed := range []bool{true, false} {
+		for _, p := range r.pipelines {
+			if (p.subscribedTopic() != "") != subscribed {
+				continue
+			}
+
+			err := p.Start()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Stop stops the pipelines subscribed to a topic once its publishers are
+// done, so that the requests in flight in the other pipelines reach them.
+func (r *root) Stop() {
+	r.stopOnce.Do(func() {
+		subscribed := []*pipeline{}
+		for _, p := range r.pipelines {
+			if p.subscribedTopic() != "" {
+				subscribed = append(subscribed, p)
+				continue
+			}
+			p.Stop()
+		}
+
+		go func() {
+			ticker := time.NewTicker(subscribedStopInterval)
+			defer ticker.Stop()
+
+			for {
+				remaining := []*pipeline{}
+				for _, p := range subscribed {
+					if pubsub.Get(p.subscribedTopic()).Publishers() > 0 {
+						remaining = append(remaining, p)
+						continue
+					}
+					p.Stop()
+				}
+
+				subscribed = remaining
+				if len(subscribed) == 0 {
+					return
+				}
+				<-ticker.C
+			}
+		}()
+	})
+}
+
+func (r *root) Output() <-chan mirror.Request {
+	return r.out
+}
+
+func (r *root) SetInput(c <-chan mirror.Request) {
+	r.ctx.Error(errors.New("the pipelines cannot accept input"))
+	go func() {
+		for range c {
+		}
+	}()
+}
@@ -0,0 +1,89 @@
+package config_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/criteo/traffic-mirroring/mirror/config"
+	"github.com/criteo/traffic-mirroring/mirror/graph"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipelines(t *testing.T) {
+	dir := t.TempDir()
+
+	cfg, err := config.Create(strings.NewReader(strings.ReplaceAll(`{
+		"pipelines": {
+			"capture": [
+				{"type": "control.publish", "name": "publish", "config": {"topic": "test-pipelines"}}
+			],
+			"recorder": [
+				{"type": "source.subscribe", "name": "recorder-subscribe", "config": {"topic": "test-pipelines"}},
+				{"type": "sink.file", "name": "recorder-file", "config": {"path": "$DIR/recorder.json", "format": "json"}}
+			],
+			"replay": [
+				{"type": "source.subscribe", "name": "replay-subscribe", "config": {"topic": "test-pipelines"}},
+				{"type": "control.rate_limit", "name": "replay-limit", "config": {"rps": 1000}},
+				{"type": "sink.file", "name": "replay-file", "config": {"path": "$DIR/replay.json", "format": "json"}}
+			]
+		}
+	}`, "$DIR", dir)))
+	require.NoError(t, err)
+
+	in := make(chan mirror.Request)
+	cfg.Pipelines["capture"].SetInput(in)
+
+	root := cfg.Root()
+	done := make(chan struct{})
+	go func() {
+		for range root.Output() {
+		}
+		close(done)
+	}()
+	require.NoError(t, root.Start())
+
+	for _, p := range []string{"/1", "/2", "/3"} {
+		in <- mirror.Request{Path: p}
+	}
+
+	// the subscribed pipelines are only stopped once the publisher is done
+	root.Stop()
+	close(in)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the pipelines to drain")
+	}
+
+	for _, name := range []string{"recorder.json", "replay.json"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		require.Equal(t, 3, bytes.Count(b, []byte("\n")), name)
+	}
+
+	g := graph.FromModule(root).String()
+	require.Contains(t, g, `"Pipeline recorder"`)
+	require.Regexp(t, `n\d+->n\d+\[label="test-pipelines",style="dashed"\]`, g)
+}
+
+func TestPipelinesErrors(t *testing.T) {
+	_, err := config.Create(strings.NewReader(`{
+		"pipelines": {
+			"a": [{"type": "control.publish", "config": {}}],
+			"b": [{"type": "control.identity"}, {"type": "source.subscribe", "config": {"topic": "b"}}]
+		}
+	}`))
+
+	var errs config.Errors
+	require.True(t, errors.As(err, &errs), "expected config.Errors, got %v", err)
+	require.Len(t, errs, 2)
+	require.Equal(t, "pipelines.a[0]", errs[0].Path)
+	require.Equal(t, "pipelines.b[1]", errs[1].Path)
+}
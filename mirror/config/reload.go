@@ -0,0 +1,197 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	reloadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "config_reloads_total",
+		Help: "The total number of configuration reloads by result",
+	}, []string{"result"})
+)
+
+// ReloadStatus describes the last reloads of the configuration.
+type ReloadStatus struct {
+	Reloads     int       `json:"reloads"`
+	Failures    int       `json:"failures"`
+	LastAttempt time.Time `json:"last_attempt,omitempty"`
+	LastSuccess time.Time `json:"last_success,omitempty"`
+	// Errors are the errors of the last attempt, if it failed
+	Errors []string `json:"errors,omitempty"`
+
+	// Kept, Added and Removed are the modules of the top level pipeline
+	// affected by the last successful reload
+	Kept    []string `json:"kept,omitempty"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// Reloader applies the changes of the configuration file to a running
+// pipeline.
+type Reloader struct {
+	path string
+
+	lock   sync.Mutex
+	cfg    Config
+	status ReloadStatus
+}
+
+func NewReloader(path string, cfg Config) *Reloader {
+	return &Reloader{
+		path: path,
+		cfg:  cfg,
+	}
+}
+
+// Config returns the configuration currently applied.
+func (r *Reloader) Config() Config {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.cfg
+}
+
+func (r *Reloader) Status() ReloadStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.status
+}
+
+// Reload reads the configuration file again. The modules of the top level
+// pipeline whose configuration is unchanged keep running, the others are
+// replaced once the requests they hold are drained. Nothing is changed if
+// the new configuration is invalid.
+func (r *Reloader) Reload() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.status.LastAttempt = time.Now()
+
+	// changes are only nil when the reload is rejected. Otherwise, err
+	// holds the new modules which could not be started, their pipeline
+	// was left unchanged.
+	changes, err := r.reload()
+	if changes != nil {
+		r.status.Kept = changes.Kept
+		r.status.Added = changes.Added
+		r.status.Removed = changes.Removed
+		log.Infof("config reloaded: %d modules kept, %d added, %d removed", len(changes.Kept), len(changes.Added), len(changes.Removed))
+	}
+
+	if err != nil {
+		r.status.Failures++
+		r.status.Errors = strings.Split(err.Error(), "\n")
+		reloadsTotal.WithLabelValues("failure").Inc()
+		return err
+	}
+
+	r.status.Reloads++
+	r.status.LastSuccess = r.status.LastAttempt
+	r.status.Errors = nil
+	reloadsTotal.WithLabelValues("success").Inc()
+
+	return nil
+}
+
+func (r *Reloader) reload() (*reloadChanges, error) {
+	b, err := os.ReadFile(r.path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read config file: %w", err)
+	}
+
+	// the pipelines are decoded by the running ones, which only create the
+	// modules that changed
+	c := struct {
+		Config
+		Pipeline  json.RawMessage            `json:"pipeline,omitempty"`
+		Pipelines map[string]json.RawMessage `json:"pipelines,omitempty"`
+	}{}
+	err = json.Unmarshal(b, &c)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config: %w", err)
+	}
+
+	errs := Errors{}
+	if (c.Pipeline == nil) != (r.cfg.Pipeline == nil) {
+		errs = append(errs, &Error{Path: "pipeline", Module: "Pipeline", Err: errors.New("pipelines cannot be added or removed without a restart")})
+	}
+	for name := range c.Pipelines {
+		if r.cfg.Pipelines[name] == nil {
+			errs = append(errs, &Error{Path: "pipelines." + name, Module: "Pipeline " + name, Err: errors.New("pipelines cannot be added or removed without a restart")})
+		}
+	}
+	for name := range r.cfg.Pipelines {
+		if c.Pipelines[name] == nil {
+			errs = append(errs, &Error{Path: "pipelines." + name, Module: "Pipeline " + name, Err: errors.New("pipelines cannot be added or removed without a restart")})
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	errs = append(errs, c.Config.check()...)
+
+	// all the pipelines are checked before any of them is changed
+	ps := r.cfg.all()
+	raws := []json.RawMessage{}
+	if c.Pipeline != nil {
+		raws = append(raws, c.Pipeline)
+	}
+	for _, name := range r.cfg.Pipelines.sortedNames() {
+		raws = append(raws, c.Pipelines[name])
+	}
+
+	plans := []*reloadPlan{}
+	for i, p := range ps {
+		plan, err := p.plan(raws[i])
+		if err != nil {
+			errs = appendErrors(errs, err, p.ctx.ConfigPath, p.ctx.Name)
+			continue
+		}
+		plans = append(plans, plan)
+	}
+
+	if len(errs) > 0 {
+		for _, plan := range plans {
+			plan.discard()
+		}
+		return nil, errs
+	}
+
+	changes := &reloadChanges{}
+	startErrs := Errors{}
+	for i, p := range ps {
+		pc, err := p.reload(plans[i])
+		if err != nil {
+			startErrs = appendErrors(startErrs, err, p.ctx.ConfigPath, p.ctx.Name)
+		}
+		if pc != nil {
+			changes.Kept = append(changes.Kept, pc.Kept...)
+			changes.Added = append(changes.Added, pc.Added...)
+			changes.Removed = append(changes.Removed, pc.Removed...)
+		}
+	}
+
+	if c.ListenAddr != r.cfg.ListenAddr {
+		log.Warnf("config reload: listen_addr cannot be changed without a restart")
+	}
+	r.cfg.ShutdownTimeout = c.ShutdownTimeout
+
+	if len(startErrs) > 0 {
+		return changes, startErrs
+	}
+
+	return changes, nil
+}
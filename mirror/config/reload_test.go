@@ -0,0 +1,237 @@
+package config_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/criteo/traffic-mirroring/mirror/config"
+	"github.com/stretchr/testify/require"
+)
+
+type reloadTest struct {
+	t        *testing.T
+	dir      string
+	path     string
+	cfg      config.Config
+	reloader *config.Reloader
+	in       chan mirror.Request
+	done     chan struct{}
+}
+
+func newReloadTest(t *testing.T, pipeline string) *reloadTest {
+	dir, err := ioutil.TempDir("/tmp", "http-mirror-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	rt := &reloadTest{
+		t:    t,
+		dir:  dir,
+		path: filepath.Join(dir, "config.json"),
+		in:   make(chan mirror.Request),
+		done: make(chan struct{}),
+	}
+	rt.write(pipeline)
+
+	f, err := os.Open(rt.path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	rt.cfg, err = config.Create(f)
+	require.NoError(t, err)
+	rt.reloader = config.NewReloader(rt.path, rt.cfg)
+
+	rt.cfg.Pipeline.SetInput(rt.in)
+	go func() {
+		for range rt.cfg.Pipeline.Output() {
+		}
+		close(rt.done)
+	}()
+	require.NoError(t, rt.cfg.Pipeline.Start())
+
+	return rt
+}
+
+// write writes the config file, $DIR in the pipeline is replaced by the
+// directory of the test.
+func (rt *reloadTest) write(pipeline string) {
+	cfg := `{"pipeline": ` + strings.ReplaceAll(pipeline, "$DIR", rt.dir) + `}`
+	require.NoError(rt.t, ioutil.WriteFile(rt.path, []byte(cfg), 0o644))
+}
+
+func (rt *reloadTest) send(paths ...string) {
+	for _, p := range paths {
+		rt.in <- mirror.Request{Path: p}
+	}
+}
+
+func (rt *reloadTest) stop() {
+	close(rt.in)
+	<-rt.done
+}
+
+func (rt *reloadTest) modules() []mirror.Module {
+	return rt.cfg.Pipeline.Children()[0]
+}
+
+func (rt *reloadTest) lines(name string) int {
+	b, err := ioutil.ReadFile(filepath.Join(rt.dir, name))
+	require.NoError(rt.t, err)
+	return bytes.Count(b, []byte("\n"))
+}
+
+func TestReload(t *testing.T) {
+	rt := newReloadTest(t, `[
+		{"type": "control.rate_limit", "name": "limit", "config": {"rps": 1000}},
+		{"type": "sink.file", "name": "out", "config": {"path": "$DIR/a.json", "format": "json"}}
+	]`)
+	before := rt.modules()
+
+	rt.send("/1", "/2")
+
+	rt.write(`[
+		{"type": "control.rate_limit", "name": "limit", "config": {"rps": 1000}},
+		{"type": "sink.file", "name": "out", "config": {"path": "$DIR/b.json", "format": "json"}}
+	]`)
+	require.NoError(t, rt.reloader.Reload())
+
+	status := rt.reloader.Status()
+	require.Equal(t, 1, status.Reloads)
+	require.Equal(t, []string{"limit"}, status.Kept)
+	require.Equal(t, []string{"out"}, status.Added)
+	require.Equal(t, []string{"out"}, status.Removed)
+	require.Same(t, before[0], rt.modules()[0])
+
+	// the replaced sink is drained and closed before the new one starts,
+	// the requests still held by the rate limit go to the new one
+	written := rt.lines("a.json")
+
+	rt.send("/3", "/4", "/5")
+	rt.stop()
+
+	require.Equal(t, written, rt.lines("a.json"))
+	require.Equal(t, 5, rt.lines("a.json")+rt.lines("b.json"))
+}
+
+func TestReloadInvalid(t *testing.T) {
+	rt := newReloadTest(t, `[
+		{"type": "control.identity", "name": "identity", "config": {}},
+		{"type": "sink.file", "name": "out", "config": {"path": "$DIR/out.json", "format": "json"}}
+	]`)
+	before := rt.modules()
+
+	rt.write(`[
+		{"type": "control.unknown"},
+		{"type": "sink.file", "name": "out", "config": {"path": "$DIR/other.json", "format": "xml"}}
+	]`)
+	err := rt.reloader.Reload()
+
+	var errs config.Errors
+	require.ErrorAs(t, err, &errs)
+	require.Len(t, errs, 2)
+	require.Equal(t, "pipeline[0]", errs[0].Path)
+	require.Equal(t, "pipeline[1]", errs[1].Path)
+
+	status := rt.reloader.Status()
+	require.Equal(t, 0, status.Reloads)
+	require.Equal(t, 1, status.Failures)
+	require.Len(t, status.Errors, 2)
+
+	// nothing changed
+	require.Equal(t, before, rt.modules())
+	rt.stop()
+}
+
+func TestReloadInsert(t *testing.T) {
+	rt := newReloadTest(t, `[
+		{"type": "control.identity", "name": "identity", "config": {}},
+		{"type": "sink.file", "name": "out", "config": {"path": "$DIR/out.json", "format": "json"}}
+	]`)
+
+	before := rt.modules()
+	rt.send("/1")
+
+	rt.write(`[
+		{"type": "control.identity", "name": "identity", "config": {}},
+		{"type": "control.filter", "name": "filter", "config": {"drop": "{req.path == '/2'}"}},
+		{"type": "sink.file", "name": "out", "config": {"path": "$DIR/out.json", "format": "json"}}
+	]`)
+	require.NoError(t, rt.reloader.Reload())
+	require.Equal(t, []string{"filter"}, rt.reloader.Status().Added)
+
+	after := rt.modules()
+	require.Len(t, after, 3)
+	require.Same(t, before[0], after[0])
+	require.Same(t, before[1], after[2])
+
+	rt.send("/2", "/3")
+	rt.stop()
+
+	require.Equal(t, 2, rt.lines("out.json"))
+}
+
+func TestReloadRemove(t *testing.T) {
+	rt := newReloadTest(t, `[
+		{"type": "control.identity", "name": "a", "config": {}},
+		{"type": "control.filter", "name": "b", "config": {"drop": "{req.path == '/x'}"}},
+		{"type": "control.identity", "name": "c", "config": {}},
+		{"type": "sink.file", "name": "d", "config": {"path": "$DIR/d.json", "format": "json"}}
+	]`)
+	before := rt.modules()
+	rt.send("/1", "/2")
+
+	// b drains into c while c still feeds d, which is drained next
+	rt.write(`[
+		{"type": "control.identity", "name": "a", "config": {}},
+		{"type": "control.identity", "name": "c", "config": {}},
+		{"type": "sink.file", "name": "e", "config": {"path": "$DIR/e.json", "format": "json"}}
+	]`)
+	require.NoError(t, rt.reloader.Reload())
+	require.Equal(t, []string{"b", "d"}, rt.reloader.Status().Removed)
+
+	after := rt.modules()
+	require.Same(t, before[0], after[0])
+	require.Same(t, before[2], after[1])
+
+	rt.send("/x", "/3")
+	rt.stop()
+
+	require.Equal(t, 4, rt.lines("d.json")+rt.lines("e.json"))
+}
+
+func TestReloadStartError(t *testing.T) {
+	rt := newReloadTest(t, `[
+		{"type": "control.identity", "name": "identity", "config": {}},
+		{"type": "sink.file", "name": "out", "config": {"path": "$DIR/out.json", "format": "json"}}
+	]`)
+	before := rt.modules()
+
+	// the filter starts, the new sink cannot create its file
+	rt.write(`[
+		{"type": "control.identity", "name": "identity", "config": {}},
+		{"type": "control.filter", "name": "filter", "config": {"drop": "{false}"}},
+		{"type": "sink.file", "name": "out", "config": {"path": "$DIR/nonexistent/out.json", "format": "json"}}
+	]`)
+	err := rt.reloader.Reload()
+
+	var errs config.Errors
+	require.ErrorAs(t, err, &errs)
+	require.Len(t, errs, 1)
+	require.Equal(t, "pipeline[2]", errs[0].Path)
+
+	status := rt.reloader.Status()
+	require.Equal(t, 0, status.Reloads)
+	require.Equal(t, 1, status.Failures)
+	require.Empty(t, status.Added)
+
+	// the old sink still receives the requests
+	require.Equal(t, before, rt.modules())
+	rt.send("/1", "/2")
+	rt.stop()
+
+	require.Equal(t, 2, rt.lines("out.json"))
+}
@@ -0,0 +1,615 @@
+// Package diskqueue is an append-only queue of requests stored in segment
+// files, with the proto framing of sink.file.
+package diskqueue
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/criteo/traffic-mirroring/mirror/codec"
+)
+
+const (
+	segmentExt = ".seg"
+	cursorFile = "cursor.json"
+
+	DefaultMaxSize      = 1 << 30
+	DefaultSegmentSize  = 64 << 20
+	DefaultSyncInterval = time.Second
+)
+
+var (
+	// ErrFull is returned by Push when the request would exceed the
+	// maximum size of the queue.
+	ErrFull = errors.New("disk queue is full")
+	// ErrEmpty is returned by Peek when there is nothing to read.
+	ErrEmpty = errors.New("disk queue is empty")
+)
+
+type Options struct {
+	// Dir is the directory of the segment files, created if needed
+	Dir string
+	// MaxSize is the maximum size of the segment files in bytes, segments
+	// are only removed once completely read
+	MaxSize int64
+	// SegmentSize is the size in bytes after which a new segment is started
+	SegmentSize int64
+	// Persist keeps the requests on disk when the queue is closed, they are
+	// read again when it is opened. Otherwise the directory is emptied.
+	Persist bool
+	// SyncInterval is how often the requests pushed are written to disk
+	// and the position of the reader is saved, with Persist. If the
+	// process crashes, the requests pushed during the last interval are
+	// lost, and the ones read are read again.
+	SyncInterval time.Duration
+}
+
+// cursor is the position of the reader, saved periodically and when the
+// queue is closed.
+type cursor struct {
+	Segment int   `json:"segment"`
+	Offset  int64 `json:"offset"`
+}
+
+// Queue is safe for a concurrent writer and reader. Requests are read in
+// the order they were pushed.
+type Queue struct {
+	opts Options
+
+	lock sync.Mutex
+	// segments are the numbers of the segment files, oldest first. The last
+	// one is being written, the first one is being read.
+	segments []int
+	size     int64
+	length   int
+
+	file *os.File
+	w    *bufio.Writer
+	cw   *countingWriter
+	enc  codec.Encoder
+	// segmentSize is the size of the segment being written
+	segmentSize int64
+
+	rfile *os.File
+	r     *bufio.Reader
+	cr    *countingReader
+	dec   codec.Decoder
+	// next is the request returned by Peek, until Advance is called, read
+	// at nextOffset
+	next       *mirror.Request
+	nextOffset int64
+
+	// syncErr is the error of the last periodic sync, returned by the next
+	// Push
+	syncErr  error
+	stopSync chan struct{}
+	syncDone chan struct{}
+}
+
+// Open opens the queue in opts.Dir. With opts.Persist, the requests left by
+// the previous queue in the directory are read first.
+func Open(opts Options) (*Queue, error) {
+	if opts.Dir == "" {
+		return nil, errors.New("dir is required")
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = DefaultMaxSize
+	}
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = DefaultSyncInterval
+	}
+
+	err := os.MkdirAll(opts.Dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Queue{opts: opts}
+
+	segments, err := q.listSegments()
+	if err != nil {
+		return nil, err
+	}
+
+	if !opts.Persist {
+		return q, q.removeAll(segments)
+	}
+
+	err = q.recover(segments)
+	if err != nil {
+		q.closeFiles()
+		return nil, err
+	}
+
+	q.stopSync = make(chan struct{})
+	q.syncDone = make(chan struct{})
+	go q.syncLoop()
+
+	return q, nil
+}
+
+func (q *Queue) syncLoop() {
+	defer close(q.syncDone)
+
+	t := time.NewTicker(q.opts.SyncInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			q.lock.Lock()
+			err := q.syncLocked()
+			if err != nil {
+				q.syncErr = err
+			}
+			q.lock.Unlock()
+		case <-q.stopSync:
+			return
+		}
+	}
+}
+
+// Sync writes the requests pushed to disk and saves the position of the
+// reader. It is called periodically with Persist.
+func (q *Queue) Sync() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.syncLocked()
+}
+
+func (q *Queue) syncLocked() error {
+	if q.w != nil {
+		err := q.w.Flush()
+		if err != nil {
+			return err
+		}
+		err = q.file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(q.segments) == 0 {
+		return nil
+	}
+	return q.saveCursorLocked()
+}
+
+// saveCursorLocked saves the position of the reader. A request returned by
+// Peek but not advanced is read again.
+func (q *Queue) saveCursorLocked() error {
+	c := cursor{}
+	if len(q.segments) > 0 {
+		c.Segment = q.segments[0]
+	}
+	if q.cr != nil {
+		c.Offset = q.cr.n - int64(q.r.Buffered())
+	}
+	if q.next != nil {
+		c.Offset = q.nextOffset
+	}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	// the cursor is replaced at once, a crash leaves the previous one
+	path := filepath.Join(q.opts.Dir, cursorFile)
+	err = os.WriteFile(path+".tmp", b, 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Push appends the request to the queue.
+func (q *Queue) Push(r mirror.Request) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.syncErr != nil {
+		err := q.syncErr
+		q.syncErr = nil
+		return fmt.Errorf("sync: %w", err)
+	}
+
+	b, err := codec.Marshal(codec.FormatProto, r)
+	if err != nil {
+		return err
+	}
+	// the varint size prefix is at most 10 bytes
+	if q.size+int64(len(b))+10 > q.opts.MaxSize {
+		return ErrFull
+	}
+
+	if q.enc == nil || q.segmentSize >= q.opts.SegmentSize {
+		err = q.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	before := q.cw.n
+	err = q.enc.Encode(r)
+	n := q.cw.n - before
+	q.segmentSize += n
+	q.size += n
+	if err != nil {
+		return err
+	}
+
+	q.length++
+	return nil
+}
+
+// Peek returns the oldest request of the queue, or ErrEmpty. The same
+// request is returned until Advance is called.
+func (q *Queue) Peek() (mirror.Request, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.next != nil {
+		return *q.next, nil
+	}
+	if q.length == 0 {
+		return mirror.Request{}, ErrEmpty
+	}
+
+	for {
+		if q.dec == nil {
+			err := q.openReader(q.segments[0], 0)
+			if err != nil {
+				return mirror.Request{}, err
+			}
+		}
+
+		if len(q.segments) == 1 && q.w != nil {
+			// the reader is on the segment being written
+			err := q.w.Flush()
+			if err != nil {
+				return mirror.Request{}, err
+			}
+		}
+
+		offset := q.cr.n - int64(q.r.Buffered())
+		r := mirror.Request{}
+		err := q.dec.Decode(&r)
+		if err == nil {
+			q.next = &r
+			q.nextOffset = offset
+			return r, nil
+		}
+		if err != io.EOF || len(q.segments) == 1 {
+			return mirror.Request{}, fmt.Errorf("error reading segment %d: %w", q.segments[0], err)
+		}
+
+		// the segment is completely read
+		err = q.removeFirst()
+		if err != nil {
+			return mirror.Request{}, err
+		}
+	}
+}
+
+// Advance removes the request returned by Peek.
+func (q *Queue) Advance() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.next == nil {
+		return
+	}
+	q.next = nil
+	q.length--
+
+	if q.length == 0 {
+		// everything is read, start over with a new segment to free the
+		// disk space
+		q.closeFiles()
+		_ = q.removeAll(q.segments)
+	}
+}
+
+// Len returns the number of requests in the queue.
+func (q *Queue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.length
+}
+
+// Size returns the size of the segment files in bytes.
+func (q *Queue) Size() int64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.size
+}
+
+// Close closes the segment files. With persistence they are kept with the
+// position of the reader, otherwise they are removed.
+func (q *Queue) Close() error {
+	if q.stopSync != nil {
+		close(q.stopSync)
+		<-q.syncDone
+		q.stopSync = nil
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if !q.opts.Persist {
+		q.closeFiles()
+		return q.removeAll(q.segments)
+	}
+
+	err := q.syncLocked()
+	q.next = nil
+	q.closeFiles()
+	return err
+}
+
+// recover counts the requests left in the segments after the saved
+// cursor. A request only partially written is truncated.
+func (q *Queue) recover(segments []int) error {
+	c := cursor{}
+	b, err := os.ReadFile(filepath.Join(q.opts.Dir, cursorFile))
+	if err == nil {
+		err = json.Unmarshal(b, &c)
+		if err != nil {
+			return fmt.Errorf("invalid cursor: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// segments before the cursor were completely read
+	for len(segments) > 0 && segments[0] < c.Segment {
+		err = os.Remove(q.segmentPath(segments[0]))
+		if err != nil {
+			return err
+		}
+		segments = segments[1:]
+	}
+	if len(segments) == 0 || segments[0] != c.Segment {
+		c.Offset = 0
+	}
+
+	for i, s := range segments {
+		offset := int64(0)
+		if i == 0 {
+			offset = c.Offset
+		}
+
+		n, end, err := countRecords(q.segmentPath(s), offset)
+		if err != nil {
+			return err
+		}
+
+		err = os.Truncate(q.segmentPath(s), end)
+		if err != nil {
+			return err
+		}
+		q.length += n
+		q.size += end
+	}
+
+	if q.length == 0 {
+		return q.removeAll(segments)
+	}
+
+	// new requests go to a new segment, the last one is left as is
+	last := segments[len(segments)-1]
+	q.segments = append(segments, last+1)
+	err = q.openWriter(last + 1)
+	if err != nil {
+		return err
+	}
+
+	return q.openReader(segments[0], c.Offset)
+}
+
+// countRecords returns the number of complete records after offset in the
+// segment, and the offset of the end of the last one.
+func countRecords(path string, offset int64) (int, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	cr := &countingReader{inner: f, n: offset}
+	r := bufio.NewReader(cr)
+	dec, err := codec.NewDecoder(r, codec.FormatProto)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	n := 0
+	end := offset
+	for {
+		req := mirror.Request{}
+		err = dec.Decode(&req)
+		if err != nil {
+			// io.EOF at the end of the last record, anything else is a
+			// partial write
+			return n, end, nil
+		}
+		n++
+		end = cr.n - int64(r.Buffered())
+	}
+}
+
+// rotate starts a new segment.
+func (q *Queue) rotate() error {
+	if q.w != nil {
+		err := q.w.Flush()
+		if err != nil {
+			return err
+		}
+		err = q.file.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	next := 0
+	if len(q.segments) > 0 {
+		next = q.segments[len(q.segments)-1] + 1
+	}
+	q.segments = append(q.segments, next)
+
+	return q.openWriter(next)
+}
+
+func (q *Queue) openWriter(segment int) error {
+	f, err := os.OpenFile(q.segmentPath(segment), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	q.file = f
+	q.w = bufio.NewWriter(f)
+	q.cw = &countingWriter{inner: q.w}
+	q.segmentSize = 0
+	q.enc, err = codec.NewEncoder(q.cw, codec.FormatProto)
+	return err
+}
+
+func (q *Queue) openReader(segment int, offset int64) error {
+	f, err := os.Open(q.segmentPath(segment))
+	if err != nil {
+		return err
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	q.rfile = f
+	q.cr = &countingReader{inner: f, n: offset}
+	q.r = bufio.NewReader(q.cr)
+	q.dec, err = codec.NewDecoder(q.r, codec.FormatProto)
+	return err
+}
+
+// removeFirst removes the segment being read, it must not be the one being
+// written.
+func (q *Queue) removeFirst() error {
+	q.rfile.Close()
+	q.rfile, q.r, q.cr, q.dec = nil, nil, nil, nil
+
+	path := q.segmentPath(q.segments[0])
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if err != nil {
+		return err
+	}
+
+	q.size -= info.Size()
+	q.segments = q.segments[1:]
+	return nil
+}
+
+func (q *Queue) closeFiles() {
+	if q.file != nil {
+		q.file.Close()
+	}
+	if q.rfile != nil {
+		q.rfile.Close()
+	}
+	q.file, q.w, q.cw, q.enc = nil, nil, nil, nil
+	q.rfile, q.r, q.cr, q.dec = nil, nil, nil, nil
+}
+
+func (q *Queue) removeAll(segments []int) error {
+	for _, s := range segments {
+		err := os.Remove(q.segmentPath(s))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	err := os.Remove(filepath.Join(q.opts.Dir, cursorFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	q.segments = nil
+	q.size = 0
+	q.length = 0
+	return nil
+}
+
+func (q *Queue) listSegments() ([]int, error) {
+	entries, err := os.ReadDir(q.opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []int{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(name, segmentExt))
+		if err != nil {
+			continue
+		}
+		segments = append(segments, n)
+	}
+	sort.Ints(segments)
+
+	return segments, nil
+}
+
+func (q *Queue) segmentPath(segment int) string {
+	return filepath.Join(q.opts.Dir, fmt.Sprintf("%016d%s", segment, segmentExt))
+}
+
+type countingWriter struct {
+	inner io.Writer
+	n     int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.inner.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	inner io.Reader
+	n     int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.inner.Read(b)
+	r.n += int64(n)
+	return n, err
+}
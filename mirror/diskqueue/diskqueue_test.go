@@ -0,0 +1,169 @@
+package diskqueue_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/criteo/traffic-mirroring/mirror/diskqueue"
+	"github.com/stretchr/testify/require"
+)
+
+func push(t *testing.T, q *diskqueue.Queue, from, to int) {
+	for i := from; i < to; i++ {
+		require.NoError(t, q.Push(mirror.Request{Path: fmt.Sprintf("/%d", i)}))
+	}
+}
+
+func pop(t *testing.T, q *diskqueue.Queue, from, to int) {
+	for i := from; i < to; i++ {
+		r, err := q.Peek()
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("/%d", i), r.Path)
+		q.Advance()
+	}
+}
+
+func segments(t *testing.T, dir string) int {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	require.NoError(t, err)
+	return len(matches)
+}
+
+func TestQueue(t *testing.T) {
+	dir := t.TempDir()
+	q, err := diskqueue.Open(diskqueue.Options{Dir: dir, SegmentSize: 64})
+	require.NoError(t, err)
+
+	_, err = q.Peek()
+	require.Equal(t, diskqueue.ErrEmpty, err)
+
+	push(t, q, 0, 20)
+	require.Equal(t, 20, q.Len())
+	require.Greater(t, segments(t, dir), 1)
+
+	// reading and writing are interleaved
+	pop(t, q, 0, 10)
+	push(t, q, 20, 30)
+	pop(t, q, 10, 30)
+
+	require.Equal(t, 0, q.Len())
+	require.Equal(t, int64(0), q.Size())
+	require.Equal(t, 0, segments(t, dir))
+
+	require.NoError(t, q.Close())
+}
+
+func TestQueueFull(t *testing.T) {
+	q, err := diskqueue.Open(diskqueue.Options{Dir: t.TempDir(), MaxSize: 100})
+	require.NoError(t, err)
+	defer q.Close()
+
+	n := 0
+	for ; n < 100; n++ {
+		err = q.Push(mirror.Request{Path: fmt.Sprintf("/%d", n)})
+		if err != nil {
+			break
+		}
+	}
+	require.Equal(t, diskqueue.ErrFull, err)
+	require.LessOrEqual(t, q.Size(), int64(100))
+
+	// the space is freed once everything is read
+	pop(t, q, 0, n)
+	push(t, q, 0, 1)
+}
+
+func TestQueuePersist(t *testing.T) {
+	dir := t.TempDir()
+	opts := diskqueue.Options{Dir: dir, SegmentSize: 64, Persist: true}
+
+	q, err := diskqueue.Open(opts)
+	require.NoError(t, err)
+	push(t, q, 0, 20)
+	pop(t, q, 0, 5)
+
+	// peeked but not advanced, it is read again
+	_, err = q.Peek()
+	require.NoError(t, err)
+	require.NoError(t, q.Close())
+
+	q, err = diskqueue.Open(opts)
+	require.NoError(t, err)
+	require.Equal(t, 15, q.Len())
+	push(t, q, 20, 25)
+	pop(t, q, 5, 25)
+	require.NoError(t, q.Close())
+
+	q, err = diskqueue.Open(opts)
+	require.NoError(t, err)
+	require.Equal(t, 0, q.Len())
+	require.NoError(t, q.Close())
+}
+
+func TestQueueCrash(t *testing.T) {
+	dir := t.TempDir()
+	opts := diskqueue.Options{Dir: dir, SegmentSize: 64, Persist: true, SyncInterval: 10 * time.Millisecond}
+
+	q, err := diskqueue.Open(opts)
+	require.NoError(t, err)
+	// only stops the periodic sync once the test is done
+	defer q.Close()
+	push(t, q, 0, 20)
+	pop(t, q, 0, 5)
+
+	// the queue is not closed, the requests and the cursor are on disk
+	// after a sync
+	time.Sleep(50 * time.Millisecond)
+
+	crashed, err := diskqueue.Open(opts)
+	require.NoError(t, err)
+	require.Equal(t, 15, crashed.Len())
+	pop(t, crashed, 5, 20)
+	require.NoError(t, crashed.Close())
+}
+
+func TestQueuePartialWrite(t *testing.T) {
+	dir := t.TempDir()
+	opts := diskqueue.Options{Dir: dir, Persist: true}
+
+	q, err := diskqueue.Open(opts)
+	require.NoError(t, err)
+	push(t, q, 0, 3)
+	require.NoError(t, q.Close())
+
+	// a crash in the middle of a write
+	matches, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+	f, err := os.OpenFile(matches[0], os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{42, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	q, err = diskqueue.Open(opts)
+	require.NoError(t, err)
+	require.Equal(t, 3, q.Len())
+	pop(t, q, 0, 3)
+	require.NoError(t, q.Close())
+}
+
+func TestQueueNoPersist(t *testing.T) {
+	dir := t.TempDir()
+	opts := diskqueue.Options{Dir: dir}
+
+	q, err := diskqueue.Open(opts)
+	require.NoError(t, err)
+	push(t, q, 0, 3)
+	require.NoError(t, q.Close())
+	require.Equal(t, 0, segments(t, dir))
+
+	q, err = diskqueue.Open(opts)
+	require.NoError(t, err)
+	require.Equal(t, 0, q.Len())
+	require.NoError(t, q.Close())
+}
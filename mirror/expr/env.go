@@ -1,11 +1,14 @@
 package expr
 
 import (
+	"net/url"
+
 	"github.com/criteo/traffic-mirroring/mirror"
 	"github.com/google/cel-go/cel"
 	"github.com/google/cel-go/checker/decls"
 	"github.com/google/cel-go/common/types"
 	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/ext"
 	"github.com/google/cel-go/interpreter/functions"
 	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
 )
@@ -27,6 +30,13 @@ func (customLib) CompileOptions() []cel.EnvOption {
 				decls.String,
 			),
 		),
+		decls.NewFunction("query_param",
+			decls.NewInstanceOverload(
+				"query_param",
+				[]*exprpb.Type{reqType, decls.String},
+				decls.String,
+			),
+		),
 	}
 	for name, v := range mirror.Method_value {
 		c := &exprpb.Constant{ConstantKind: &exprpb.Constant_Int64Value{Int64Value: int64(v)}}
@@ -51,7 +61,7 @@ func (customLib) ProgramOptions() []cel.ProgramOption {
 					req := lhs.Value().(*mirror.Request)
 					name := rhs.Value().(string)
 
-					v := req.Headers[name].Values
+					v := req.Headers[name].GetValues()
 					if len(v) == 0 {
 						return types.String("")
 					}
@@ -59,12 +69,24 @@ func (customLib) ProgramOptions() []cel.ProgramOption {
 					return types.String(v[0])
 				},
 			},
+			&functions.Overload{
+				Operator: "query_param",
+				Binary: func(lhs, rhs ref.Val) ref.Val {
+					req := lhs.Value().(*mirror.Request)
+					name := rhs.Value().(string)
+
+					// an invalid query still returns the params parsed
+					// before the error
+					values, _ := url.ParseQuery(req.Query)
+					return types.String(values.Get(name))
+				},
+			},
 		),
 	}
 }
 
 func init() {
-	e, err := cel.NewEnv(cel.Lib(customLib{}))
+	e, err := cel.NewEnv(cel.Lib(customLib{}), ext.Strings())
 	if err != nil {
 		panic(err)
 	}
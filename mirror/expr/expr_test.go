@@ -18,22 +18,34 @@ var testCases = map[string]interface{}{
 	"{true}":  true,
 	"{false}": false,
 
-	"{req.path}":           "/index.html",
-	"{req.method == GET}":  true,
-	`{req.header("Host")}`: "www.google.com",
-	`{req.meta.key1.int}`:  int64(42),
+	"{req.path}":              "/index.html",
+	"{req.method == GET}":     true,
+	`{req.header("Host")}`:    "www.google.com",
+	`{req.header("Missing")}`: "",
+	`{req.meta.key1.int}`:     int64(42),
+
+	`{req.query}`:                "q=mirror&page=2",
+	`{req.query_param("q")}`:     "mirror",
+	`{req.query_param("other")}`: "",
+	`{req.authority}`:            "www.google.com",
+
+	`{req.path.replace(".html", ".css")}`: "/index.css",
+	`{req.response.status_code >= 500}`:   true,
 }
 
 func TestParseTmpl(t *testing.T) {
 	r := mirror.Request{
-		Method: mirror.Method_GET,
-		Path:   "/index.html",
+		Method:    mirror.Method_GET,
+		Path:      "/index.html",
+		Query:     "q=mirror&page=2",
+		Authority: "www.google.com",
 		Headers: map[string]*mirror.HeaderValue{
 			"Host": {Values: []string{"www.google.com"}},
 		},
 		Meta: map[string]*mirror.MetaValue{
 			"key1": {Value: &mirror.MetaValue_Int{Int: 42}},
 		},
+		Response: &mirror.Response{StatusCode: 503},
 	}
 
 	for str, expected := range testCases {
@@ -2,18 +2,45 @@ package graph
 
 import (
 	"fmt"
+	"html"
 	"io"
 	"os/exec"
+	"sort"
 	"strings"
 
 	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/criteo/traffic-mirroring/mirror/pubsub"
 	"github.com/emicklei/dot"
 )
 
+// topicEnds are the nodes publishing and subscribed to a topic.
+type topicEnds struct {
+	publishers  []dot.Node
+	subscribers []dot.Node
+}
+
 func FromModule(m mirror.Module) *dot.Graph {
 	g := dot.NewGraph(dot.Directed)
 	g.Attr("nodesep", "2")
-	processNode(g, nil, m)
+
+	topics := map[string]*topicEnds{}
+	processNode(g, topics, nil, m)
+
+	// the pipelines connected by a topic are linked by dashed edges
+	names := []string{}
+	for name := range topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, pub := range topics[name].publishers {
+			for _, sub := range topics[name].subscribers {
+				g.Edge(pub, sub, name).Attr("style", "dashed")
+			}
+		}
+	}
+
 	return g
 }
 
@@ -26,19 +53,59 @@ func GraphSVG(g *dot.Graph, w io.Writer) error {
 	return cmd.Run()
 }
 
-func processNode(g *dot.Graph, parents []dot.Node, m mirror.Module) []dot.Node {
+func processNode(g *dot.Graph, topics map[string]*topicEnds, parents []dot.Node, m mirror.Module) []dot.Node {
 	ctx := m.Context()
 	current := g.Node(ctx.Name)
 	role := ctx.Role()
 
+	topic := func(name string) *topicEnds {
+		if topics[name] == nil {
+			topics[name] = &topicEnds{}
+		}
+		return topics[name]
+	}
+	if pub, ok := m.(pubsub.Publisher); ok {
+		t := topic(pub.PublishedTopic())
+		t.publishers = append(t.publishers, current)
+	}
+	if sub, ok := m.(pubsub.Subscriber); ok {
+		t := topic(sub.SubscribedTopic())
+		t.subscribers = append(t.subscribers, current)
+	}
+
 	if role != "virtual" {
+		errors := ""
+		if n := ctx.Errors(); n > 0 {
+			errors = fmt.Sprintf(
+				`<FONT point-size="11" color="#D7263D"><B>Errors:</B>&nbsp;&nbsp;&nbsp;%d (%s)</FONT><BR />`,
+				n, ctx.ErrorPolicy,
+			)
+		}
+
+		params := ""
+		if t, ok := m.(mirror.Tunable); ok {
+			params = formatParams(t.Params())
+		}
+		if r, ok := m.(mirror.StateReporter); ok {
+			params += formatState(r.State())
+		}
+		if ctx.Paused() {
+			params += `<FONT point-size="11" color="#D7263D"><B>Paused</B></FONT><BR />`
+		}
+
 		current.Attr("label", dot.HTML(
 			fmt.Sprintf(`
 				%s<BR />
 				<FONT point-size="11"><B>Throughput:</B>&nbsp;&nbsp;&nbsp;%d/s</FONT><BR />
+				%s
+				%s
 				<FONT point-size="10">%s</FONT>
-			`, ctx.Name, ctx.RPS, ctx.Type),
+			`, ctx.Name, ctx.RPS(), errors, params, ctx.Type),
 		))
+
+		if last := ctx.LastError(); last != "" {
+			current.Attr("tooltip", last)
+		}
 	}
 
 	current.Attr("width", "3")
@@ -76,7 +143,7 @@ func processNode(g *dot.Graph, parents []dot.Node, m mirror.Module) []dot.Node {
 	for _, group := range children {
 		parents := []dot.Node{current}
 		for i, child := range group {
-			parents = processNode(g, parents, child)
+			parents = processNode(g, topics, parents, child)
 
 			if i == len(group)-1 {
 				leafs = append(leafs, parents...)
@@ -90,3 +157,38 @@ func processNode(g *dot.Graph, parents []dot.Node, m mirror.Module) []dot.Node {
 
 	return leafs
 }
+
+// formatParams formats the parameters of a tunable module, one per line.
+func formatParams(params map[string]interface{}) string {
+	names := []string{}
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	res := ""
+	for _, name := range names {
+		if params[name] == nil {
+			continue
+		}
+		res += fmt.Sprintf(`<FONT point-size="11"><B>%s:</B>&nbsp;&nbsp;&nbsp;%v</FONT><BR />`, html.EscapeString(name), html.EscapeString(fmt.Sprint(params[name])))
+	}
+
+	return res
+}
+
+// formatState formats the state reported by a module, one line per entry.
+func formatState(state map[string]string) string {
+	names := []string{}
+	for name := range state {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	res := ""
+	for _, name := range names {
+		res += fmt.Sprintf(`<FONT point-size="11" color="#D7263D"><B>%s:</B>&nbsp;&nbsp;&nbsp;%s</FONT><BR />`, html.EscapeString(name), html.EscapeString(state[name]))
+	}
+
+	return res
+}
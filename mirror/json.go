@@ -0,0 +1,38 @@
+package mirror
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// UnmarshalJSON decodes meta values as written by encoding/json, which
+// cannot decode the oneof field on its own.
+func (m *MetaValue) UnmarshalJSON(b []byte) error {
+	v := struct {
+		Value *struct {
+			String_ *string
+			Int     *int64
+			Bool    *bool
+		}
+	}{}
+
+	err := json.Unmarshal(b, &v)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case v.Value == nil:
+		m.Value = nil
+	case v.Value.String_ != nil:
+		m.Value = &MetaValue_String_{String_: *v.Value.String_}
+	case v.Value.Int != nil:
+		m.Value = &MetaValue_Int{Int: *v.Value.Int}
+	case v.Value.Bool != nil:
+		m.Value = &MetaValue_Bool{Bool: *v.Value.Bool}
+	default:
+		return errors.New("unknown meta value type")
+	}
+
+	return nil
+}
@@ -1,12 +1,17 @@
 package mirror
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
 )
 
 var (
@@ -14,28 +19,169 @@ var (
 		Name: "requets_total",
 		Help: "The total number of requets handled by the module",
 	}, []string{"module"})
+
+	ErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "module_errors_total",
+		Help: "The total number of runtime errors reported by the module",
+	}, []string{"module", "policy"})
+)
+
+// ErrorPolicy tells a module what to do after a runtime error.
+type ErrorPolicy string
+
+const (
+	// ErrorPolicySkip drops the request that caused the error.
+	ErrorPolicySkip ErrorPolicy = "skip"
+	// ErrorPolicyRestart drops the request and resets the state of the
+	// module, e.g. reopens a file or a listener.
+	ErrorPolicyRestart ErrorPolicy = "restart"
+	// ErrorPolicyFail drops the request and stops the whole pipeline.
+	ErrorPolicyFail ErrorPolicy = "fail"
 )
 
+func ParseErrorPolicy(s string) (ErrorPolicy, error) {
+	switch p := ErrorPolicy(s); p {
+	case "":
+		return ErrorPolicySkip, nil
+	case ErrorPolicySkip, ErrorPolicyRestart, ErrorPolicyFail:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown error policy %q", s)
+	}
+}
+
 type ModuleContext struct {
-	Type           string
-	Name           string
-	RPS            int
+	Type string
+	Name string
+
+	// requestCounter counts the requests of the second rpsSecond, rps is
+	// the count of the second before. They are updated by the requests and
+	// by RPS, so that modules need no goroutine.
+	rpsLock        sync.Mutex
+	rpsSecond      int64
+	rps            uint64
 	requestCounter uint64
+
+	// ConfigPath is the JSON path of the config of the module in the
+	// configuration file, used to locate the errors of its children.
+	ConfigPath string
+
+	ErrorPolicy ErrorPolicy
+	// OnFail is called when the module reports an error with the fail
+	// policy.
+	OnFail     func(ctx *ModuleContext, err error)
+	errorCount uint64
+	lastError  atomic.Value
+
+	paused    uint32
+	pauseLock sync.Mutex
+	// resumed is closed when the module is resumed
+	resumed chan struct{}
 }
 
 func (c *ModuleContext) Role() string {
 	return strings.Split(c.Type, ".")[0]
 }
 
+// HandledRequest counts a request handled by the module. It blocks while
+// the module is paused.
 func (c *ModuleContext) HandledRequest() {
+	if atomic.LoadUint32(&c.paused) == 1 {
+		c.pauseLock.Lock()
+		resumed := c.resumed
+		c.pauseLock.Unlock()
+		if resumed != nil {
+			<-resumed
+		}
+	}
+
+	c.rotateRPS(time.Now().Unix())
 	atomic.AddUint64(&c.requestCounter, 1)
 	RequestsTotal.WithLabelValues(c.Name).Inc()
 }
 
-func (c *ModuleContext) Run() {
-	for range time.Tick(time.Second) {
-		c.RPS = int(atomic.SwapUint64(&c.requestCounter, 0))
+// Error reports a runtime error of the module, and returns the policy the
+// module must apply. Whatever the policy, the request being handled is
+// dropped.
+func (c *ModuleContext) Error(err error) ErrorPolicy {
+	policy := c.ErrorPolicy
+	if policy == "" {
+		policy = ErrorPolicySkip
+	}
+
+	atomic.AddUint64(&c.errorCount, 1)
+	c.lastError.Store(err.Error())
+	ErrorsTotal.WithLabelValues(c.Name, string(policy)).Inc()
+	log.Errorf("%s: %s", c.Name, err)
+
+	if policy == ErrorPolicyFail && c.OnFail != nil {
+		c.OnFail(c, err)
+	}
+
+	return policy
+}
+
+func (c *ModuleContext) Errors() uint64 {
+	return atomic.LoadUint64(&c.errorCount)
+}
+
+func (c *ModuleContext) LastError() string {
+	s, _ := c.lastError.Load().(string)
+	return s
+}
+
+// SetPaused pauses or resumes the module. A paused module stops handling
+// requests, so that its input backs up.
+func (c *ModuleContext) SetPaused(paused bool) {
+	c.pauseLock.Lock()
+	defer c.pauseLock.Unlock()
+
+	if paused == (c.resumed != nil) {
+		return
+	}
+
+	if paused {
+		c.resumed = make(chan struct{})
+		atomic.StoreUint32(&c.paused, 1)
+		return
+	}
+
+	atomic.StoreUint32(&c.paused, 0)
+	close(c.resumed)
+	c.resumed = nil
+}
+
+func (c *ModuleContext) Paused() bool {
+	return atomic.LoadUint32(&c.paused) == 1
+}
+
+// RPS returns the number of requests handled during the last second.
+func (c *ModuleContext) RPS() int {
+	c.rotateRPS(time.Now().Unix())
+	return int(atomic.LoadUint64(&c.rps))
+}
+
+// rotateRPS starts counting the requests of the given second.
+func (c *ModuleContext) rotateRPS(second int64) {
+	if atomic.LoadInt64(&c.rpsSecond) == second {
+		return
+	}
+
+	c.rpsLock.Lock()
+	defer c.rpsLock.Unlock()
+
+	prev := atomic.LoadInt64(&c.rpsSecond)
+	if prev == second {
+		return
+	}
+
+	count := atomic.SwapUint64(&c.requestCounter, 0)
+	if second != prev+1 {
+		// no request was handled during the last second
+		count = 0
 	}
+	atomic.StoreUint64(&c.rps, count)
+	atomic.StoreInt64(&c.rpsSecond, second)
 }
 
 type Module interface {
@@ -43,4 +189,57 @@ type Module interface {
 	SetInput(<-chan Request)
 	Output() <-chan Request
 	Children() [][]Module
+
+	// Start is called once the whole pipeline is connected. Sources start
+	// listening or reading there, and not when they are created.
+	Start() error
+	// Stop makes sources stop producing requests and close their output.
+	// Other modules keep processing their input until it is closed, so
+	// stopping the pipeline lets the requests in flight drain through it.
+	// Stop can be called several times, or before Start.
+	Stop()
+}
+
+// Tunable is implemented by the modules whose parameters can be changed
+// while they run, through the admin API.
+type Tunable interface {
+	// Params returns the current value of the parameters.
+	Params() map[string]interface{}
+	// SetParams changes the parameters of the JSON object b, see
+	// DecodeParams. Nothing is changed if one of them is invalid.
+	SetParams(b []byte) error
+}
+
+// Restartable is implemented by the modules which reset their state when
+// Error returns ErrorPolicyRestart. The restart policy is refused for the
+// other modules.
+type Restartable interface {
+	// Restartable is only a marker, the modules restart by themselves.
+	Restartable()
+}
+
+// StateReporter is implemented by the modules with a runtime state to show
+// on the graph.
+type StateReporter interface {
+	// State returns the state to show by name, nothing when all is well.
+	State() map[string]string
+}
+
+// DecodeParams decodes the parameters given to SetParams into v, a struct
+// of pointers to tell the parameters which are not changed. Unknown
+// parameters are an error.
+func DecodeParams(b []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// Walk calls fn on the module and all its descendants.
+func Walk(m Module, fn func(Module)) {
+	fn(m)
+	for _, group := range m.Children() {
+		for _, child := range group {
+			Walk(child, fn)
+		}
+	}
 }
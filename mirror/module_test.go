@@ -0,0 +1,81 @@
+package mirror
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseErrorPolicy(t *testing.T) {
+	p, err := ParseErrorPolicy("")
+	require.NoError(t, err)
+	require.Equal(t, ErrorPolicySkip, p)
+
+	p, err = ParseErrorPolicy("restart")
+	require.NoError(t, err)
+	require.Equal(t, ErrorPolicyRestart, p)
+
+	_, err = ParseErrorPolicy("retry")
+	require.Error(t, err)
+}
+
+func TestModuleContextError(t *testing.T) {
+	failed := 0
+	ctx := &ModuleContext{
+		Name: t.Name(),
+		OnFail: func(*ModuleContext, error) {
+			failed++
+		},
+	}
+
+	require.Equal(t, ErrorPolicySkip, ctx.Error(errors.New("first")))
+	require.Equal(t, 0, failed)
+
+	ctx.ErrorPolicy = ErrorPolicyFail
+	require.Equal(t, ErrorPolicyFail, ctx.Error(errors.New("second")))
+	require.Equal(t, 1, failed)
+
+	require.Equal(t, uint64(2), ctx.Errors())
+	require.Equal(t, "second", ctx.LastError())
+}
+
+func TestModuleContextRPS(t *testing.T) {
+	ctx := &ModuleContext{Name: t.Name()}
+
+	for i := 0; i < 3; i++ {
+		ctx.HandledRequest()
+	}
+	second := atomic.LoadInt64(&ctx.rpsSecond)
+
+	ctx.rotateRPS(second + 1)
+	require.Equal(t, 3, int(atomic.LoadUint64(&ctx.rps)))
+
+	// the module was idle for a second
+	ctx.rotateRPS(second + 3)
+	require.Equal(t, 0, int(atomic.LoadUint64(&ctx.rps)))
+}
+
+func TestModuleContextPause(t *testing.T) {
+	ctx := &ModuleContext{Name: t.Name()}
+	ctx.SetPaused(true)
+	require.True(t, ctx.Paused())
+
+	handled := make(chan struct{})
+	go func() {
+		ctx.HandledRequest()
+		close(handled)
+	}()
+
+	select {
+	case <-handled:
+		t.Fatal("the request was handled while paused")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	ctx.SetPaused(false)
+	<-handled
+	require.False(t, ctx.Paused())
+}
@@ -2,10 +2,15 @@ package control
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/criteo/traffic-mirroring/mirror/diskqueue"
+	"github.com/criteo/traffic-mirroring/mirror/expr"
 	"github.com/criteo/traffic-mirroring/mirror/registry"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -13,8 +18,14 @@ import (
 )
 
 const (
-	DecoupleName       = "control.decouple"
-	logDroppedInterval = 10 * time.Second
+	DecoupleName        = "control.decouple"
+	logDroppedInterval  = 10 * time.Second
+	accountFullInterval = time.Second
+
+	OverflowDropNewest = "drop_newest"
+	OverflowDropOldest = "drop_oldest"
+	OverflowBlock      = "block"
+	OverflowPriority   = "priority"
 )
 
 var (
@@ -22,6 +33,26 @@ var (
 		Name: "decouple_dropped_total",
 		Help: "The total number of responses dropped",
 	}, []string{"module"})
+
+	spilledTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "decouple_spilled_total",
+		Help: "The total number of requests written to the disk queue",
+	}, []string{"module"})
+
+	replayedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "decouple_replayed_total",
+		Help: "The total number of requests read back from the disk queue",
+	}, []string{"module"})
+
+	spillDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "decouple_spill_depth",
+		Help: "The number of requests in the disk queue",
+	}, []string{"module"})
+
+	spillBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "decouple_spill_bytes",
+		Help: "The size of the disk queue in bytes",
+	}, []string{"module"})
 )
 
 func init() {
@@ -29,14 +60,39 @@ func init() {
 }
 
 type DecoupleConfig struct {
-	Quiet     bool `json:"log"`
-	QueueSize int  `json:"queue_size"`
+	Quiet        bool                 `json:"log"`
+	QueueSize    int                  `json:"queue_size"`
+	Overflow     string               `json:"overflow,omitempty"`
+	BlockTimeout string               `json:"block_timeout,omitempty"`
+	Priority     *expr.BoolExpr       `json:"priority,omitempty"`
+	Spill        *DecoupleSpillConfig `json:"spill,omitempty"`
+}
+
+// DecoupleSpillConfig writes the requests to disk instead of dropping them
+// when the queue is full.
+type DecoupleSpillConfig struct {
+	Dir          string `json:"dir"`
+	MaxSize      int64  `json:"max_size,omitempty"`
+	SegmentSize  int64  `json:"segment_size,omitempty"`
+	Persist      bool   `json:"persist,omitempty"`
+	SyncInterval string `json:"sync_interval,omitempty"`
 }
 
 type Decouple struct {
-	ctx   *mirror.ModuleContext
-	out   chan mirror.Request
-	quiet bool
+	ctx          *mirror.ModuleContext
+	cfg          DecoupleConfig
+	out          chan mirror.Request
+	queue        *requestQueue
+	blockTimeout time.Duration
+	spill        *DecoupleSpillConfig
+	syncInterval time.Duration
+
+	lock        sync.Mutex
+	disk        *diskqueue.Queue
+	inputClosed bool
+	// notify wakes up the replay when a request is spilled
+	notify    chan struct{}
+	inputDone chan struct{}
 }
 
 func NewDecouple(ctx *mirror.ModuleContext, cfg []byte) (mirror.Module, error) {
@@ -52,11 +108,50 @@ func NewDecouple(ctx *mirror.ModuleContext, cfg []byte) (mirror.Module, error) {
 	}
 
 	mod := &Decouple{
-		ctx:   ctx,
-		out:   make(chan mirror.Request, queueSize),
-		quiet: c.Quiet,
+		ctx:       ctx,
+		cfg:       c,
+		out:       make(chan mirror.Request),
+		spill:     c.Spill,
+		notify:    make(chan struct{}, 1),
+		inputDone: make(chan struct{}),
+	}
+
+	switch c.Overflow {
+	case "":
+		mod.cfg.Overflow = OverflowDropNewest
+	case OverflowDropNewest, OverflowDropOldest:
+	case OverflowBlock:
+		if c.BlockTimeout != "" {
+			mod.blockTimeout, err = time.ParseDuration(c.BlockTimeout)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case OverflowPriority:
+		if c.Priority == nil {
+			return nil, errors.New("priority is required with the priority overflow policy")
+		}
+	default:
+		return nil, fmt.Errorf("unknown overflow policy %q", c.Overflow)
 	}
 
+	if c.Spill != nil {
+		if c.Spill.Dir == "" {
+			return nil, errors.New("spill.dir is required")
+		}
+		if mod.cfg.Overflow != OverflowDropNewest {
+			return nil, fmt.Errorf("spill cannot be used with the %s overflow policy", mod.cfg.Overflow)
+		}
+		if c.Spill.SyncInterval != "" {
+			mod.syncInterval, err = time.ParseDuration(c.Spill.SyncInterval)
+			if err != nil {
+				return nil, fmt.Errorf("spill.sync_interval: %w", err)
+			}
+		}
+	}
+
+	mod.queue = newRequestQueue(ctx.Name, queueSize)
+
 	return mod, nil
 }
 
@@ -68,6 +163,41 @@ func (m *Decouple) Children() [][]mirror.Module {
 	return nil
 }
 
+func (m *Decouple) Start() error {
+	if m.spill == nil {
+		return nil
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.disk != nil || m.inputClosed {
+		return nil
+	}
+
+	q, err := diskqueue.Open(diskqueue.Options{
+		Dir:          m.spill.Dir,
+		MaxSize:      m.spill.MaxSize,
+		SegmentSize:  m.spill.SegmentSize,
+		Persist:      m.spill.Persist,
+		SyncInterval: m.syncInterval,
+	})
+	if err != nil {
+		return err
+	}
+	if q.Len() > 0 {
+		log.Infof("%s: replaying %d requests from %s", m.ctx.Name, q.Len(), m.spill.Dir)
+	}
+
+	m.disk = q
+	m.updateSpillGauges()
+	go m.replay()
+
+	return nil
+}
+
+func (m *Decouple) Stop() {}
+
 func (m *Decouple) Output() <-chan mirror.Request {
 	return m.out
 }
@@ -80,28 +210,273 @@ func (m *Decouple) SetInput(c <-chan mirror.Request) {
 		for r := range c {
 			atomic.AddUint32(&processed, 1)
 			m.ctx.HandledRequest()
-			select {
-			case m.out <- r:
-			default:
-				droppedTotal.WithLabelValues(m.ctx.Name).Inc()
-				atomic.AddUint32(&dropped, 1)
+
+			d := m.push(r)
+			if d > 0 {
+				droppedTotal.WithLabelValues(m.ctx.Name).Add(float64(d))
+				atomic.AddUint32(&dropped, uint32(d))
+			}
+		}
+
+		if m.spill == nil {
+			m.queue.close()
+			return
+		}
+
+		m.lock.Lock()
+		defer m.lock.Unlock()
+
+		// the queue is closed by the replay once the disk queue is done
+		m.inputClosed = true
+		close(m.inputDone)
+		if m.disk == nil {
+			m.queue.close()
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			r, ok := m.queue.pop()
+			if !ok {
+				break
 			}
+			m.out <- r
 		}
 		close(m.out)
+		close(done)
+	}()
+
+	go func() {
+		ticker := time.NewTicker(accountFullInterval)
+		defer ticker.Stop()
+
+		last := time.Now()
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+
+			m.queue.accountFull()
+			if m.cfg.Quiet || time.Since(last) < logDroppedInterval {
+				continue
+			}
+			last = time.Now()
+
+			d := atomic.SwapUint32(&dropped, 0)
+			p := atomic.SwapUint32(&processed, 0)
+			if d == 0 {
+				log.Debugf("%s: dropped %d of %d requests", DecoupleName, d, p)
+			} else {
+				log.Warnf("%s: dropped %d of %d requests", DecoupleName, d, p)
+			}
+		}
 	}()
+}
+
+func (m *Decouple) Params() map[string]interface{} {
+	return map[string]interface{}{
+		"queue_size": m.queue.getCapacity(),
+	}
+}
 
-	if !m.quiet {
-		go func() {
-			for range time.Tick(logDroppedInterval) {
-				d := atomic.SwapUint32(&dropped, 0)
-				p := atomic.SwapUint32(&processed, 0)
-				if d == 0 {
-					log.Debugf("%s: dropped %d of %d requests", DecoupleName, d, p)
-				} else {
-					log.Warnf("%s: dropped %d of %d requests", DecoupleName, d, p)
+func (m *Decouple) SetParams(b []byte) error {
+	p := struct {
+		QueueSize *int `json:"queue_size"`
+	}{}
+	err := mirror.DecodeParams(b, &p)
+	if err != nil {
+		return err
+	}
+
+	if p.QueueSize != nil {
+		if *p.QueueSize <= 0 {
+			return errors.New("queue_size must be positive")
+		}
+		m.queue.setCapacity(*p.QueueSize)
+	}
+
+	return nil
+}
+
+// push queues the request according to the overflow policy, it returns the
+// number of requests dropped.
+func (m *Decouple) push(r mirror.Request) int {
+	if m.spill != nil {
+		return m.spillPush(r)
+	}
+
+	switch m.cfg.Overflow {
+	case OverflowDropOldest:
+		// the input is the only writer, there is room once the oldest
+		// requests are dropped
+		return m.pushDropOldest(r, false)
+
+	case OverflowBlock:
+		var timeout <-chan time.Time
+		if m.blockTimeout > 0 {
+			timer := time.NewTimer(m.blockTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		for {
+			ok, changed := m.queue.push(r, false)
+			if ok {
+				return 0
+			}
+
+			select {
+			case <-changed:
+			case <-timeout:
+				return 1
+			}
+		}
+
+	case OverflowPriority:
+		high, err := m.cfg.Priority.Eval(r)
+		if err != nil {
+			m.ctx.Error(fmt.Errorf("cannot evaluate priority: %w", err))
+			return 1
+		}
+
+		if high {
+			// a request with a high priority takes the place of the
+			// oldest ones with a low priority
+			return m.pushDropOldest(r, true)
+		}
+
+		ok, _ := m.queue.push(r, false)
+		if ok {
+			return 0
+		}
+		return 1
+
+	default:
+		ok, _ := m.queue.push(r, false)
+		if ok {
+			return 0
+		}
+		return 1
+	}
+}
+
+// pushDropOldest drops the oldest requests with a low priority until the
+// request fits in the queue, it returns the number of requests dropped.
+func (m *Decouple) pushDropOldest(r mirror.Request, high bool) int {
+	dropped := 0
+	for {
+		ok, _ := m.queue.push(r, high)
+		if ok {
+			return dropped
+		}
+		if !m.queue.dropOldest() {
+			return dropped + 1
+		}
+		dropped++
+	}
+}
+
+// spillPush queues the request in memory, or on disk if the queue is full or
+// older requests are still on disk.
+func (m *Decouple) spillPush(r mirror.Request) int {
+	m.lock.Lock()
+	q := m.disk
+	m.lock.Unlock()
+	if q == nil {
+		return 1
+	}
+
+	// the requests on disk are older, the memory queue is bypassed until
+	// they are all replayed
+	if q.Len() == 0 {
+		ok, _ := m.queue.push(r, false)
+		if ok {
+			return 0
+		}
+	}
+
+	err := q.Push(r)
+	if err == diskqueue.ErrFull {
+		return 1
+	}
+	if err != nil {
+		m.ctx.Error(err)
+		return 1
+	}
+
+	spilledTotal.WithLabelValues(m.ctx.Name).Inc()
+	m.updateSpillGauges()
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+
+	return 0
+}
+
+// replay moves the requests of the disk queue to the memory queue in order.
+// Once the input is closed, the remaining requests are replayed before the
+// memory queue is closed, unless they are persisted for the next start.
+func (m *Decouple) replay() {
+	q := m.disk
+	defer func() {
+		err := q.Close()
+		if err != nil {
+			log.Errorf("%s: error closing the disk queue: %s", m.ctx.Name, err)
+		}
+		m.updateSpillGauges()
+		m.queue.close()
+	}()
+
+	var stop chan struct{}
+	if m.spill.Persist {
+		stop = m.inputDone
+	}
+
+	for {
+		r, err := q.Peek()
+		if err == diskqueue.ErrEmpty {
+			select {
+			case <-m.notify:
+				continue
+			case <-m.inputDone:
+				if q.Len() > 0 {
+					continue
 				}
+				return
+			}
+		}
+		if err != nil {
+			// nothing can be read anymore, new requests are still spilled
+			// until the disk queue is full
+			m.ctx.Error(err)
+			<-m.inputDone
+			return
+		}
+
+		for {
+			ok, changed := m.queue.push(r, false)
+			if ok {
+				break
+			}
 
+			select {
+			case <-changed:
+			case <-stop:
+				return
 			}
-		}()
+		}
+
+		q.Advance()
+		replayedTotal.WithLabelValues(m.ctx.Name).Inc()
+		m.updateSpillGauges()
 	}
 }
+
+func (m *Decouple) updateSpillGauges() {
+	spillDepth.WithLabelValues(m.ctx.Name).Set(float64(m.disk.Len()))
+	spillBytes.WithLabelValues(m.ctx.Name).Set(float64(m.disk.Size()))
+}
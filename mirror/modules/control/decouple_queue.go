@@ -0,0 +1,205 @@
+package control
+
+import (
+	"sync"
+	"time"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	queueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "decouple_queue_depth",
+		Help: "The number of requests in the queue",
+	}, []string{"module"})
+
+	queueCapacity = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "decouple_queue_capacity",
+		Help: "The maximum number of requests in the queue",
+	}, []string{"module"})
+
+	queueFullSeconds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "decouple_queue_full_seconds_total",
+		Help: "The total time the queue spent full",
+	}, []string{"module"})
+
+	queueFullDuration = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "decouple_queue_full_duration_seconds",
+		Help: "How long the queue has been full, 0 if it is not full",
+	}, []string{"module"})
+)
+
+// requestQueue is the in-memory queue of control.decouple. The requests
+// pushed with a high priority are popped first.
+type requestQueue struct {
+	name string
+
+	lock     sync.Mutex
+	high     []mirror.Request
+	low      []mirror.Request
+	capacity int
+	closed   bool
+	// changed is closed and replaced whenever requests are pushed or
+	// popped, to wake up the goroutines waiting on the queue
+	changed chan struct{}
+	// fullSince is the last time the time spent full was accounted, if the
+	// queue is full
+	fullSince time.Time
+	// fullStart is the time the queue became full, if it is full
+	fullStart time.Time
+}
+
+func newRequestQueue(name string, capacity int) *requestQueue {
+	q := &requestQueue{
+		name:     name,
+		capacity: capacity,
+		changed:  make(chan struct{}),
+	}
+	queueCapacity.WithLabelValues(name).Set(float64(capacity))
+	q.updateLocked()
+
+	return q
+}
+
+// push adds the request if the queue is not full. Otherwise it returns a
+// channel closed once the queue changed.
+func (q *requestQueue) push(r mirror.Request, high bool) (bool, <-chan struct{}) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if len(q.high)+len(q.low) >= q.capacity {
+		return false, q.changed
+	}
+
+	if high {
+		q.high = append(q.high, r)
+	} else {
+		q.low = append(q.low, r)
+	}
+	q.updateLocked()
+
+	return true, nil
+}
+
+// dropOldest removes the oldest request with a low priority, it returns
+// false if there is none.
+func (q *requestQueue) dropOldest() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if len(q.low) == 0 {
+		return false
+	}
+
+	q.low[0] = mirror.Request{}
+	q.low = q.low[1:]
+	q.updateLocked()
+
+	return true
+}
+
+// pop blocks until a request is available, it returns false once the queue
+// is closed and empty.
+func (q *requestQueue) pop() (mirror.Request, bool) {
+	for {
+		q.lock.Lock()
+		var r mirror.Request
+		switch {
+		case len(q.high) > 0:
+			r = q.high[0]
+			q.high[0] = mirror.Request{}
+			q.high = q.high[1:]
+		case len(q.low) > 0:
+			r = q.low[0]
+			q.low[0] = mirror.Request{}
+			q.low = q.low[1:]
+		case q.closed:
+			q.lock.Unlock()
+			return mirror.Request{}, false
+		default:
+			changed := q.changed
+			q.lock.Unlock()
+			<-changed
+			continue
+		}
+
+		q.updateLocked()
+		q.lock.Unlock()
+		return r, true
+	}
+}
+
+// close lets pop return once the requests left are popped.
+func (q *requestQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.closed = true
+	q.updateLocked()
+}
+
+// setCapacity changes the capacity of the queue. When it shrinks, the
+// requests in excess are kept until they are popped.
+func (q *requestQueue) setCapacity(capacity int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.capacity = capacity
+	queueCapacity.WithLabelValues(q.name).Set(float64(capacity))
+	q.updateLocked()
+}
+
+func (q *requestQueue) getCapacity() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.capacity
+}
+
+func (q *requestQueue) len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return len(q.high) + len(q.low)
+}
+
+// accountFull adds the time spent full so far, so that it is visible while
+// the queue is still full.
+func (q *requestQueue) accountFull() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.accountFullLocked()
+}
+
+func (q *requestQueue) accountFullLocked() {
+	if q.fullSince.IsZero() {
+		return
+	}
+
+	now := time.Now()
+	queueFullSeconds.WithLabelValues(q.name).Add(now.Sub(q.fullSince).Seconds())
+	queueFullDuration.WithLabelValues(q.name).Set(now.Sub(q.fullStart).Seconds())
+	q.fullSince = now
+}
+
+// updateLocked wakes up the waiting goroutines and updates the metrics
+// after a change.
+func (q *requestQueue) updateLocked() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+
+	n := len(q.high) + len(q.low)
+	queueDepth.WithLabelValues(q.name).Set(float64(n))
+
+	q.accountFullLocked()
+	if n < q.capacity {
+		q.fullSince, q.fullStart = time.Time{}, time.Time{}
+		queueFullDuration.WithLabelValues(q.name).Set(0)
+	} else if q.fullSince.IsZero() {
+		q.fullSince = time.Now()
+		q.fullStart = q.fullSince
+	}
+}
@@ -0,0 +1,234 @@
+package control
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func newSpillDecouple(t *testing.T, name, cfg string) (*Decouple, chan mirror.Request) {
+	mod, err := NewDecouple(&mirror.ModuleContext{Name: name}, []byte(cfg))
+	require.NoError(t, err)
+
+	in := make(chan mirror.Request)
+	mod.SetInput(in)
+	require.NoError(t, mod.Start())
+
+	return mod.(*Decouple), in
+}
+
+// waitQueued waits for the requests sent to be in the memory queue, the
+// dispatcher holding the first one.
+func waitQueued(t *testing.T, mod *Decouple, n int) {
+	require.Eventually(t, func() bool {
+		return mod.queue.len() == n
+	}, time.Second, time.Millisecond)
+}
+
+func readPaths(mod *Decouple) []string {
+	out := []string{}
+	for r := range mod.Output() {
+		out = append(out, r.Path)
+	}
+	return out
+}
+
+func TestDecoupleDropNewest(t *testing.T) {
+	mod, in := newSpillDecouple(t, t.Name(), `{"queue_size": 2}`)
+
+	sendPaths(in, 0, 1)
+	waitQueued(t, mod, 0)
+	sendPaths(in, 1, 5)
+	close(in)
+
+	require.Equal(t, []string{"/0", "/1", "/2"}, readPaths(mod))
+}
+
+func TestDecoupleDropOldest(t *testing.T) {
+	name := t.Name()
+	mod, in := newSpillDecouple(t, name, `{"queue_size": 2, "overflow": "drop_oldest"}`)
+	droppedBefore := testutil.ToFloat64(droppedTotal.WithLabelValues(name))
+
+	sendPaths(in, 0, 1)
+	waitQueued(t, mod, 0)
+	sendPaths(in, 1, 5)
+	close(in)
+
+	require.Equal(t, []string{"/0", "/3", "/4"}, readPaths(mod))
+	require.Equal(t, float64(2), testutil.ToFloat64(droppedTotal.WithLabelValues(name))-droppedBefore)
+}
+
+func TestDecoupleBlock(t *testing.T) {
+	name := t.Name()
+	mod, in := newSpillDecouple(t, name, `{"queue_size": 1, "overflow": "block", "block_timeout": "10ms"}`)
+	droppedBefore := testutil.ToFloat64(droppedTotal.WithLabelValues(name))
+
+	sendPaths(in, 0, 1)
+	waitQueued(t, mod, 0)
+
+	// the third request waits for room until the timeout
+	sendPaths(in, 1, 3)
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(droppedTotal.WithLabelValues(name))-droppedBefore == 1
+	}, time.Second, time.Millisecond)
+	close(in)
+	require.Equal(t, []string{"/0", "/1"}, readPaths(mod))
+
+	// without timeout nothing is dropped
+	mod, in = newSpillDecouple(t, t.Name(), `{"queue_size": 1, "overflow": "block"}`)
+	go func() {
+		sendPaths(in, 0, 10)
+		close(in)
+	}()
+	require.Len(t, readPaths(mod), 10)
+}
+
+func TestDecouplePriority(t *testing.T) {
+	name := t.Name()
+	mod, in := newSpillDecouple(t, name, `{"queue_size": 3, "overflow": "priority", "priority": "{req.path.startsWith('/health')}"}`)
+	fullBefore := testutil.ToFloat64(queueFullSeconds.WithLabelValues(name))
+
+	sendPaths(in, 0, 1)
+	waitQueued(t, mod, 0)
+	sendPaths(in, 1, 4)
+	for _, p := range []string{"/health1", "/health2", "/4"} {
+		in <- mirror.Request{Path: p}
+	}
+
+	require.Equal(t, float64(3), testutil.ToFloat64(queueDepth.WithLabelValues(name)))
+	require.Equal(t, float64(3), testutil.ToFloat64(queueCapacity.WithLabelValues(name)))
+	time.Sleep(10 * time.Millisecond)
+	mod.queue.accountFull()
+	require.Greater(t, testutil.ToFloat64(queueFullSeconds.WithLabelValues(name)), fullBefore)
+	require.Greater(t, testutil.ToFloat64(queueFullDuration.WithLabelValues(name)), float64(0))
+
+	close(in)
+	require.Equal(t, []string{"/0", "/health1", "/health2", "/3"}, readPaths(mod))
+	require.Equal(t, float64(0), testutil.ToFloat64(queueFullDuration.WithLabelValues(name)))
+}
+
+func sendPaths(in chan mirror.Request, from, to int) {
+	for i := from; i < to; i++ {
+		in <- mirror.Request{Path: fmt.Sprintf("/%d", i)}
+	}
+}
+
+func TestDecoupleSpill(t *testing.T) {
+	name := t.Name()
+	cfg := fmt.Sprintf(`{"queue_size": 2, "spill": {"dir": %q}}`, t.TempDir())
+	mod, in := newSpillDecouple(t, name, cfg)
+	spilledBefore := testutil.ToFloat64(spilledTotal.WithLabelValues(name))
+	replayedBefore := testutil.ToFloat64(replayedTotal.WithLabelValues(name))
+	droppedBefore := testutil.ToFloat64(droppedTotal.WithLabelValues(name))
+
+	// the output is not read, everything after the queue is spilled
+	sendPaths(in, 0, 10)
+	close(in)
+
+	out := []string{}
+	for r := range mod.Output() {
+		out = append(out, r.Path)
+	}
+
+	expected := []string{}
+	for i := 0; i < 10; i++ {
+		expected = append(expected, fmt.Sprintf("/%d", i))
+	}
+	require.Equal(t, expected, out)
+
+	// the replay fills the queue again while the input is spilled
+	spilled := testutil.ToFloat64(spilledTotal.WithLabelValues(name)) - spilledBefore
+	require.GreaterOrEqual(t, spilled, float64(6))
+	require.Equal(t, spilled, testutil.ToFloat64(replayedTotal.WithLabelValues(name))-replayedBefore)
+	require.Equal(t, droppedBefore, testutil.ToFloat64(droppedTotal.WithLabelValues(name)))
+	require.Equal(t, float64(0), testutil.ToFloat64(spillDepth.WithLabelValues(name)))
+}
+
+func TestDecoupleSpillFull(t *testing.T) {
+	name := t.Name()
+	cfg := fmt.Sprintf(`{"queue_size": 1, "spill": {"dir": %q, "max_size": 20}}`, t.TempDir())
+	mod, in := newSpillDecouple(t, name, cfg)
+	droppedBefore := testutil.ToFloat64(droppedTotal.WithLabelValues(name))
+
+	sendPaths(in, 0, 10)
+	close(in)
+
+	n := 0
+	for range mod.Output() {
+		n++
+	}
+
+	dropped := testutil.ToFloat64(droppedTotal.WithLabelValues(name)) - droppedBefore
+	require.Greater(t, dropped, float64(0))
+	require.Equal(t, 10, n+int(dropped))
+}
+
+func TestDecoupleSpillPersist(t *testing.T) {
+	name := t.Name()
+	cfg := fmt.Sprintf(`{"queue_size": 1, "spill": {"dir": %q, "persist": true}}`, t.TempDir())
+	mod, in := newSpillDecouple(t, name, cfg)
+
+	sendPaths(in, 0, 5)
+	close(in)
+	require.Eventually(t, func() bool {
+		mod.lock.Lock()
+		defer mod.lock.Unlock()
+		return mod.inputClosed
+	}, time.Second, time.Millisecond)
+
+	// the replay stops once the input is closed, the requests left are
+	// kept on disk
+	out := []string{}
+	for r := range mod.Output() {
+		out = append(out, r.Path)
+	}
+	// one request in the queue, and the one being sent
+	require.Equal(t, []string{"/0", "/1"}, out)
+
+	// a new module replays them first
+	mod, in = newSpillDecouple(t, name, cfg)
+	sendPaths(in, 5, 7)
+	for len(out) < 7 {
+		out = append(out, (<-mod.Output()).Path)
+	}
+	close(in)
+	for range mod.Output() {
+	}
+
+	require.Equal(t, []string{"/0", "/1", "/2", "/3", "/4", "/5", "/6"}, out)
+}
+
+func TestDecoupleSetParams(t *testing.T) {
+	name := t.Name()
+	mod, in := newSpillDecouple(t, name, `{"queue_size": 1}`)
+
+	require.Error(t, mod.SetParams([]byte(`{"queue_size": 0}`)))
+	require.NoError(t, mod.SetParams([]byte(`{"queue_size": 3}`)))
+	require.Equal(t, map[string]interface{}{"queue_size": 3}, mod.Params())
+	require.Equal(t, float64(3), testutil.ToFloat64(queueCapacity.WithLabelValues(name)))
+
+	sendPaths(in, 0, 1)
+	waitQueued(t, mod, 0)
+	sendPaths(in, 1, 5)
+	close(in)
+
+	require.Equal(t, []string{"/0", "/1", "/2", "/3"}, readPaths(mod))
+}
+
+func TestDecouplePriorityError(t *testing.T) {
+	name := t.Name()
+	mod, in := newSpillDecouple(t, name, `{"queue_size": 3, "overflow": "priority", "priority": "{int(req.path) > 0}"}`)
+	droppedBefore := testutil.ToFloat64(droppedTotal.WithLabelValues(name))
+
+	// the paths are not numbers, the priority cannot be evaluated
+	sendPaths(in, 0, 2)
+	close(in)
+
+	require.Empty(t, readPaths(mod))
+	require.Equal(t, float64(2), testutil.ToFloat64(droppedTotal.WithLabelValues(name))-droppedBefore)
+	require.Equal(t, uint64(2), mod.ctx.Errors())
+}
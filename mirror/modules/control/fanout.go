@@ -31,7 +31,7 @@ func NewFanout(ctx *mirror.ModuleContext, cfg []byte) (mirror.Module, error) {
 		out: make(chan mirror.Request),
 	}
 
-	mods, err := config.CreateModules(cfg)
+	mods, err := config.CreateModules(ctx.ConfigPath, cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -60,6 +60,23 @@ func (m *Fanout) Children() [][]mirror.Module {
 	return res
 }
 
+func (m *Fanout) Start() error {
+	for _, sub := range m.modules {
+		err := sub.Start()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *Fanout) Stop() {
+	for _, sub := range m.modules {
+		sub.Stop()
+	}
+}
+
 func (m *Fanout) Output() <-chan mirror.Request {
 	return m.out
 }
@@ -0,0 +1,149 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/criteo/traffic-mirroring/mirror/expr"
+	"github.com/criteo/traffic-mirroring/mirror/registry"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	FilterName = "control.filter"
+
+	OnEvalErrorDrop = "drop"
+	OnEvalErrorKeep = "keep"
+	OnEvalErrorLog  = "log"
+)
+
+var (
+	filterTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "filter_requests_total",
+		Help: "The total number of requests kept or dropped by the filter",
+	}, []string{"module", "result"})
+
+	filterErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "filter_errors_total",
+		Help: "The total number of filter expressions that could not be evaluated",
+	}, []string{"module"})
+)
+
+func init() {
+	registry.Register(FilterName, NewFilter)
+}
+
+type FilterConfig struct {
+	Keep        *expr.BoolExpr `json:"keep,omitempty"`
+	Drop        *expr.BoolExpr `json:"drop,omitempty"`
+	OnEvalError string         `json:"on_eval_error,omitempty"`
+}
+
+type Filter struct {
+	ctx *mirror.ModuleContext
+	cfg FilterConfig
+	out chan mirror.Request
+}
+
+func NewFilter(ctx *mirror.ModuleContext, cfg []byte) (mirror.Module, error) {
+	c := FilterConfig{}
+	err := json.Unmarshal(cfg, &c)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Keep == nil && c.Drop == nil {
+		return nil, errors.New("keep or drop is required")
+	}
+
+	switch c.OnEvalError {
+	case "":
+		c.OnEvalError = OnEvalErrorDrop
+	case OnEvalErrorDrop, OnEvalErrorKeep, OnEvalErrorLog:
+	default:
+		return nil, fmt.Errorf("unknown on_eval_error policy %q", c.OnEvalError)
+	}
+
+	mod := &Filter{
+		ctx: ctx,
+		cfg: c,
+		out: make(chan mirror.Request),
+	}
+
+	return mod, nil
+}
+
+func (m *Filter) Context() *mirror.ModuleContext {
+	return m.ctx
+}
+
+func (m *Filter) Children() [][]mirror.Module {
+	return nil
+}
+
+func (m *Filter) Start() error {
+	return nil
+}
+
+func (m *Filter) Stop() {}
+
+func (m *Filter) Output() <-chan mirror.Request {
+	return m.out
+}
+
+func (m *Filter) SetInput(c <-chan mirror.Request) {
+	go func() {
+		for r := range c {
+			m.ctx.HandledRequest()
+
+			keep, err := m.match(r)
+			if err != nil {
+				filterErrorsTotal.WithLabelValues(m.ctx.Name).Inc()
+				switch m.cfg.OnEvalError {
+				case OnEvalErrorKeep:
+					keep = true
+				case OnEvalErrorLog:
+					m.ctx.Error(err)
+				}
+			}
+
+			if !keep {
+				filterTotal.WithLabelValues(m.ctx.Name, "dropped").Inc()
+				continue
+			}
+
+			filterTotal.WithLabelValues(m.ctx.Name, "kept").Inc()
+			m.out <- r
+		}
+		close(m.out)
+	}()
+}
+
+func (m *Filter) match(r mirror.Request) (bool, error) {
+	if m.cfg.Keep != nil {
+		keep, err := m.cfg.Keep.Eval(r)
+		if err != nil {
+			return false, fmt.Errorf("cannot evaluate keep: %s", err)
+		}
+
+		if !keep {
+			return false, nil
+		}
+	}
+
+	if m.cfg.Drop != nil {
+		drop, err := m.cfg.Drop.Eval(r)
+		if err != nil {
+			return false, fmt.Errorf("cannot evaluate drop: %s", err)
+		}
+
+		if drop {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
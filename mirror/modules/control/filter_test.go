@@ -0,0 +1,97 @@
+package control
+
+import (
+	"testing"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/stretchr/testify/require"
+)
+
+var filterTestRequests = []mirror.Request{
+	{Method: mirror.Method_GET, Path: "/api/users"},
+	{Method: mirror.Method_POST, Path: "/api/users"},
+	{Method: mirror.Method_POST, Path: "/login"},
+	{
+		Method: mirror.Method_POST,
+		Path:   "/api/health",
+		Meta: map[string]*mirror.MetaValue{
+			"health": {Value: &mirror.MetaValue_Bool{Bool: true}},
+		},
+	},
+}
+
+func runFilter(t *testing.T, cfg string) []string {
+	mod, err := NewFilter(&mirror.ModuleContext{}, []byte(cfg))
+	require.NoError(t, err)
+
+	in := make(chan mirror.Request, len(filterTestRequests))
+	for _, r := range filterTestRequests {
+		in <- r
+	}
+
+	mod.SetInput(in)
+	close(in)
+
+	out := []string{}
+	for r := range mod.Output() {
+		out = append(out, r.Method.String()+" "+r.Path)
+	}
+
+	return out
+}
+
+func TestFilter(t *testing.T) {
+	testCases := []struct {
+		name     string
+		cfg      string
+		expected []string
+	}{
+		{
+			name:     "keep",
+			cfg:      `{"keep": "{req.method == POST && req.path.startsWith('/api')}"}`,
+			expected: []string{"POST /api/users", "POST /api/health"},
+		},
+		{
+			name:     "drop",
+			cfg:      `{"drop": "{req.path == '/login'}"}`,
+			expected: []string{"GET /api/users", "POST /api/users", "POST /api/health"},
+		},
+		{
+			name:     "keep and drop",
+			cfg:      `{"keep": "{req.method == POST}", "drop": "{req.path == '/login'}"}`,
+			expected: []string{"POST /api/users", "POST /api/health"},
+		},
+		{
+			name:     "error drop",
+			cfg:      `{"drop": "{req.meta.health.bool}"}`,
+			expected: []string{},
+		},
+		{
+			name:     "error keep",
+			cfg:      `{"drop": "{req.meta.health.bool}", "on_eval_error": "keep"}`,
+			expected: []string{"GET /api/users", "POST /api/users", "POST /login"},
+		},
+		{
+			name:     "error log",
+			cfg:      `{"drop": "{req.meta.health.bool}", "on_eval_error": "log"}`,
+			expected: []string{},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			require.Equal(t, testCase.expected, runFilter(t, testCase.cfg))
+		})
+	}
+}
+
+func TestFilterBadConfig(t *testing.T) {
+	for _, cfg := range []string{
+		`{}`,
+		`{"keep": "{req.path}"}`,
+		`{"keep": true, "on_eval_error": "retry"}`,
+	} {
+		_, err := NewFilter(&mirror.ModuleContext{}, []byte(cfg))
+		require.Error(t, err, cfg)
+	}
+}
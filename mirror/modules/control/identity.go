@@ -33,6 +33,12 @@ func (m *Identity) Children() [][]mirror.Module {
 	return nil
 }
 
+func (m *Identity) Start() error {
+	return nil
+}
+
+func (m *Identity) Stop() {}
+
 func (m *Identity) Output() <-chan mirror.Request {
 	return m.out
 }
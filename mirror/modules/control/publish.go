@@ -0,0 +1,83 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/criteo/traffic-mirroring/mirror/pubsub"
+	"github.com/criteo/traffic-mirroring/mirror/registry"
+)
+
+const (
+	PublishName = "control.publish"
+)
+
+func init() {
+	registry.Register(PublishName, NewPublish)
+}
+
+type PublishConfig struct {
+	Topic string `json:"topic"`
+}
+
+type Publish struct {
+	ctx   *mirror.ModuleContext
+	out   chan mirror.Request
+	topic *pubsub.Topic
+}
+
+func NewPublish(ctx *mirror.ModuleContext, cfg []byte) (mirror.Module, error) {
+	c := PublishConfig{}
+	err := json.Unmarshal(cfg, &c)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Topic == "" {
+		return nil, errors.New("topic is required")
+	}
+
+	return &Publish{
+		ctx:   ctx,
+		out:   make(chan mirror.Request),
+		topic: pubsub.Get(c.Topic),
+	}, nil
+}
+
+func (m *Publish) Context() *mirror.ModuleContext {
+	return m.ctx
+}
+
+func (m *Publish) Children() [][]mirror.Module {
+	return nil
+}
+
+func (m *Publish) PublishedTopic() string {
+	return m.topic.Name()
+}
+
+func (m *Publish) Start() error {
+	return nil
+}
+
+func (m *Publish) Stop() {}
+
+func (m *Publish) Output() <-chan mirror.Request {
+	return m.out
+}
+
+// SetInput publishes the requests, and also passes them to the next module.
+// The module is a publisher of the topic until its input is closed.
+func (m *Publish) SetInput(c <-chan mirror.Request) {
+	m.topic.AddPublisher()
+	go func() {
+		for r := range c {
+			m.ctx.HandledRequest()
+			m.topic.Publish(r)
+			m.out <- r
+		}
+		m.topic.RemovePublisher()
+		close(m.out)
+	}()
+}
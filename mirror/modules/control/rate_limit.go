@@ -1,26 +1,53 @@
 package control
 
 import (
+	"container/list"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"math"
+	"sync"
 	"time"
 
 	"github.com/criteo/traffic-mirroring/mirror"
 	"github.com/criteo/traffic-mirroring/mirror/expr"
 	"github.com/criteo/traffic-mirroring/mirror/registry"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
 )
 
 const (
 	RateLimitName = "control.rate_limit"
 )
 
+var (
+	rateLimitRate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rate_limit_rate",
+		Help: "The current rate limit in requests per second",
+	}, []string{"module"})
+
+	rateLimitTokens = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rate_limit_tokens",
+		Help: "The tokens available in the bucket, negative when requests are waiting",
+	}, []string{"module"})
+
+	rateLimitDroppedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rate_limit_dropped_total",
+		Help: "The total number of requests exceeding the rate in drop mode",
+	}, []string{"module"})
+)
+
 func init() {
 	registry.Register(RateLimitName, NewRateLimit)
 }
 
 type RateLimitConfig struct {
-	RPS *expr.NumberExpr `json:"rps"`
+	RPS     *expr.NumberExpr `json:"rps"`
+	Burst   int              `json:"burst,omitempty"`
+	Drop    bool             `json:"drop,omitempty"`
+	Key     *expr.AnyExpr    `json:"key,omitempty"`
+	MaxKeys int              `json:"max_keys,omitempty"`
 }
 
 type RateLimit struct {
@@ -28,8 +55,24 @@ type RateLimit struct {
 	cfg RateLimitConfig
 	out chan mirror.Request
 
-	ready    bool
-	interval time.Duration
+	// lock guards the config and the buckets, changed by SetParams
+	lock sync.Mutex
+	// rate is the static rate of the config, 0 when it is an expression
+	rate  float64
+	burst float64
+	// buckets holds a bucket by key, in lru from the most to the least
+	// recently used. Without key, all the requests share the bucket of the
+	// empty key.
+	buckets map[string]*list.Element
+	lru     *list.List
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type keyBucket struct {
+	key    string
+	bucket tokenBucket
 }
 
 func NewRateLimit(ctx *mirror.ModuleContext, cfg []byte) (mirror.Module, error) {
@@ -39,10 +82,48 @@ func NewRateLimit(ctx *mirror.ModuleContext, cfg []byte) (mirror.Module, error)
 		return nil, err
 	}
 
+	if c.RPS == nil {
+		return nil, errors.New("rps is required")
+	}
+
+	rate := 0.0
+	if c.RPS.Static() {
+		rate, err = evalRate(c.RPS, mirror.Request{})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	burst := 1
+	if c.Burst > 0 {
+		burst = c.Burst
+	}
+
+	// requests of all the keys wait in turn, a slow key would hold back
+	// the others
+	if c.Key != nil && !c.Drop {
+		return nil, errors.New("key requires drop, use a control.split_by to wait by key")
+	}
+
+	if c.MaxKeys < 0 {
+		return nil, errors.New("max_keys must be positive")
+	}
+	if c.MaxKeys == 0 {
+		c.MaxKeys = 1000
+	}
+
 	mod := &RateLimit{
-		ctx: ctx,
-		cfg: c,
-		out: make(chan mirror.Request),
+		ctx:     ctx,
+		cfg:     c,
+		out:     make(chan mirror.Request),
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: map[string]*list.Element{},
+		lru:     list.New(),
+		stop:    make(chan struct{}),
+	}
+	if rate > 0 {
+		rateLimitRate.WithLabelValues(ctx.Name).Set(rate)
 	}
 
 	return mod, nil
@@ -56,39 +137,271 @@ func (m *RateLimit) Children() [][]mirror.Module {
 	return nil
 }
 
+func (m *RateLimit) Start() error {
+	return nil
+}
+
+// Stop ends the waits, the requests are then passed on right away so that
+// the pipeline drains without waiting for their turn.
+func (m *RateLimit) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+}
+
+// Restartable resets the buckets on an error with the restart policy.
+func (m *RateLimit) Restartable() {}
+
 func (m *RateLimit) Output() <-chan mirror.Request {
 	return m.out
 }
 
 func (m *RateLimit) SetInput(c <-chan mirror.Request) {
 	go func() {
-
 		for r := range c {
-			if !m.ready {
-				err := m.init(r)
-				if err != nil {
-					log.Fatalf("%s: %s", RateLimitName, err)
+			// a request without a rate or a key is dropped whatever the
+			// policy
+			b, err := m.bucket(r)
+			if err != nil {
+				if m.ctx.Error(err) == mirror.ErrorPolicyRestart {
+					m.lock.Lock()
+					m.buckets = map[string]*list.Element{}
+					m.lru.Init()
+					m.lock.Unlock()
 				}
+				continue
 			}
 
-			start := time.Now()
-
 			m.ctx.HandledRequest()
-			m.out <- r
 
-			time.Sleep(m.interval - time.Since(start))
+			m.lock.Lock()
+			drop := m.cfg.Drop
+			ok, wait := true, time.Duration(0)
+			if drop {
+				ok = b.tryTake(time.Now())
+			} else {
+				wait = b.take(time.Now())
+			}
+			if m.cfg.Key == nil {
+				rateLimitTokens.WithLabelValues(m.ctx.Name).Set(b.tokens)
+			}
+			m.lock.Unlock()
+
+			if !ok {
+				rateLimitDroppedTotal.WithLabelValues(m.ctx.Name).Inc()
+				continue
+			}
+			if wait > 0 {
+				m.wait(wait)
+			}
+
+			m.out <- r
 		}
 		close(m.out)
 	}()
 }
 
-func (m *RateLimit) init(r mirror.Request) error {
-	v, err := m.cfg.RPS.EvalFloat(r)
+// wait waits for d, or until the module is stopped.
+func (m *RateLimit) wait(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-m.stop:
+	}
+}
+
+// bucket returns the bucket of the request, with its rate up to date. The
+// rate is evaluated on every request unless it is static.
+func (m *RateLimit) bucket(r mirror.Request) (*tokenBucket, error) {
+	key := ""
+	if m.cfg.Key != nil {
+		k, err := m.cfg.Key.Eval(r)
+		if err != nil {
+			return nil, fmt.Errorf("cannot evaluate key: %s", err)
+		}
+		key = fmt.Sprint(k)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	rate := m.rate
+	if rate == 0 {
+		var err error
+		rate, err = evalRate(m.cfg.RPS, r)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	el, ok := m.buckets[key]
+	if ok {
+		m.lru.MoveToFront(el)
+	} else {
+		if m.lru.Len() >= m.cfg.MaxKeys {
+			oldest := m.lru.Back()
+			m.lru.Remove(oldest)
+			delete(m.buckets, oldest.Value.(*keyBucket).key)
+		}
+		el = m.lru.PushFront(&keyBucket{key: key, bucket: newTokenBucket(m.burst)})
+		m.buckets[key] = el
+	}
+
+	b := &el.Value.(*keyBucket).bucket
+	if rate != b.rate {
+		if m.cfg.Key == nil {
+			log.Debugf("%s: rate changed from %v to %v rps", m.ctx.Name, b.rate, rate)
+			rateLimitRate.WithLabelValues(m.ctx.Name).Set(rate)
+		}
+		b.setRate(time.Now(), rate)
+	}
+
+	return b, nil
+}
+
+// Params returns the static rate, or null when it is an expression.
+func (m *RateLimit) Params() map[string]interface{} {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var rps interface{}
+	if m.rate > 0 {
+		rps = m.rate
+	}
+
+	return map[string]interface{}{
+		"rps":   rps,
+		"burst": m.burst,
+		"drop":  m.cfg.Drop,
+	}
+}
+
+// SetParams changes the rate, which can be a number or an expression, the
+// burst or the drop mode.
+func (m *RateLimit) SetParams(b []byte) error {
+	p := struct {
+		RPS   *expr.NumberExpr `json:"rps"`
+		Burst *int             `json:"burst"`
+		Drop  *bool            `json:"drop"`
+	}{}
+	err := mirror.DecodeParams(b, &p)
 	if err != nil {
-		return fmt.Errorf("cannot evaluate rps: %s", err)
+		return err
+	}
+
+	rate := 0.0
+	if p.RPS != nil && p.RPS.Static() {
+		rate, err = evalRate(p.RPS, mirror.Request{})
+		if err != nil {
+			return err
+		}
+	}
+	if p.Burst != nil && *p.Burst <= 0 {
+		return errors.New("burst must be positive")
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if p.Drop != nil && !*p.Drop && m.cfg.Key != nil {
+		return errors.New("key requires drop")
+	}
+
+	now := time.Now()
+	if p.RPS != nil {
+		m.cfg.RPS = p.RPS
+		// an expression is evaluated by the next requests
+		m.rate = rate
+		if rate > 0 {
+			for el := m.lru.Front(); el != nil; el = el.Next() {
+				el.Value.(*keyBucket).bucket.setRate(now, rate)
+			}
+			rateLimitRate.WithLabelValues(m.ctx.Name).Set(rate)
+		}
+	}
+	if p.Burst != nil {
+		m.burst = float64(*p.Burst)
+		for el := m.lru.Front(); el != nil; el = el.Next() {
+			el.Value.(*keyBucket).bucket.setBurst(now, m.burst)
+		}
+	}
+	if p.Drop != nil {
+		m.cfg.Drop = *p.Drop
 	}
 
-	m.ready = true
-	m.interval = time.Duration(float64(time.Second) / v)
 	return nil
 }
+
+func evalRate(e *expr.NumberExpr, r mirror.Request) (float64, error) {
+	v, err := e.EvalFloat(r)
+	if err != nil {
+		return 0, fmt.Errorf("cannot evaluate rps: %s", err)
+	}
+	if v <= 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("invalid rps %v", v)
+	}
+	return v, nil
+}
+
+// tokenBucket allows rate requests per second on average, and up to burst
+// requests at once after a pause.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+	// tokens is negative when requests are waiting for their turn
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(burst float64) tokenBucket {
+	return tokenBucket{
+		burst:  burst,
+		tokens: burst,
+	}
+}
+
+// advance adds the tokens accumulated since the last call.
+func (b *tokenBucket) advance(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+}
+
+// setRate changes the rate, the tokens accumulated so far are kept.
+func (b *tokenBucket) setRate(now time.Time, rate float64) {
+	b.advance(now)
+	b.rate = rate
+}
+
+func (b *tokenBucket) setBurst(now time.Time, burst float64) {
+	b.advance(now)
+	b.burst = burst
+	b.tokens = math.Min(b.burst, b.tokens)
+}
+
+// take takes a token and returns how long to wait for it. The wait is
+// accounted in the bucket, so that sleeping longer than needed is caught up
+// on the next requests.
+func (b *tokenBucket) take(now time.Time) time.Duration {
+	b.advance(now)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// tryTake takes a token if one is available.
+func (b *tokenBucket) tryTake(now time.Time) bool {
+	b.advance(now)
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
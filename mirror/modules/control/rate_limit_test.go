@@ -0,0 +1,217 @@
+package control
+
+import (
+	"testing"
+	"time"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitError(t *testing.T) {
+	failed := []error{}
+	ctx := &mirror.ModuleContext{
+		Name:        t.Name(),
+		ErrorPolicy: mirror.ErrorPolicyFail,
+		OnFail: func(ctx *mirror.ModuleContext, err error) {
+			failed = append(failed, err)
+		},
+	}
+
+	mod, err := NewRateLimit(ctx, []byte(`{"rps": "{req.meta.rps.int}"}`))
+	require.NoError(t, err)
+
+	in := make(chan mirror.Request, 2)
+	in <- mirror.Request{Path: "/no-rps"}
+	in <- mirror.Request{
+		Path: "/rps",
+		Meta: map[string]*mirror.MetaValue{
+			"rps": {Value: &mirror.MetaValue_Int{Int: 1000}},
+		},
+	}
+	close(in)
+	mod.SetInput(in)
+
+	out := []string{}
+	for r := range mod.Output() {
+		out = append(out, r.Path)
+	}
+
+	// the first request is dropped, and the rate evaluated again on the
+	// second one
+	require.Equal(t, []string{"/rps"}, out)
+	require.Len(t, failed, 1)
+	require.Equal(t, uint64(1), ctx.Errors())
+	require.NotEmpty(t, ctx.LastError())
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2)
+	b.setRate(now, 10)
+
+	// the burst is available right away, then one token every 100ms
+	require.Equal(t, time.Duration(0), b.take(now))
+	require.Equal(t, time.Duration(0), b.take(now))
+	require.Equal(t, 100*time.Millisecond, b.take(now))
+	require.Equal(t, 200*time.Millisecond, b.take(now))
+
+	// the waits are accounted, the bucket is refilled up to the burst
+	now = now.Add(time.Second)
+	require.True(t, b.tryTake(now))
+	require.True(t, b.tryTake(now))
+	require.False(t, b.tryTake(now))
+
+	// a new rate applies to the tokens accumulated from now on
+	b.setRate(now, 1)
+	require.False(t, b.tryTake(now.Add(500*time.Millisecond)))
+	require.True(t, b.tryTake(now.Add(time.Second)))
+}
+
+func rpsRequest(path string, rps int64) mirror.Request {
+	return mirror.Request{
+		Path: path,
+		Meta: map[string]*mirror.MetaValue{
+			"rps": {Value: &mirror.MetaValue_Int{Int: rps}},
+		},
+	}
+}
+
+func TestRateLimitDynamic(t *testing.T) {
+	name := t.Name()
+	mod, err := NewRateLimit(&mirror.ModuleContext{Name: name}, []byte(`{"rps": "{req.meta.rps.int}", "drop": true}`))
+	require.NoError(t, err)
+
+	in := make(chan mirror.Request)
+	mod.SetInput(in)
+	out := []string{}
+	done := make(chan struct{})
+	go func() {
+		for r := range mod.Output() {
+			out = append(out, r.Path)
+		}
+		close(done)
+	}()
+
+	in <- rpsRequest("/1", 1)
+	in <- rpsRequest("/2", 1)
+	require.Equal(t, float64(1), testutil.ToFloat64(rateLimitRate.WithLabelValues(name)))
+
+	// the new rate applies right away
+	in <- rpsRequest("/3", 1000)
+	time.Sleep(10 * time.Millisecond)
+	in <- rpsRequest("/4", 1000)
+	require.Equal(t, float64(1000), testutil.ToFloat64(rateLimitRate.WithLabelValues(name)))
+
+	close(in)
+	<-done
+	require.Equal(t, []string{"/1", "/4"}, out)
+}
+
+func TestRateLimitBurst(t *testing.T) {
+	mod, err := NewRateLimit(&mirror.ModuleContext{Name: t.Name()}, []byte(`{"rps": 10, "burst": 5}`))
+	require.NoError(t, err)
+
+	in := make(chan mirror.Request, 6)
+	for i := 0; i < 6; i++ {
+		in <- mirror.Request{}
+	}
+	close(in)
+	mod.SetInput(in)
+
+	start := time.Now()
+	n := 0
+	for range mod.Output() {
+		n++
+		if n == 5 {
+			require.Less(t, time.Since(start), 50*time.Millisecond)
+		}
+	}
+	require.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+}
+
+func TestRateLimitKey(t *testing.T) {
+	run := func(cfg string, reqs ...mirror.Request) []string {
+		mod, err := NewRateLimit(&mirror.ModuleContext{Name: t.Name()}, []byte(cfg))
+		require.NoError(t, err)
+
+		in := make(chan mirror.Request)
+		mod.SetInput(in)
+		out := []string{}
+		done := make(chan struct{})
+		go func() {
+			for r := range mod.Output() {
+				out = append(out, r.Path)
+			}
+			close(done)
+		}()
+
+		for _, r := range reqs {
+			in <- r
+			time.Sleep(10 * time.Millisecond)
+		}
+		close(in)
+		<-done
+		return out
+	}
+
+	// each path has its own bucket and rate, the rate of one does not
+	// change the others
+	out := run(`{"rps": "{req.meta.rps.int}", "key": "{req.path}", "drop": true}`,
+		rpsRequest("/a", 1), rpsRequest("/b", 1000), rpsRequest("/b", 1000), rpsRequest("/a", 1))
+	require.Equal(t, []string{"/a", "/b", "/b"}, out)
+
+	// without key, the bucket is shared
+	out = run(`{"rps": 1, "drop": true}`, rpsRequest("/a", 1), rpsRequest("/b", 1))
+	require.Equal(t, []string{"/a"}, out)
+
+	// beyond max_keys, the least recently used bucket is evicted
+	out = run(`{"rps": 1, "key": "{req.path}", "max_keys": 1, "drop": true}`,
+		rpsRequest("/a", 1), rpsRequest("/b", 1), rpsRequest("/a", 1), rpsRequest("/a", 1))
+	require.Equal(t, []string{"/a", "/b", "/a"}, out)
+
+	// waiting by key would make the slowest key pace all the others
+	_, err := NewRateLimit(&mirror.ModuleContext{Name: t.Name()}, []byte(`{"rps": 1, "key": "{req.path}"}`))
+	require.Error(t, err)
+
+	mod, err := NewRateLimit(&mirror.ModuleContext{Name: t.Name()}, []byte(`{"rps": 1, "key": "{req.path}", "drop": true}`))
+	require.NoError(t, err)
+	require.Error(t, mod.(*RateLimit).SetParams([]byte(`{"drop": false}`)))
+}
+
+func TestRateLimitStop(t *testing.T) {
+	mod, err := NewRateLimit(&mirror.ModuleContext{Name: t.Name()}, []byte(`{"rps": 0.1}`))
+	require.NoError(t, err)
+
+	in := make(chan mirror.Request, 2)
+	in <- mirror.Request{Path: "/1"}
+	in <- mirror.Request{Path: "/2"}
+	close(in)
+	mod.SetInput(in)
+	require.Equal(t, "/1", (<-mod.Output()).Path)
+
+	// the second request waits for 10s, unless the module is stopped
+	mod.Stop()
+	select {
+	case r := <-mod.Output():
+		require.Equal(t, "/2", r.Path)
+	case <-time.After(time.Second):
+		t.Fatal("the wait ignored Stop")
+	}
+	_, ok := <-mod.Output()
+	require.False(t, ok)
+}
+
+func TestRateLimitParams(t *testing.T) {
+	mod, err := NewRateLimit(&mirror.ModuleContext{Name: t.Name()}, []byte(`{"rps": 10, "burst": 5}`))
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"rps": 10.0, "burst": 5.0, "drop": false}, mod.(*RateLimit).Params())
+
+	mod, err = NewRateLimit(&mirror.ModuleContext{Name: t.Name()}, []byte(`{"rps": "{req.meta.rps.int}"}`))
+	require.NoError(t, err)
+	require.Nil(t, mod.(*RateLimit).Params()["rps"])
+
+	_, err = NewRateLimit(&mirror.ModuleContext{Name: t.Name()}, []byte(`{"rps": 0}`))
+	require.Error(t, err)
+}
@@ -0,0 +1,154 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync/atomic"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/criteo/traffic-mirroring/mirror/expr"
+	"github.com/criteo/traffic-mirroring/mirror/registry"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	SampleName = "control.sample"
+)
+
+var (
+	sampleTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sample_requests_total",
+		Help: "The total number of requests sampled in or out",
+	}, []string{"module", "result"})
+)
+
+func init() {
+	registry.Register(SampleName, NewSample)
+}
+
+type SampleConfig struct {
+	Ratio *float64      `json:"ratio"`
+	Key   *expr.AnyExpr `json:"key,omitempty"`
+}
+
+type Sample struct {
+	ctx *mirror.ModuleContext
+	cfg SampleConfig
+	out chan mirror.Request
+
+	// ratio is the ratio of the config, changed by SetParams
+	ratio atomic.Value
+}
+
+func NewSample(ctx *mirror.ModuleContext, cfg []byte) (mirror.Module, error) {
+	c := SampleConfig{}
+	err := json.Unmarshal(cfg, &c)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Ratio == nil {
+		return nil, errors.New("ratio is required")
+	}
+	if *c.Ratio < 0 || *c.Ratio > 1 {
+		return nil, errors.New("ratio must be between 0 and 1")
+	}
+
+	mod := &Sample{
+		ctx: ctx,
+		cfg: c,
+		out: make(chan mirror.Request),
+	}
+	mod.ratio.Store(*c.Ratio)
+
+	return mod, nil
+}
+
+func (m *Sample) Context() *mirror.ModuleContext {
+	return m.ctx
+}
+
+func (m *Sample) Children() [][]mirror.Module {
+	return nil
+}
+
+func (m *Sample) Start() error {
+	return nil
+}
+
+func (m *Sample) Stop() {}
+
+func (m *Sample) Output() <-chan mirror.Request {
+	return m.out
+}
+
+func (m *Sample) SetInput(c <-chan mirror.Request) {
+	go func() {
+		for r := range c {
+			m.ctx.HandledRequest()
+
+			keep, err := m.keep(r)
+			if err != nil {
+				m.ctx.Error(err)
+			}
+
+			if !keep {
+				sampleTotal.WithLabelValues(m.ctx.Name, "dropped").Inc()
+				continue
+			}
+
+			sampleTotal.WithLabelValues(m.ctx.Name, "kept").Inc()
+			m.out <- r
+		}
+		close(m.out)
+	}()
+}
+
+func (m *Sample) keep(r mirror.Request) (bool, error) {
+	if m.cfg.Key == nil {
+		return rand.Float64() < m.getRatio(), nil
+	}
+
+	k, err := m.cfg.Key.Eval(r)
+	if err != nil {
+		return false, fmt.Errorf("cannot evaluate key: %s", err)
+	}
+
+	h := xxhash.Sum64String(fmt.Sprint(k))
+
+	return float64(h)/math.MaxUint64 < m.getRatio(), nil
+}
+
+func (m *Sample) getRatio() float64 {
+	return m.ratio.Load().(float64)
+}
+
+func (m *Sample) Params() map[string]interface{} {
+	return map[string]interface{}{
+		"ratio": m.getRatio(),
+	}
+}
+
+func (m *Sample) SetParams(b []byte) error {
+	p := struct {
+		Ratio *float64 `json:"ratio"`
+	}{}
+	err := mirror.DecodeParams(b, &p)
+	if err != nil {
+		return err
+	}
+
+	if p.Ratio != nil {
+		if *p.Ratio < 0 || *p.Ratio > 1 {
+			return errors.New("ratio must be between 0 and 1")
+		}
+		m.ratio.Store(*p.Ratio)
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package control
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/stretchr/testify/require"
+)
+
+func runSample(t *testing.T, cfg string, reqs []mirror.Request) []mirror.Request {
+	mod, err := NewSample(&mirror.ModuleContext{}, []byte(cfg))
+	require.NoError(t, err)
+
+	in := make(chan mirror.Request, len(reqs))
+	for _, r := range reqs {
+		in <- r
+	}
+
+	mod.SetInput(in)
+	close(in)
+
+	out := []mirror.Request{}
+	for r := range mod.Output() {
+		out = append(out, r)
+	}
+
+	return out
+}
+
+func TestSampleRandom(t *testing.T) {
+	reqs := make([]mirror.Request, 10000)
+
+	require.Len(t, runSample(t, `{"ratio": 0}`, reqs), 0)
+	require.Len(t, runSample(t, `{"ratio": 1}`, reqs), len(reqs))
+	require.InDelta(t, 1000, len(runSample(t, `{"ratio": 0.1}`, reqs)), 200)
+}
+
+func TestSampleKey(t *testing.T) {
+	reqs := []mirror.Request{}
+	for i := 0; i < 10000; i++ {
+		reqs = append(reqs, mirror.Request{
+			Path: fmt.Sprintf("/%d", i),
+			Headers: map[string]*mirror.HeaderValue{
+				"X-User-Id": {Values: []string{fmt.Sprint(i % 1000)}},
+			},
+		})
+	}
+
+	out := runSample(t, `{"ratio": 0.2, "key": "{req.header('X-User-Id')}"}`, reqs)
+	require.InDelta(t, 2000, len(out), 400)
+
+	users := map[string]int{}
+	for _, r := range out {
+		users[r.Headers["X-User-Id"].Values[0]]++
+	}
+
+	// every request of a sampled user is kept
+	for user, count := range users {
+		require.Equal(t, 10, count, user)
+	}
+}
+
+func TestSampleBadRatio(t *testing.T) {
+	_, err := NewSample(&mirror.ModuleContext{}, []byte(`{"ratio": 5}`))
+	require.Error(t, err)
+
+	_, err = NewSample(&mirror.ModuleContext{}, []byte(`{}`))
+	require.EqualError(t, err, "ratio is required")
+}
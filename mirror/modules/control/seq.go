@@ -1,6 +1,8 @@
 package control
 
 import (
+	"fmt"
+
 	"github.com/criteo/traffic-mirroring/mirror"
 	"github.com/criteo/traffic-mirroring/mirror/config"
 	"github.com/criteo/traffic-mirroring/mirror/registry"
@@ -21,13 +23,17 @@ type Seq struct {
 }
 
 func NewSeq(ctx *mirror.ModuleContext, cfg []byte) (mirror.Module, error) {
-	mods, err := config.CreateModules(cfg)
+	mods, err := config.CreateModules(ctx.ConfigPath, cfg)
 	if err != nil {
 		return nil, err
 	}
 
 	var lastOut <-chan mirror.Request
-	for _, sub := range mods {
+	for i, sub := range mods {
+		if i > 0 && sub.Context().Role() == "source" {
+			return nil, fmt.Errorf("%s: a source can only be the first module of a pipeline", sub.Context().Name)
+		}
+
 		if lastOut != nil {
 			sub.SetInput(lastOut)
 		}
@@ -50,6 +56,25 @@ func (m *Seq) Children() [][]mirror.Module {
 	return [][]mirror.Module{m.modules}
 }
 
+// Start starts the last modules first, so that sources only produce
+// requests once the rest of the pipeline is running.
+func (m *Seq) Start() error {
+	for i := len(m.modules) - 1; i >= 0; i-- {
+		err := m.modules[i].Start()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *Seq) Stop() {
+	for _, sub := range m.modules {
+		sub.Stop()
+	}
+}
+
 func (m *Seq) Output() <-chan mirror.Request {
 	return m.out
 }
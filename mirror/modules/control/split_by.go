@@ -40,6 +40,8 @@ type SplitBy struct {
 	out         chan mirror.Request
 	modules     map[interface{}]*splitByModule
 	modulesLock sync.Mutex
+	// outputs tracks the sub-pipelines that have not closed their output
+	outputs sync.WaitGroup
 }
 
 func NewSplitBy(ctx *mirror.ModuleContext, cfg []byte) (mirror.Module, error) {
@@ -50,7 +52,7 @@ func NewSplitBy(ctx *mirror.ModuleContext, cfg []byte) (mirror.Module, error) {
 	}
 
 	// check that the module compiles
-	_, err = config.CreateModule(c.Pipeline)
+	_, err = config.CreateModule(ctx.ConfigPath+".pipeline", c.Pipeline)
 	if err != nil {
 		return nil, err
 	}
@@ -103,6 +105,20 @@ func (m *SplitBy) Children() [][]mirror.Module {
 	return res
 }
 
+// Start does nothing, sub-pipelines are started when they are created.
+func (m *SplitBy) Start() error {
+	return nil
+}
+
+func (m *SplitBy) Stop() {
+	m.modulesLock.Lock()
+	defer m.modulesLock.Unlock()
+
+	for _, mod := range m.modules {
+		mod.mod.Stop()
+	}
+}
+
 func (m *SplitBy) Output() <-chan mirror.Request {
 	return m.out
 }
@@ -115,14 +131,23 @@ func (m *SplitBy) SetInput(c <-chan mirror.Request) {
 			m.modulesLock.Lock()
 			in, err := m.selectIn(r)
 			if err != nil {
-				log.Errorf("%s: %s", SplitByName, err)
 				m.modulesLock.Unlock()
+				m.ctx.Error(err)
 				continue
 			}
 
 			in <- r
 			m.modulesLock.Unlock()
 		}
+
+		m.modulesLock.Lock()
+		for k, mod := range m.modules {
+			close(mod.in)
+			delete(m.modules, k)
+		}
+		m.modulesLock.Unlock()
+
+		m.outputs.Wait()
 		close(m.out)
 	}()
 }
@@ -139,15 +164,10 @@ func (m *SplitBy) selectIn(r mirror.Request) (chan mirror.Request, error) {
 	}
 
 	log.Debugf("%s: creating pipeline for value %q", SplitByName, e)
-	mod, err := config.CreateModule(m.cfg.Pipeline)
+	mod, err := config.CreateModule(m.ctx.ConfigPath+".pipeline", m.cfg.Pipeline)
 	if err != nil {
 		return nil, err
 	}
-	go func() {
-		for r := range mod.Output() {
-			m.out <- r
-		}
-	}()
 
 	smod := &splitByModule{
 		e:             e,
@@ -156,6 +176,21 @@ func (m *SplitBy) selectIn(r mirror.Request) (chan mirror.Request, error) {
 		lastMessageAt: time.Now(),
 	}
 	mod.SetInput(smod.in)
+
+	m.outputs.Add(1)
+	go func() {
+		defer m.outputs.Done()
+		for r := range mod.Output() {
+			m.out <- r
+		}
+	}()
+
+	err = mod.Start()
+	if err != nil {
+		close(smod.in)
+		return nil, err
+	}
+
 	m.modules[e] = smod
 
 	return smod.in, nil
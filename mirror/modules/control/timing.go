@@ -0,0 +1,169 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/criteo/traffic-mirroring/mirror/registry"
+)
+
+const (
+	TimingName = "control.timing"
+
+	// timingRewind is how far back in time a request must be to be
+	// considered as the start of a new replay, and not as out of order
+	timingRewind = time.Second
+)
+
+func init() {
+	registry.Register(TimingName, NewTiming)
+}
+
+type TimingConfig struct {
+	Speed       float64 `json:"speed,omitempty"`
+	MaxGap      string  `json:"max_gap,omitempty"`
+	StartOffset string  `json:"start_offset,omitempty"`
+}
+
+type Timing struct {
+	ctx *mirror.ModuleContext
+	out chan mirror.Request
+
+	speed       float64
+	maxGap      time.Duration
+	startOffset time.Duration
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewTiming(ctx *mirror.ModuleContext, cfg []byte) (mirror.Module, error) {
+	c := TimingConfig{}
+	err := json.Unmarshal(cfg, &c)
+	if err != nil {
+		return nil, err
+	}
+
+	mod := &Timing{
+		ctx:   ctx,
+		out:   make(chan mirror.Request),
+		speed: 1,
+		stop:  make(chan struct{}),
+	}
+
+	if c.Speed < 0 {
+		return nil, errors.New("speed must be positive")
+	}
+	if c.Speed > 0 {
+		mod.speed = c.Speed
+	}
+
+	if c.MaxGap != "" {
+		mod.maxGap, err = time.ParseDuration(c.MaxGap)
+		if err != nil {
+			return nil, fmt.Errorf("max_gap: %w", err)
+		}
+	}
+
+	if c.StartOffset != "" {
+		mod.startOffset, err = time.ParseDuration(c.StartOffset)
+		if err != nil {
+			return nil, fmt.Errorf("start_offset: %w", err)
+		}
+	}
+
+	return mod, nil
+}
+
+func (m *Timing) Context() *mirror.ModuleContext {
+	return m.ctx
+}
+
+func (m *Timing) Children() [][]mirror.Module {
+	return nil
+}
+
+func (m *Timing) Start() error {
+	return nil
+}
+
+// Stop ends the waits, the requests are then passed on right away so that
+// the pipeline drains without waiting for a long gap.
+func (m *Timing) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+}
+
+func (m *Timing) Output() <-chan mirror.Request {
+	return m.out
+}
+
+func (m *Timing) SetInput(c <-chan mirror.Request) {
+	go func() {
+		var first, prev, deadline time.Time
+
+		for r := range c {
+			// requests without a timestamp cannot be paced, let them through
+			if r.Time != nil {
+				t := r.Time.AsTime()
+
+				// the recording started over, like with a looping
+				// source.file: pace it again from now
+				if !prev.IsZero() && prev.Sub(t) > timingRewind {
+					first, prev, deadline = time.Time{}, time.Time{}, time.Time{}
+				}
+
+				if first.IsZero() {
+					first = t
+				}
+
+				if t.Sub(first) < m.startOffset {
+					continue
+				}
+
+				if deadline.IsZero() {
+					deadline = time.Now()
+					prev = t
+				}
+
+				gap := t.Sub(prev)
+				if gap < 0 {
+					gap = 0
+				} else {
+					prev = t
+				}
+
+				if m.maxGap > 0 && gap > m.maxGap {
+					gap = m.maxGap
+				}
+
+				deadline = deadline.Add(time.Duration(float64(gap) / m.speed))
+				m.wait(time.Until(deadline))
+			}
+
+			m.ctx.HandledRequest()
+			m.out <- r
+		}
+		close(m.out)
+	}()
+}
+
+// wait waits for d, or until the module is stopped.
+func (m *Timing) wait(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-m.stop:
+	}
+}
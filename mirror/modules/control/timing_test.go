@@ -0,0 +1,94 @@
+package control
+
+import (
+	"testing"
+	"time"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func runTiming(t *testing.T, cfg string, offsets ...time.Duration) ([]string, time.Duration) {
+	mod, err := NewTiming(&mirror.ModuleContext{}, []byte(cfg))
+	require.NoError(t, err)
+
+	start := time.Unix(1600000000, 0)
+	in := make(chan mirror.Request, len(offsets))
+	for _, o := range offsets {
+		in <- mirror.Request{
+			Time: timestamppb.New(start.Add(o)),
+			Path: o.String(),
+		}
+	}
+
+	begin := time.Now()
+	mod.SetInput(in)
+	close(in)
+
+	out := []string{}
+	for r := range mod.Output() {
+		out = append(out, r.Path)
+	}
+
+	return out, time.Since(begin)
+}
+
+func TestTimingSpeed(t *testing.T) {
+	out, elapsed := runTiming(t, `{"speed": 10}`, 0, time.Second, 2*time.Second)
+
+	require.Equal(t, []string{"0s", "1s", "2s"}, out)
+	require.GreaterOrEqual(t, int64(elapsed), int64(200*time.Millisecond))
+	require.Less(t, int64(elapsed), int64(time.Second))
+}
+
+func TestTimingMaxGap(t *testing.T) {
+	out, elapsed := runTiming(t, `{"max_gap": "50ms"}`, 0, time.Hour)
+
+	require.Equal(t, []string{"0s", "1h0m0s"}, out)
+	require.GreaterOrEqual(t, int64(elapsed), int64(50*time.Millisecond))
+	require.Less(t, int64(elapsed), int64(time.Second))
+}
+
+func TestTimingStartOffset(t *testing.T) {
+	out, elapsed := runTiming(t, `{"start_offset": "1h"}`, 0, time.Minute, time.Hour, time.Hour+100*time.Millisecond)
+
+	require.Equal(t, []string{"1h0m0s", "1h0m0.1s"}, out)
+	require.GreaterOrEqual(t, int64(elapsed), int64(100*time.Millisecond))
+	require.Less(t, int64(elapsed), int64(time.Second))
+}
+
+func TestTimingRewind(t *testing.T) {
+	s := time.Second
+	out, elapsed := runTiming(t, `{"speed": 10}`, 0, 2*s, 4*s, 0, 2*s, 1500*time.Millisecond)
+
+	// the second replay is paced like the first one, the request slightly
+	// out of order is not
+	require.Equal(t, []string{"0s", "2s", "4s", "0s", "2s", "1.5s"}, out)
+	require.GreaterOrEqual(t, int64(elapsed), int64(600*time.Millisecond))
+	require.Less(t, int64(elapsed), int64(time.Second))
+}
+
+func TestTimingStop(t *testing.T) {
+	mod, err := NewTiming(&mirror.ModuleContext{}, []byte(`{}`))
+	require.NoError(t, err)
+
+	start := time.Unix(1600000000, 0)
+	in := make(chan mirror.Request, 2)
+	in <- mirror.Request{Time: timestamppb.New(start), Path: "/1"}
+	in <- mirror.Request{Time: timestamppb.New(start.Add(time.Hour)), Path: "/2"}
+	close(in)
+	mod.SetInput(in)
+	require.Equal(t, "/1", (<-mod.Output()).Path)
+
+	// the second request waits for an hour, unless the module is stopped
+	mod.Stop()
+	select {
+	case r := <-mod.Output():
+		require.Equal(t, "/2", r.Path)
+	case <-time.After(time.Second):
+		t.Fatal("the wait ignored Stop")
+	}
+	_, ok := <-mod.Output()
+	require.False(t, ok)
+}
@@ -0,0 +1,266 @@
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/criteo/traffic-mirroring/mirror/expr"
+	"github.com/criteo/traffic-mirroring/mirror/registry"
+)
+
+const (
+	TransformName = "control.transform"
+)
+
+func init() {
+	registry.Register(TransformName, NewTransform)
+}
+
+type TransformOperation struct {
+	Op    string          `json:"op"`
+	Name  string          `json:"name,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type transformFunc func(r *mirror.Request) error
+
+type Transform struct {
+	ctx *mirror.ModuleContext
+	out chan mirror.Request
+	ops []transformFunc
+}
+
+func NewTransform(ctx *mirror.ModuleContext, cfg []byte) (mirror.Module, error) {
+	c := []TransformOperation{}
+	err := json.Unmarshal(cfg, &c)
+	if err != nil {
+		return nil, err
+	}
+
+	mod := &Transform{
+		ctx: ctx,
+		out: make(chan mirror.Request),
+	}
+
+	for i, op := range c {
+		f, err := newTransformFunc(op)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %s", i, err)
+		}
+
+		mod.ops = append(mod.ops, f)
+	}
+
+	return mod, nil
+}
+
+func (m *Transform) Context() *mirror.ModuleContext {
+	return m.ctx
+}
+
+func (m *Transform) Children() [][]mirror.Module {
+	return nil
+}
+
+func (m *Transform) Start() error {
+	return nil
+}
+
+func (m *Transform) Stop() {}
+
+func (m *Transform) Output() <-chan mirror.Request {
+	return m.out
+}
+
+func (m *Transform) SetInput(c <-chan mirror.Request) {
+	go func() {
+	requests:
+		for r := range c {
+			m.ctx.HandledRequest()
+
+			// requests may be shared with other modules, e.g. behind a
+			// control.fanout, so maps are copied before being modified
+			r.Headers = copyHeaders(r.Headers)
+			r.Meta = copyMeta(r.Meta)
+
+			for _, op := range m.ops {
+				err := op(&r)
+				if err != nil {
+					m.ctx.Error(err)
+					continue requests
+				}
+			}
+
+			m.out <- r
+		}
+		close(m.out)
+	}()
+}
+
+func newTransformFunc(op TransformOperation) (transformFunc, error) {
+	switch op.Op {
+	case "set_header", "add_header", "remove_header", "set_meta":
+		if op.Name == "" {
+			return nil, fmt.Errorf("%s: name is required", op.Op)
+		}
+	}
+
+	if op.Op == "remove_header" {
+		return func(r *mirror.Request) error {
+			if k, ok := findHeader(r.Headers, op.Name); ok {
+				delete(r.Headers, k)
+			}
+			return nil
+		}, nil
+	}
+
+	if len(op.Value) == 0 {
+		return nil, fmt.Errorf("%s: value is required", op.Op)
+	}
+
+	if op.Op == "set_meta" {
+		v := &expr.AnyExpr{}
+		err := json.Unmarshal(op.Value, v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", op.Op, err)
+		}
+
+		return func(r *mirror.Request) error {
+			val, err := v.Eval(*r)
+			if err != nil {
+				return fmt.Errorf("cannot evaluate meta %q: %s", op.Name, err)
+			}
+
+			meta, err := newMetaValue(val)
+			if err != nil {
+				return fmt.Errorf("meta %q: %s", op.Name, err)
+			}
+
+			r.Meta[op.Name] = meta
+			return nil
+		}, nil
+	}
+
+	v := &expr.StringExpr{}
+	err := json.Unmarshal(op.Value, v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", op.Op, err)
+	}
+
+	eval := func(r *mirror.Request) (string, error) {
+		val, err := v.Eval(*r)
+		if err != nil {
+			return "", fmt.Errorf("cannot evaluate %s: %s", op.Op, err)
+		}
+		return val, nil
+	}
+
+	switch op.Op {
+	case "set_header":
+		return func(r *mirror.Request) error {
+			val, err := eval(r)
+			if err != nil {
+				return err
+			}
+
+			k, ok := findHeader(r.Headers, op.Name)
+			if !ok {
+				k = op.Name
+			}
+			r.Headers[k] = &mirror.HeaderValue{Values: []string{val}}
+			return nil
+		}, nil
+	case "add_header":
+		return func(r *mirror.Request) error {
+			val, err := eval(r)
+			if err != nil {
+				return err
+			}
+
+			k, ok := findHeader(r.Headers, op.Name)
+			if !ok {
+				k = op.Name
+			}
+
+			values := append([]string{}, r.Headers[k].GetValues()...)
+			r.Headers[k] = &mirror.HeaderValue{Values: append(values, val)}
+			return nil
+		}, nil
+	case "set_path":
+		return func(r *mirror.Request) error {
+			val, err := eval(r)
+			if err != nil {
+				return err
+			}
+
+			r.Path = val
+			return nil
+		}, nil
+	case "set_method":
+		return func(r *mirror.Request) error {
+			val, err := eval(r)
+			if err != nil {
+				return err
+			}
+
+			method, ok := mirror.Method_value[strings.ToUpper(val)]
+			if !ok {
+				return fmt.Errorf("unknown method %q", val)
+			}
+
+			r.Method = mirror.Method(method)
+			return nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown operation %q", op.Op)
+	}
+}
+
+// findHeader looks up a header name case-insensitively, as sources do not
+// all canonicalize them.
+func findHeader(headers map[string]*mirror.HeaderValue, name string) (string, bool) {
+	if _, ok := headers[name]; ok {
+		return name, true
+	}
+
+	for k := range headers {
+		if strings.EqualFold(k, name) {
+			return k, true
+		}
+	}
+
+	return "", false
+}
+
+func copyHeaders(headers map[string]*mirror.HeaderValue) map[string]*mirror.HeaderValue {
+	res := make(map[string]*mirror.HeaderValue, len(headers))
+	for k, v := range headers {
+		res[k] = v
+	}
+	return res
+}
+
+func copyMeta(meta map[string]*mirror.MetaValue) map[string]*mirror.MetaValue {
+	res := make(map[string]*mirror.MetaValue, len(meta))
+	for k, v := range meta {
+		res[k] = v
+	}
+	return res
+}
+
+func newMetaValue(v interface{}) (*mirror.MetaValue, error) {
+	switch t := v.(type) {
+	case string:
+		return &mirror.MetaValue{Value: &mirror.MetaValue_String_{String_: t}}, nil
+	case int64:
+		return &mirror.MetaValue{Value: &mirror.MetaValue_Int{Int: t}}, nil
+	case float64:
+		return &mirror.MetaValue{Value: &mirror.MetaValue_Int{Int: int64(t)}}, nil
+	case bool:
+		return &mirror.MetaValue{Value: &mirror.MetaValue_Bool{Bool: t}}, nil
+	default:
+		return nil, fmt.Errorf("unhandled type %T, allowed values are string, int, bool", v)
+	}
+}
@@ -0,0 +1,85 @@
+package control
+
+import (
+	"testing"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestTransform(t *testing.T) {
+	mod, err := NewTransform(&mirror.ModuleContext{}, []byte(`[
+		{"op": "set_header", "name": "Host", "value": "staging.example.com"},
+		{"op": "remove_header", "name": "Authorization"},
+		{"op": "add_header", "name": "X-Mirrored", "value": "1"},
+		{"op": "add_header", "name": "accept", "value": "text/html"},
+		{"op": "set_path", "value": "{req.path.replace('/v1/', '/v2/')}"},
+		{"op": "set_method", "value": "{req.meta.method.string}"},
+		{"op": "set_meta", "name": "original_host", "value": "{req.header('X-Forwarded-Host')}"},
+		{"op": "set_meta", "name": "mirrored", "value": true}
+	]`))
+	require.NoError(t, err)
+
+	original := mirror.Request{
+		Method: mirror.Method_GET,
+		Path:   "/v1/users",
+		Headers: map[string]*mirror.HeaderValue{
+			"host":             {Values: []string{"www.example.com"}},
+			"authorization":    {Values: []string{"secret"}},
+			"Accept":           {Values: []string{"application/json"}},
+			"X-Forwarded-Host": {Values: []string{"example.com"}},
+		},
+		Meta: map[string]*mirror.MetaValue{
+			"method": {Value: &mirror.MetaValue_String_{String_: "post"}},
+		},
+	}
+
+	in := make(chan mirror.Request, 2)
+	in <- original
+	in <- mirror.Request{Path: "/v1/users"}
+
+	mod.SetInput(in)
+	close(in)
+
+	out := []mirror.Request{}
+	for r := range mod.Output() {
+		out = append(out, r)
+	}
+
+	// the second request is dropped because it has no method meta
+	require.Len(t, out, 1)
+	expected := mirror.Request{
+		Method: mirror.Method_POST,
+		Path:   "/v2/users",
+		Headers: map[string]*mirror.HeaderValue{
+			"host":             {Values: []string{"staging.example.com"}},
+			"Accept":           {Values: []string{"application/json", "text/html"}},
+			"X-Forwarded-Host": {Values: []string{"example.com"}},
+			"X-Mirrored":       {Values: []string{"1"}},
+		},
+		Meta: map[string]*mirror.MetaValue{
+			"method":        {Value: &mirror.MetaValue_String_{String_: "post"}},
+			"original_host": {Value: &mirror.MetaValue_String_{String_: "example.com"}},
+			"mirrored":      {Value: &mirror.MetaValue_Bool{Bool: true}},
+		},
+	}
+	require.True(t, proto.Equal(&expected, &out[0]), "expected %v, got %v", &expected, &out[0])
+
+	// the input request is left untouched
+	require.Len(t, original.Headers, 4)
+	require.Equal(t, []string{"application/json"}, original.Headers["Accept"].Values)
+	require.Len(t, original.Meta, 1)
+}
+
+func TestTransformBadConfig(t *testing.T) {
+	for _, cfg := range []string{
+		`[{"op": "rename_header", "name": "Host", "value": "a"}]`,
+		`[{"op": "set_header", "value": "a"}]`,
+		`[{"op": "set_header", "name": "Host"}]`,
+		`[{"op": "set_path", "value": "{req.method == GET}"}]`,
+	} {
+		_, err := NewTransform(&mirror.ModuleContext{}, []byte(cfg))
+		require.Error(t, err, cfg)
+	}
+}
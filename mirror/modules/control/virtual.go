@@ -20,6 +20,12 @@ func (m *Virtual) Children() [][]mirror.Module {
 	return nil
 }
 
+func (m *Virtual) Start() error {
+	return nil
+}
+
+func (m *Virtual) Stop() {}
+
 func (m *Virtual) Output() <-chan mirror.Request {
 	return nil
 }
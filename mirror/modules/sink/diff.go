@@ -0,0 +1,486 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/criteo/traffic-mirroring/mirror/expr"
+	"github.com/criteo/traffic-mirroring/mirror/registry"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/log"
+)
+
+const (
+	DiffName = "sink.diff"
+
+	defaultDiffEndpoint     = "all"
+	defaultDiffMaxEndpoints = 100
+	// otherDiffEndpoint groups the endpoints beyond max_endpoints
+	otherDiffEndpoint = "other"
+)
+
+var (
+	diffRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "diff_requests_total",
+		Help: "The total number of compared requests by endpoint and result",
+	}, []string{"module", "endpoint", "result"})
+
+	diffNoiseTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "diff_noise_total",
+		Help: "The total number of differences ignored because they are noise between primaries",
+	}, []string{"module", "endpoint"})
+)
+
+func init() {
+	registry.Register(DiffName, NewDiff)
+}
+
+type DiffConfig struct {
+	Primary            HTTPConfig       `json:"primary"`
+	Secondary          *HTTPConfig      `json:"secondary,omitempty"`
+	Candidate          HTTPConfig       `json:"candidate"`
+	Parallel           int              `json:"parallel"`
+	Endpoint           *expr.StringExpr `json:"endpoint,omitempty"`
+	Headers            []string         `json:"headers,omitempty"`
+	Ignore             []string         `json:"ignore,omitempty"`
+	Samples            string           `json:"samples,omitempty"`
+	SamplesPerEndpoint int              `json:"samples_per_endpoint,omitempty"`
+	MaxEndpoints       int              `json:"max_endpoints,omitempty"`
+}
+
+type diffValues struct {
+	Primary   interface{} `json:"primary"`
+	Candidate interface{} `json:"candidate"`
+}
+
+type diffSample struct {
+	Endpoint    string                `json:"endpoint"`
+	Method      string                `json:"method"`
+	Path        string                `json:"path"`
+	Differences map[string]diffValues `json:"differences"`
+}
+
+type Diff struct {
+	ctx *mirror.ModuleContext
+	cfg DiffConfig
+	out chan mirror.Request
+
+	primary   *httpTarget
+	secondary *httpTarget
+	candidate *httpTarget
+	ignore    [][]string
+
+	// endpoints are the endpoints seen, up to max_endpoints. They bound the
+	// metric labels and the maps below.
+	endpoints map[string]bool
+	// noise holds, by endpoint, the fields seen differing between the
+	// primary and the secondary
+	noise       map[string]map[string]bool
+	samplesFile *os.File
+	samples     *json.Encoder
+	sampled     map[string]int
+	stateLock   sync.Mutex
+}
+
+func NewDiff(ctx *mirror.ModuleContext, cfg []byte) (mirror.Module, error) {
+	c := DiffConfig{}
+	err := json.Unmarshal(cfg, &c)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Endpoint == nil {
+		c.Endpoint = &expr.StringExpr{}
+		err := json.Unmarshal([]byte(`"`+defaultDiffEndpoint+`"`), c.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.MaxEndpoints <= 0 {
+		c.MaxEndpoints = defaultDiffMaxEndpoints
+	}
+
+	if c.Parallel <= 0 {
+		c.Parallel = 10
+	}
+
+	if c.SamplesPerEndpoint <= 0 {
+		c.SamplesPerEndpoint = 10
+	}
+
+	mod := &Diff{
+		ctx:       ctx,
+		cfg:       c,
+		out:       make(chan mirror.Request),
+		endpoints: map[string]bool{},
+		noise:     map[string]map[string]bool{},
+		sampled:   map[string]int{},
+	}
+
+	mod.primary, err = mod.newTarget("primary", c.Primary)
+	if err != nil {
+		return nil, err
+	}
+
+	mod.candidate, err = mod.newTarget("candidate", c.Candidate)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Secondary != nil {
+		mod.secondary, err = mod.newTarget("secondary", *c.Secondary)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, path := range c.Ignore {
+		mod.ignore = append(mod.ignore, strings.Split(path, "."))
+	}
+
+	return mod, nil
+}
+
+func (m *Diff) newTarget(name string, c HTTPConfig) (*httpTarget, error) {
+	c.ResponseBody = true
+	c.ResponseHeaders = m.cfg.Headers
+
+	t, err := newHTTPTarget(m.ctx, m.ctx.Name+"."+name, c)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+
+	return t, nil
+}
+
+func (m *Diff) Context() *mirror.ModuleContext {
+	return m.ctx
+}
+
+func (m *Diff) Children() [][]mirror.Module {
+	return nil
+}
+
+func (m *Diff) Start() error {
+	for _, t := range []*httpTarget{m.primary, m.secondary, m.candidate} {
+		if t == nil {
+			continue
+		}
+		err := t.start()
+		if err != nil {
+			return fmt.Errorf("%s: %w", t.name, err)
+		}
+	}
+
+	if m.cfg.Samples != "" {
+		return m.openSamples()
+	}
+
+	return nil
+}
+
+func (m *Diff) openSamples() error {
+	f, err := os.OpenFile(m.cfg.Samples, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	m.samplesFile = f
+	m.samples = json.NewEncoder(f)
+	return nil
+}
+
+// restartLocked opens the samples file again and closes the connections to
+// the targets, after an error with the restart policy.
+func (m *Diff) restartLocked() {
+	for _, t := range []*httpTarget{m.primary, m.secondary, m.candidate} {
+		if t != nil {
+			t.clients.closeIdleConnections()
+		}
+	}
+
+	if m.samplesFile == nil {
+		return
+	}
+	m.samplesFile.Close()
+	m.samplesFile = nil
+	m.samples = nil
+
+	err := m.openSamples()
+	if err != nil {
+		m.ctx.Error(fmt.Errorf("could not open samples: %w", err))
+	}
+}
+
+func (m *Diff) Stop() {}
+
+// Restartable opens the samples file again and closes the connections to
+// the targets on an error with the restart policy.
+func (m *Diff) Restartable() {}
+
+// State shows the circuit breakers which are not closed, and the targets
+// which do not receive requests.
+func (m *Diff) State() map[string]string {
+	res := map[string]string{}
+	for _, t := range []*httpTarget{m.primary, m.secondary, m.candidate} {
+		if t != nil {
+			t.state(res)
+		}
+	}
+	return res
+}
+
+func (m *Diff) Output() <-chan mirror.Request {
+	return m.out
+}
+
+func (m *Diff) SetInput(c <-chan mirror.Request) {
+	wg := sync.WaitGroup{}
+	wg.Add(m.cfg.Parallel)
+
+	for i := 0; i < m.cfg.Parallel; i++ {
+		go func() {
+			defer wg.Done()
+			for r := range c {
+				m.ctx.HandledRequest()
+
+				endpoint, err := m.cfg.Endpoint.Eval(r)
+				if err != nil {
+					if m.ctx.Error(fmt.Errorf("could not evaluate endpoint: %w", err)) == mirror.ErrorPolicyRestart {
+						m.stateLock.Lock()
+						m.restartLocked()
+						m.stateLock.Unlock()
+					}
+					continue
+				}
+
+				m.out <- m.compare(r, m.boundEndpoint(endpoint))
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		for _, t := range []*httpTarget{m.primary, m.secondary, m.candidate} {
+			if t != nil {
+				t.stop()
+			}
+		}
+
+		m.stateLock.Lock()
+		if m.samplesFile != nil {
+			err := m.samplesFile.Close()
+			if err != nil {
+				m.ctx.Error(fmt.Errorf("could not close samples: %w", err))
+			}
+			m.samplesFile = nil
+			m.samples = nil
+		}
+		m.stateLock.Unlock()
+
+		close(m.out)
+	}()
+}
+
+// boundEndpoint returns the endpoint, or otherDiffEndpoint once
+// max_endpoints endpoints were seen.
+func (m *Diff) boundEndpoint(endpoint string) string {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+
+	if !m.endpoints[endpoint] {
+		if len(m.endpoints) >= m.cfg.MaxEndpoints {
+			return otherDiffEndpoint
+		}
+		m.endpoints[endpoint] = true
+	}
+	return endpoint
+}
+
+func (m *Diff) compare(req mirror.Request, endpoint string) mirror.Request {
+	var primary, secondary, candidate *mirror.Response
+	wg := sync.WaitGroup{}
+	send := func(t *httpTarget, res **mirror.Response) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			*res = t.do(req)
+		}()
+	}
+
+	send(m.primary, &primary)
+	send(m.candidate, &candidate)
+	if m.secondary != nil {
+		send(m.secondary, &secondary)
+	}
+	wg.Wait()
+
+	req.Response = candidate
+
+	if primary.Error != "" || candidate.Error != "" || (secondary != nil && secondary.Error != "") {
+		diffRequestsTotal.WithLabelValues(m.ctx.Name, endpoint, "error").Inc()
+		return req
+	}
+
+	diffs := m.diffResponses(primary, candidate)
+
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+
+	noise := m.noise[endpoint]
+	if secondary != nil {
+		for field := range m.diffResponses(primary, secondary) {
+			if noise == nil {
+				noise = map[string]bool{}
+				m.noise[endpoint] = noise
+			}
+			noise[field] = true
+		}
+	}
+
+	for field := range diffs {
+		if noise[field] {
+			diffNoiseTotal.WithLabelValues(m.ctx.Name, endpoint).Inc()
+			delete(diffs, field)
+		}
+	}
+
+	if len(diffs) == 0 {
+		diffRequestsTotal.WithLabelValues(m.ctx.Name, endpoint, "equal").Inc()
+		return req
+	}
+
+	diffRequestsTotal.WithLabelValues(m.ctx.Name, endpoint, "different").Inc()
+	log.Debugf("%s: %s %s: differences in %s", DiffName, req.Method, req.Path, strings.Join(sortedFields(diffs), ", "))
+
+	if m.samples != nil && m.sampled[endpoint] < m.cfg.SamplesPerEndpoint {
+		m.sampled[endpoint]++
+		err := m.samples.Encode(diffSample{
+			Endpoint:    endpoint,
+			Method:      req.Method.String(),
+			Path:        req.Path,
+			Differences: diffs,
+		})
+		if err != nil && m.ctx.Error(fmt.Errorf("could not write sample: %w", err)) == mirror.ErrorPolicyRestart {
+			m.restartLocked()
+		}
+	}
+
+	return req
+}
+
+// diffResponses returns the fields that differ between two responses, keyed
+// by their path: "status_code", "headers.<name>", and "body" followed by the
+// path of the field in JSON bodies.
+func (m *Diff) diffResponses(a, b *mirror.Response) map[string]diffValues {
+	res := map[string]diffValues{}
+	add := func(field string, va, vb interface{}) {
+		if !m.ignored(field) {
+			res[field] = diffValues{Primary: va, Candidate: vb}
+		}
+	}
+
+	if a.StatusCode != b.StatusCode {
+		add("status_code", a.StatusCode, b.StatusCode)
+	}
+
+	for _, name := range m.cfg.Headers {
+		name = http.CanonicalHeaderKey(name)
+		va := strings.Join(a.Headers[name].GetValues(), ",")
+		vb := strings.Join(b.Headers[name].GetValues(), ",")
+		if va != vb {
+			add("headers."+name, va, vb)
+		}
+	}
+
+	if bytes.Equal(a.Body, b.Body) {
+		return res
+	}
+
+	var ja, jb interface{}
+	if json.Unmarshal(a.Body, &ja) != nil || json.Unmarshal(b.Body, &jb) != nil {
+		add("body", a.BodyHash, b.BodyHash)
+		return res
+	}
+
+	diffJSON("body", ja, jb, add)
+	return res
+}
+
+func (m *Diff) ignored(field string) bool {
+	parts := strings.Split(field, ".")
+
+ignore:
+	for _, ignore := range m.ignore {
+		if len(ignore) > len(parts) {
+			continue
+		}
+
+		for i, p := range ignore {
+			if p != "*" && p != parts[i] {
+				continue ignore
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+func diffJSON(path string, a, b interface{}, add func(string, interface{}, interface{})) {
+	switch ta := a.(type) {
+	case map[string]interface{}:
+		tb, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+
+		keys := map[string]bool{}
+		for k := range ta {
+			keys[k] = true
+		}
+		for k := range tb {
+			keys[k] = true
+		}
+
+		for k := range keys {
+			diffJSON(path+"."+k, ta[k], tb[k], add)
+		}
+		return
+	case []interface{}:
+		tb, ok := b.([]interface{})
+		if !ok || len(ta) != len(tb) {
+			break
+		}
+
+		for i := range ta {
+			diffJSON(fmt.Sprintf("%s.%d", path, i), ta[i], tb[i], add)
+		}
+		return
+	}
+
+	ea, _ := json.Marshal(a)
+	eb, _ := json.Marshal(b)
+	if !bytes.Equal(ea, eb) {
+		add(path, a, b)
+	}
+}
+
+// sortedFields is used to log differences in a stable order.
+func sortedFields(diffs map[string]diffValues) []string {
+	res := make([]string, 0, len(diffs))
+	for k := range diffs {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
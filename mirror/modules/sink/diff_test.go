@@ -0,0 +1,154 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/stretchr/testify/require"
+)
+
+func newDiffTestServer(name string) *httptest.Server {
+	counter := int64(0)
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(rw, `{"path": %q, "name": %q, "counter": %d}`, r.URL.Path, name, atomic.AddInt64(&counter, 1))
+	}))
+}
+
+func runDiff(t *testing.T, cfg string, paths ...string) []mirror.Request {
+	mod, err := NewDiff(&mirror.ModuleContext{Name: t.Name()}, []byte(cfg))
+	require.NoError(t, err)
+	require.NoError(t, mod.Start())
+
+	in := make(chan mirror.Request, len(paths))
+	for _, p := range paths {
+		in <- mirror.Request{Method: mirror.Method_GET, Path: p}
+	}
+
+	mod.SetInput(in)
+	close(in)
+
+	out := []mirror.Request{}
+	for r := range mod.Output() {
+		out = append(out, r)
+	}
+
+	return out
+}
+
+func readSamples(t *testing.T, path string) []diffSample {
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+
+	res := []diffSample{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for dec.More() {
+		s := diffSample{}
+		require.NoError(t, dec.Decode(&s))
+		res = append(res, s)
+	}
+
+	return res
+}
+
+func TestDiff(t *testing.T) {
+	primary := newDiffTestServer("primary")
+	secondary := newDiffTestServer("primary")
+	candidate := newDiffTestServer("candidate")
+
+	f, err := ioutil.TempFile("/tmp", "http-mirror-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	out := runDiff(t, `{
+		"primary": {"target_url": "`+primary.URL+`", "timeout": "10s"},
+		"secondary": {"target_url": "`+secondary.URL+`", "timeout": "10s"},
+		"candidate": {"target_url": "`+candidate.URL+`", "timeout": "10s"},
+		"parallel": 1,
+		"endpoint": "{req.path}",
+		"headers": ["Content-Type"],
+		"samples": "`+f.Name()+`",
+		"samples_per_endpoint": 2
+	}`, "/a", "/a", "/a", "/b")
+
+	require.Len(t, out, 4)
+	for _, r := range out {
+		require.NotNil(t, r.Response)
+		require.Equal(t, int32(http.StatusOK), r.Response.StatusCode)
+	}
+
+	samples := readSamples(t, f.Name())
+	require.Len(t, samples, 3)
+	for _, s := range samples {
+		// counter only differs between primary and candidate on the
+		// first request, and is then known as noise
+		require.Equal(t, map[string]diffValues{
+			"body.name": {Primary: "primary", Candidate: "candidate"},
+		}, s.Differences)
+	}
+	require.Equal(t, []string{"/a", "/a", "/b"}, []string{samples[0].Path, samples[1].Path, samples[2].Path})
+}
+
+func TestDiffIgnore(t *testing.T) {
+	primary := newDiffTestServer("primary")
+	candidate := newDiffTestServer("candidate")
+
+	f, err := ioutil.TempFile("/tmp", "http-mirror-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	runDiff(t, `{
+		"primary": {"target_url": "`+primary.URL+`", "timeout": "10s"},
+		"candidate": {"target_url": "`+candidate.URL+`", "timeout": "10s"},
+		"ignore": ["body.name", "body.counter"],
+		"samples": "`+f.Name()+`"
+	}`, "/a", "/b")
+
+	require.Len(t, readSamples(t, f.Name()), 0)
+}
+
+func TestDiffMaxEndpoints(t *testing.T) {
+	primary := newDiffTestServer("primary")
+	candidate := newDiffTestServer("candidate")
+
+	f, err := ioutil.TempFile("/tmp", "http-mirror-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	runDiff(t, `{
+		"primary": {"target_url": "`+primary.URL+`", "timeout": "10s"},
+		"candidate": {"target_url": "`+candidate.URL+`", "timeout": "10s"},
+		"parallel": 1,
+		"endpoint": "{req.path}",
+		"max_endpoints": 2,
+		"samples": "`+f.Name()+`"
+	}`, "/a", "/b", "/c", "/a", "/d")
+
+	endpoints := []string{}
+	for _, s := range readSamples(t, f.Name()) {
+		endpoints = append(endpoints, s.Endpoint)
+	}
+	require.Equal(t, []string{"/a", "/b", "other", "/a", "other"}, endpoints)
+}
+
+func TestDiffError(t *testing.T) {
+	primary := newDiffTestServer("primary")
+	candidate := newDiffTestServer("candidate")
+	candidate.Close()
+
+	out := runDiff(t, `{
+		"primary": {"target_url": "`+primary.URL+`", "timeout": "10s"},
+		"candidate": {"target_url": "`+candidate.URL+`", "timeout": "10s"}
+	}`, "/a")
+
+	require.Len(t, out, 1)
+	require.NotEmpty(t, out[0].Response.Error)
+}
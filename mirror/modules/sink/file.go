@@ -2,16 +2,15 @@ package sink
 
 import (
 	"bufio"
-	"encoding/binary"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
 	"os"
 
 	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/criteo/traffic-mirroring/mirror/codec"
 	"github.com/criteo/traffic-mirroring/mirror/expr"
 	"github.com/criteo/traffic-mirroring/mirror/registry"
-	"github.com/gogo/protobuf/proto"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	log "github.com/sirupsen/logrus"
@@ -53,15 +52,12 @@ type File struct {
 	ctx *mirror.ModuleContext
 	cfg FileConfig
 
-	f   *bufio.Writer
-	fmt string
-	out chan mirror.Request
+	file *os.File
+	f    *bufio.Writer
+	fmt  string
+	out  chan mirror.Request
 
-	encoder func(w io.Writer, req mirror.Request) error
-
-	protoBuf     *proto.Buffer
-	protoSizeBuf []byte
-	jsonEnc      *json.Encoder
+	encoder codec.Encoder
 
 	ready bool
 }
@@ -73,19 +69,21 @@ func NewFile(ctx *mirror.ModuleContext, cfg []byte) (mirror.Module, error) {
 		return nil, err
 	}
 
+	if c.Path == nil {
+		return nil, errors.New("path is required")
+	}
+
+	err = codec.CheckFormat(c.Format, false)
+	if err != nil {
+		return nil, err
+	}
+
 	mod := &File{
 		ctx: ctx,
 		cfg: c,
 		out: make(chan mirror.Request),
 	}
 
-	if c.Path.Static() {
-		err := mod.init(mirror.Request{})
-		if err != nil {
-			return nil, err
-		}
-	}
-
 	return mod, nil
 }
 
@@ -97,6 +95,19 @@ func (m *File) Children() [][]mirror.Module {
 	return nil
 }
 
+func (m *File) Start() error {
+	if m.cfg.Path.Static() {
+		return m.init(mirror.Request{})
+	}
+
+	return nil
+}
+
+func (m *File) Stop() {}
+
+// Restartable opens the file again on an error with the restart policy.
+func (m *File) Restartable() {}
+
 func (m *File) Output() <-chan mirror.Request {
 	return m.out
 }
@@ -107,62 +118,33 @@ func (m *File) SetInput(c <-chan mirror.Request) {
 			if !m.ready {
 				err := m.init(r)
 				if err != nil {
-					log.Fatalf("%s: %s", FileName, err)
+					m.ctx.Error(err)
+					continue
 				}
 			}
 
 			m.ctx.HandledRequest()
-			err := m.encoder(m.f, r)
-			if err != nil {
-				log.Errorf("%s: %s", FileName, err)
+			err := m.encoder.Encode(r)
+			if err != nil && m.ctx.Error(err) == mirror.ErrorPolicyRestart {
+				// the file is opened again on the next request
+				m.close()
+				m.ready = false
 			}
 		}
-		err := m.f.Flush()
-		if err != nil {
-			log.Errorf("%s: %s", FileName, err)
+		if m.ready {
+			m.close()
 		}
 		close(m.out)
 	}()
 }
 
-func (m *File) writeJSON(w io.Writer, req mirror.Request) error {
-	err := m.jsonEnc.Encode(req)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (m *File) writeProto(w io.Writer, req mirror.Request) error {
-	m.protoBuf.Reset()
-	err := m.protoBuf.Marshal(&req)
-	if err != nil {
-		return err
-	}
-
-	n := binary.PutUvarint(m.protoSizeBuf, uint64(len(m.protoBuf.Bytes())))
-
-	_, err = w.Write(m.protoSizeBuf[:n])
-	if err != nil {
-		return err
-	}
-
-	_, err = w.Write(m.protoBuf.Bytes())
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
 func (m *File) init(r mirror.Request) error {
 	path, err := m.cfg.Path.Eval(r)
 	if err != nil {
 		return err
 	}
 
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0o644)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
 	if err != nil {
 		return err
 	}
@@ -176,21 +158,26 @@ func (m *File) init(r mirror.Request) error {
 		inner: f,
 	}, m.cfg.BufferSize)
 
+	m.file = f
 	m.f = w
-	m.protoBuf = proto.NewBuffer(nil)
-	m.protoSizeBuf = make([]byte, binary.MaxVarintLen64)
-	m.jsonEnc = json.NewEncoder(w)
-
-	switch m.cfg.Format {
-	case "proto":
-		m.encoder = m.writeProto
-	case "json":
-		m.encoder = m.writeJSON
-	default:
-		return fmt.Errorf("unknown format %q", m.cfg.Format)
+	m.encoder, err = codec.NewEncoder(w, m.cfg.Format)
+	if err != nil {
+		return err
 	}
 
 	m.ready = true
 
 	return nil
 }
+
+func (m *File) close() {
+	err := m.f.Flush()
+	if err != nil {
+		log.Errorf("%s: %s", FileName, err)
+	}
+
+	err = m.file.Close()
+	if err != nil {
+		log.Errorf("%s: %s", FileName, err)
+	}
+}
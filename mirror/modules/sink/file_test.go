@@ -1,13 +1,16 @@
 package sink
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
+	"io"
 	"io/ioutil"
 	"os"
 	"testing"
 
 	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/criteo/traffic-mirroring/mirror/codec"
 	"github.com/stretchr/testify/require"
 )
 
@@ -62,3 +65,44 @@ func TestFileJSON(t *testing.T) {
 		require.Equal(t, reqs[i], req)
 	}
 }
+
+func TestFileRestart(t *testing.T) {
+	f, err := ioutil.TempFile("/tmp", "http-mirror-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	ctx := &mirror.ModuleContext{ErrorPolicy: mirror.ErrorPolicyRestart}
+	mod, err := NewFile(ctx, []byte(`{"path": "`+f.Name()+`", "format": "proto"}`))
+	require.NoError(t, err)
+	require.NoError(t, mod.Start())
+
+	// a path which is not valid UTF-8 cannot be encoded, the file is
+	// opened again for the next request
+	in := make(chan mirror.Request, 4)
+	for _, p := range []string{"/1", "/2", "\xff", "/3"} {
+		in <- mirror.Request{Path: p}
+	}
+	mod.SetInput(in)
+	close(in)
+	<-mod.Output()
+	require.Equal(t, uint64(1), ctx.Errors())
+
+	r, err := os.Open(f.Name())
+	require.NoError(t, err)
+	defer r.Close()
+
+	dec, err := codec.NewDecoder(bufio.NewReader(r), codec.FormatProto)
+	require.NoError(t, err)
+
+	paths := []string{}
+	for {
+		req := mirror.Request{}
+		err := dec.Decode(&req)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		paths = append(paths, req.Path)
+	}
+	require.Equal(t, []string{"/1", "/2", "/3"}, paths)
+}
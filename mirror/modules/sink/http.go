@@ -1,14 +1,9 @@
 package sink
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"net/http"
-	"strconv"
-	"sync"
 	"time"
 
 	"github.com/criteo/traffic-mirroring/mirror"
@@ -16,12 +11,10 @@ import (
 	"github.com/criteo/traffic-mirroring/mirror/registry"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/common/log"
 )
 
 const (
-	HTTPName      = "sink.http"
-	workerTimeout = 2 * time.Second
+	HTTPName = "sink.http"
 )
 
 var (
@@ -42,22 +35,43 @@ func init() {
 }
 
 type HTTPConfig struct {
-	FollowRedirects bool             `json:"follow_redirects,omitempty"`
-	TargetURL       *expr.StringExpr `json:"target_url,omitempty"`
-	Timeout         string           `json:"timeout,omitempty"`
-	Parallel        int              `json:"parallel"`
+	FollowRedirects bool                   `json:"follow_redirects,omitempty"`
+	TargetURL       *expr.StringExpr       `json:"target_url,omitempty"`
+	Timeout         string                 `json:"timeout,omitempty"`
+	Parallel        int                    `json:"parallel"`
+	MinParallel     int                    `json:"min_parallel,omitempty"`
+	IdleTimeout     string                 `json:"idle_timeout,omitempty"`
+	Adaptive        *HTTPAdaptive          `json:"adaptive,omitempty"`
+	ResponseHeaders []string               `json:"response_headers,omitempty"`
+	ResponseBody    bool                   `json:"response_body,omitempty"`
+	PreserveHost    bool                   `json:"preserve_host,omitempty"`
+	RequestIDHeader string                 `json:"request_id_header,omitempty"`
+	Protocol        string                 `json:"protocol,omitempty"`
+	TLS             *HTTPTLSConfig         `json:"tls,omitempty"`
+	Transport       *HTTPTransportConfig   `json:"transport,omitempty"`
+	Retry           *HTTPRetryConfig       `json:"retry,omitempty"`
+	CircuitBreaker  *HTTPBreakerConfig     `json:"circuit_breaker,omitempty"`
+	Targets         []string               `json:"targets,omitempty"`
+	Resolve         *HTTPResolveConfig     `json:"resolve,omitempty"`
+	Balance         string                 `json:"balance,omitempty"`
+	HashKey         *expr.AnyExpr          `json:"hash_key,omitempty"`
+	HealthCheck     *HTTPHealthCheckConfig `json:"health_check,omitempty"`
+	Ejection        *HTTPEjectionConfig    `json:"ejection,omitempty"`
+	Allow           *HTTPAllowConfig       `json:"allow,omitempty"`
+}
+
+// HTTPAdaptive adjusts the number of workers to keep the latency of the
+// target below TargetLatency.
+type HTTPAdaptive struct {
+	TargetLatency string `json:"target_latency"`
+	Interval      string `json:"interval,omitempty"`
 }
 
 type HTTP struct {
 	ctx    *mirror.ModuleContext
 	out    chan mirror.Request
-	tasks  chan mirror.Request
-	client *http.Client
-	cfg    HTTPConfig
-
-	numWorkers int
-	maxWorkers int
-	workersWG  sync.WaitGroup
+	target *httpTarget
+	pool   *workerPool
 }
 
 func NewHTTP(ctx *mirror.ModuleContext, cfg []byte) (mirror.Module, error) {
@@ -68,35 +82,62 @@ func NewHTTP(ctx *mirror.ModuleContext, cfg []byte) (mirror.Module, error) {
 		return nil, err
 	}
 
-	timeout, err := time.ParseDuration(c.Timeout)
+	target, err := newHTTPTarget(ctx, ctx.Name, c)
 	if err != nil {
-		return nil, fmt.Errorf("timeout: %w", err)
+		return nil, err
 	}
 
-	maxWorkers := 10
-	if c.Parallel > 0 {
-		maxWorkers = c.Parallel
+	pc, err := newPoolConfig(c)
+	if err != nil {
+		return nil, err
 	}
 
-	httpClient := &http.Client{
-		Timeout: timeout,
+	mod := &HTTP{
+		ctx:    ctx,
+		out:    make(chan mirror.Request),
+		target: target,
 	}
+	mod.pool = newWorkerPool(ctx.Name, pc, mod.sendRequest)
+
+	return mod, nil
+}
 
-	if !c.FollowRedirects {
-		httpClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
+func newPoolConfig(c HTTPConfig) (poolConfig, error) {
+	pc := poolConfig{
+		min:         c.MinParallel,
+		max:         10,
+		idleTimeout: 2 * time.Second,
+		interval:    time.Second,
+	}
+	if c.Parallel > 0 {
+		pc.max = c.Parallel
+	}
+	if pc.min < 0 || pc.min > pc.max {
+		return pc, errors.New("min_parallel must be between 0 and parallel")
+	}
+
+	var err error
+	if c.IdleTimeout != "" {
+		pc.idleTimeout, err = time.ParseDuration(c.IdleTimeout)
+		if err != nil {
+			return pc, fmt.Errorf("idle_timeout: %w", err)
 		}
 	}
 
-	mod := &HTTP{
-		ctx:        ctx,
-		cfg:        c,
-		out:        make(chan mirror.Request),
-		tasks:      make(chan mirror.Request),
-		client:     httpClient,
-		maxWorkers: maxWorkers,
+	if c.Adaptive != nil {
+		pc.targetLatency, err = time.ParseDuration(c.Adaptive.TargetLatency)
+		if err != nil {
+			return pc, fmt.Errorf("adaptive.target_latency: %w", err)
+		}
+		if c.Adaptive.Interval != "" {
+			pc.interval, err = time.ParseDuration(c.Adaptive.Interval)
+			if err != nil {
+				return pc, fmt.Errorf("adaptive.interval: %w", err)
+			}
+		}
 	}
-	return mod, nil
+
+	return pc, nil
 }
 
 func (m *HTTP) Context() *mirror.ModuleContext {
@@ -107,90 +148,86 @@ func (m *HTTP) Children() [][]mirror.Module {
 	return nil
 }
 
+func (m *HTTP) Start() error {
+	return m.target.start()
+}
+
+func (m *HTTP) Stop() {}
+
 func (m *HTTP) Output() <-chan mirror.Request {
 	return m.out
 }
 
 func (m *HTTP) SetInput(c <-chan mirror.Request) {
+	m.pool.start()
+
 	go func() {
 		for r := range c {
-			if m.numWorkers >= m.maxWorkers {
-				m.tasks <- r
-			} else {
-				select {
-				case m.tasks <- r:
-				default:
-					go m.runWorker(r)
-					m.numWorkers++
-					m.workersWG.Add(1)
-					log.Debugf("%s: Increase numWorkers to %d/%d", HTTPName, m.numWorkers, m.maxWorkers)
-				}
-			}
+			m.pool.submit(r)
 		}
-		close(m.tasks)
-		m.workersWG.Wait()
+		m.pool.close()
+		m.target.stop()
 		close(m.out)
 	}()
 }
 
-func (m *HTTP) sendRequest(req mirror.Request) {
-	m.ctx.HandledRequest()
-	baseURL, err := m.cfg.TargetURL.Eval(req)
-	if err != nil {
-		log.Errorf("%s: could not evaluate target URL: %s", HTTPName, err)
-		return
-	}
-	url := baseURL + req.Path
-
-	headers := http.Header{}
-	for name, vals := range req.Headers {
-		headers[name] = vals.Values
+func (m *HTTP) Params() map[string]interface{} {
+	min, max := m.pool.limits()
+	return map[string]interface{}{
+		"parallel":     max,
+		"min_parallel": min,
 	}
+}
 
-	hreq, err := http.NewRequest(
-		req.Method.String(),
-		url,
-		ioutil.NopCloser(bytes.NewBuffer(req.Body)),
-	)
+// SetParams changes the number of workers, the workers in excess stop after
+// their current request.
+func (m *HTTP) SetParams(b []byte) error {
+	p := struct {
+		Parallel    *int `json:"parallel"`
+		MinParallel *int `json:"min_parallel"`
+	}{}
+	err := mirror.DecodeParams(b, &p)
 	if err != nil {
-		log.Errorf("%s: could not create request: %s", HTTPName, err)
-		return
+		return err
 	}
-	hreq.Header = headers
 
-	start := time.Now()
-	res, err := m.client.Do(hreq)
-	if err != nil {
-		log.Errorf("%s: %q: %s", HTTPName, url, err)
-		return
+	min, max := m.pool.limits()
+	if p.Parallel != nil {
+		max = *p.Parallel
+	}
+	if p.MinParallel != nil {
+		min = *p.MinParallel
+	}
+	if max <= 0 {
+		return errors.New("parallel must be positive")
+	}
+	if min < 0 || min > max {
+		return errors.New("min_parallel must be between 0 and parallel")
 	}
 
-	httpResponseTime.WithLabelValues(m.ctx.Name).Observe(time.Since(start).Seconds())
-	httpResponseTotal.WithLabelValues(m.ctx.Name, strconv.Itoa(res.StatusCode)).Inc()
-
-	io.Copy(ioutil.Discard, res.Body)
-	res.Body.Close()
+	m.pool.setLimits(min, max)
+	return nil
 }
 
-func (m *HTTP) runWorker(req mirror.Request) {
-	defer m.workersWG.Done()
+// Restartable closes the connections to the target on an error with the
+// restart policy.
+func (m *HTTP) Restartable() {}
 
-	m.sendRequest(req)
-	timeout := time.NewTimer(workerTimeout)
+// State shows the circuit breakers which are not closed, and the targets
+// which do not receive requests.
+func (m *HTTP) State() map[string]string {
+	res := map[string]string{}
+	m.target.state(res)
+	return res
+}
 
-	for {
-		select {
-		case req, ok := <-m.tasks:
-			if !ok {
-				return
-			}
+func (m *HTTP) sendRequest(req mirror.Request) time.Duration {
+	m.ctx.HandledRequest()
 
-			m.sendRequest(req)
-			timeout.Reset(workerTimeout)
-		case <-timeout.C:
-			m.numWorkers--
-			log.Debugf("%s: Timeout, Decrease numWorkers to %d/%d", HTTPName, m.numWorkers, m.maxWorkers)
-			return
-		}
-	}
+	start := time.Now()
+	req.Response = m.target.do(req)
+	latency := time.Since(start)
+
+	m.out <- req
+	return latency
 }
@@ -0,0 +1,247 @@
+package sink
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/log"
+)
+
+const (
+	logRejectedInterval = 10 * time.Second
+)
+
+var (
+	errTargetNotAllowed = errors.New("target not allowed")
+
+	// privateRanges are denied unless they are in the allowed CIDRs
+	privateRanges = mustParseCIDRs(
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.0.0.0/24",
+		"192.168.0.0/16",
+		"198.18.0.0/15",
+		"224.0.0.0/4",
+		"240.0.0.0/4",
+		"::/128",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+		"ff00::/8",
+	)
+
+	// nat64Range and sixToFourRange embed an IPv4 address, which a gateway
+	// would connect to
+	nat64Range     = mustParseCIDRs("64:ff9b::/96")[0]
+	sixToFourRange = mustParseCIDRs("2002::/16")[0]
+
+	httpTargetRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_target_rejected_total",
+		Help: "The total number of requests not sent because their target is not allowed",
+	}, []string{"module", "reason"})
+)
+
+// HTTPAllowConfig restricts the targets of a templated target_url.
+type HTTPAllowConfig struct {
+	Hosts   []string `json:"hosts,omitempty"`
+	CIDRs   []string `json:"cidrs,omitempty"`
+	Schemes []string `json:"schemes,omitempty"`
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowlist checks the targets evaluated from the requests: their URL before
+// sending, and the address they resolve to when connecting.
+type allowlist struct {
+	name    string
+	schemes map[string]bool
+	hosts   []string
+	cidrs   []*net.IPNet
+
+	lock       sync.Mutex
+	lastLog    time.Time
+	suppressed int
+}
+
+func newAllowlist(name string, c *HTTPAllowConfig) (*allowlist, error) {
+	if c == nil || (len(c.Hosts) == 0 && len(c.CIDRs) == 0) {
+		return nil, errors.New("allow.hosts or allow.cidrs is required with a templated target_url")
+	}
+
+	a := &allowlist{
+		name:    name,
+		schemes: map[string]bool{},
+	}
+
+	schemes := c.Schemes
+	if schemes == nil {
+		schemes = []string{"http", "https"}
+	}
+	for _, s := range schemes {
+		a.schemes[strings.ToLower(s)] = true
+	}
+
+	for _, h := range c.Hosts {
+		if h == "" || strings.Contains(h[1:], "*") || (h[0] == '*' && h != "*" && !strings.HasPrefix(h, "*.")) {
+			return nil, fmt.Errorf("allow.hosts: invalid pattern %q", h)
+		}
+		a.hosts = append(a.hosts, strings.ToLower(h))
+	}
+
+	var err error
+	a.cidrs, err = parseCIDRs(c.CIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("allow.cidrs: %w", err)
+	}
+
+	return a, nil
+}
+
+// checkURL returns an error if the target is not allowed.
+func (a *allowlist) checkURL(target string) error {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return a.reject(target, "invalid URL")
+	}
+
+	if !a.schemes[strings.ToLower(u.Scheme)] {
+		return a.reject(target, "scheme")
+	}
+
+	// the addresses must be in the CIDRs, and the names match the hosts
+	host := strings.ToLower(u.Hostname())
+	if ip := net.ParseIP(host); ip != nil {
+		if !containsIP(a.cidrs, ip) {
+			return a.reject(target, "host")
+		}
+		return nil
+	}
+
+	if !a.matchHost(host) {
+		return a.reject(target, "host")
+	}
+
+	return nil
+}
+
+func (a *allowlist) matchHost(host string) bool {
+	for _, pattern := range a.hosts {
+		switch {
+		case pattern == "*":
+			return true
+		case strings.HasPrefix(pattern, "*."):
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+		case host == pattern:
+			return true
+		}
+	}
+	return false
+}
+
+// control is called by the dialer with the address a host resolved to,
+// private addresses are denied unless they are in the allowed CIDRs.
+func (a *allowlist) control(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return a.reject(address, "invalid address")
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || a.denied(ip) {
+		return a.reject(address, "private address")
+	}
+
+	return nil
+}
+
+// denied returns whether the address, or the IPv4 address it embeds, is
+// private and not in the allowed CIDRs.
+func (a *allowlist) denied(ip net.IP) bool {
+	if containsIP(privateRanges, ip) && !containsIP(a.cidrs, ip) {
+		return true
+	}
+
+	v4 := embeddedIPv4(ip)
+	return v4 != nil && containsIP(privateRanges, v4) && !containsIP(a.cidrs, v4)
+}
+
+// embeddedIPv4 returns the IPv4 address of a NAT64 or 6to4 address, or nil.
+func embeddedIPv4(ip net.IP) net.IP {
+	if ip.To4() != nil {
+		return nil
+	}
+
+	ip = ip.To16()
+	switch {
+	case nat64Range.Contains(ip):
+		return net.IPv4(ip[12], ip[13], ip[14], ip[15])
+	case sixToFourRange.Contains(ip):
+		return net.IPv4(ip[2], ip[3], ip[4], ip[5])
+	default:
+		return nil
+	}
+}
+
+// reject counts the rejected target and logs it, at most once per
+// logRejectedInterval.
+func (a *allowlist) reject(target, reason string) error {
+	httpTargetRejected.WithLabelValues(a.name, reason).Inc()
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if time.Since(a.lastLog) < logRejectedInterval {
+		a.suppressed++
+	} else {
+		if a.suppressed > 0 {
+			log.Warnf("%s: rejected target %q: %s, and %d others since the last log", a.name, target, reason, a.suppressed)
+		} else {
+			log.Warnf("%s: rejected target %q: %s", a.name, target, reason)
+		}
+		a.lastLog = time.Now()
+		a.suppressed = 0
+	}
+
+	return fmt.Errorf("%w: %s: %s", errTargetNotAllowed, target, reason)
+}
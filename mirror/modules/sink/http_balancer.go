@@ -0,0 +1,650 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/criteo/traffic-mirroring/mirror/expr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/log"
+)
+
+const (
+	BalanceRoundRobin    = "round_robin"
+	BalanceLeastInFlight = "least_in_flight"
+	BalanceHash          = "hash"
+
+	// hashReplicas is the number of points of each endpoint on the hash ring
+	hashReplicas = 100
+)
+
+var (
+	errNoEndpoint = errors.New("no available target")
+
+	httpEndpointRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_endpoint_requests_total",
+		Help: "The total number of requests sent to an endpoint",
+	}, []string{"module", "endpoint"})
+
+	httpEndpointFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_endpoint_failures_total",
+		Help: "The total number of requests to an endpoint which failed or got a 5xx response",
+	}, []string{"module", "endpoint"})
+
+	httpEndpointResponseTime = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_endpoint_response_time_seconds",
+		Help:    "Http response time of an endpoint",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 5),
+	}, []string{"module", "endpoint"})
+
+	httpEndpointInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_endpoint_in_flight",
+		Help: "The number of requests being sent to an endpoint",
+	}, []string{"module", "endpoint"})
+
+	httpEndpointAvailable = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_endpoint_available",
+		Help: "Whether an endpoint receives requests: 1 if it is healthy and not ejected, 0 otherwise",
+	}, []string{"module", "endpoint"})
+
+	httpEndpointEjections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_endpoint_ejections_total",
+		Help: "The total number of times an endpoint was ejected after consecutive failures",
+	}, []string{"module", "endpoint"})
+)
+
+// HTTPResolveConfig sends the requests to the addresses of a DNS name.
+type HTTPResolveConfig struct {
+	URL      string `json:"url"`
+	Interval string `json:"interval,omitempty"`
+}
+
+// HTTPHealthCheckConfig checks the endpoints periodically, the unhealthy
+// ones do not receive requests.
+type HTTPHealthCheckConfig struct {
+	Path               string `json:"path"`
+	Interval           string `json:"interval,omitempty"`
+	Timeout            string `json:"timeout,omitempty"`
+	HealthyThreshold   int    `json:"healthy_threshold,omitempty"`
+	UnhealthyThreshold int    `json:"unhealthy_threshold,omitempty"`
+}
+
+// HTTPEjectionConfig stops sending requests to an endpoint for a while after
+// consecutive failures.
+type HTTPEjectionConfig struct {
+	Failures   int     `json:"failures,omitempty"`
+	Duration   string  `json:"duration,omitempty"`
+	MaxPercent float64 `json:"max_percent,omitempty"`
+}
+
+type resolveConfig struct {
+	scheme   string
+	hostname string
+	port     string
+	host     string
+	interval time.Duration
+}
+
+type healthConfig struct {
+	path      string
+	interval  time.Duration
+	timeout   time.Duration
+	healthy   int
+	unhealthy int
+}
+
+type ejectionConfig struct {
+	failures   int
+	duration   time.Duration
+	maxPercent float64
+}
+
+// endpoint is a target of the balancer.
+type endpoint struct {
+	url string
+	// host is sent in the Host header, for the resolved endpoints
+	host string
+
+	inFlight int
+	healthy  bool
+	// checks is the number of consecutive health checks contradicting
+	// healthy
+	checks       int
+	failures     int
+	ejectedUntil time.Time
+	// removed is set once the endpoint is not in the balancer anymore, its
+	// metrics are deleted and must not be set again by the requests in
+	// flight
+	removed bool
+}
+
+type ringPoint struct {
+	hash     uint64
+	endpoint *endpoint
+}
+
+// balancer spreads the requests over several endpoints, either given in the
+// config or resolved from a DNS name.
+type balancer struct {
+	name     string
+	strategy string
+	hashKey  *expr.AnyExpr
+	resolve  *resolveConfig
+	health   *healthConfig
+	ejection *ejectionConfig
+	// check sends a health check to the endpoint
+	check func(ep *endpoint, timeout time.Duration) bool
+
+	lock      sync.Mutex
+	endpoints []*endpoint
+	ring      []ringPoint
+	next      int
+
+	done chan struct{}
+}
+
+func newBalancer(name string, c HTTPConfig) (*balancer, error) {
+	if c.Targets == nil && c.Resolve == nil {
+		if c.Balance != "" || c.HealthCheck != nil || c.Ejection != nil {
+			return nil, errors.New("balance, health_check and ejection need targets or resolve")
+		}
+		return nil, nil
+	}
+
+	b := &balancer{
+		name:     name,
+		strategy: c.Balance,
+		hashKey:  c.HashKey,
+		done:     make(chan struct{}),
+	}
+
+	switch c.Balance {
+	case "":
+		b.strategy = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceLeastInFlight:
+	case BalanceHash:
+		if c.HashKey == nil {
+			return nil, errors.New("hash_key is required with the hash balance")
+		}
+	default:
+		return nil, fmt.Errorf("unknown balance %q", c.Balance)
+	}
+
+	var err error
+	if c.Resolve != nil {
+		b.resolve, err = newResolveConfig(c.Resolve)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if len(c.Targets) == 0 {
+			return nil, errors.New("targets is empty")
+		}
+		urls := []string{}
+		for _, t := range c.Targets {
+			u, err := url.Parse(t)
+			if err != nil {
+				return nil, fmt.Errorf("targets: %w", err)
+			}
+			if u.Scheme == "" || u.Host == "" {
+				return nil, fmt.Errorf("targets: %q is not an absolute URL", t)
+			}
+			urls = append(urls, t)
+		}
+		b.setEndpoints(urls, "")
+	}
+
+	if c.HealthCheck != nil {
+		b.health, err = newHealthConfig(c.HealthCheck)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.Ejection != nil {
+		b.ejection, err = newEjectionConfig(c.Ejection)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+func newResolveConfig(c *HTTPResolveConfig) (*resolveConfig, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("resolve.url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("resolve.url: unknown scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("resolve.url: the host is missing")
+	}
+
+	rc := &resolveConfig{
+		scheme:   u.Scheme,
+		hostname: u.Hostname(),
+		port:     u.Port(),
+		host:     u.Host,
+		interval: 30 * time.Second,
+	}
+	if rc.port == "" {
+		rc.port = "80"
+		if u.Scheme == "https" {
+			rc.port = "443"
+		}
+	}
+
+	if c.Interval != "" {
+		rc.interval, err = time.ParseDuration(c.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("resolve.interval: %w", err)
+		}
+	}
+
+	return rc, nil
+}
+
+func newHealthConfig(c *HTTPHealthCheckConfig) (*healthConfig, error) {
+	hc := &healthConfig{
+		path:      c.Path,
+		interval:  5 * time.Second,
+		timeout:   time.Second,
+		healthy:   1,
+		unhealthy: 2,
+	}
+	if c.Path == "" {
+		return nil, errors.New("health_check.path is required")
+	}
+	if c.HealthyThreshold > 0 {
+		hc.healthy = c.HealthyThreshold
+	}
+	if c.UnhealthyThreshold > 0 {
+		hc.unhealthy = c.UnhealthyThreshold
+	}
+
+	var err error
+	if c.Interval != "" {
+		hc.interval, err = time.ParseDuration(c.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("health_check.interval: %w", err)
+		}
+	}
+	if c.Timeout != "" {
+		hc.timeout, err = time.ParseDuration(c.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("health_check.timeout: %w", err)
+		}
+	}
+
+	return hc, nil
+}
+
+func newEjectionConfig(c *HTTPEjectionConfig) (*ejectionConfig, error) {
+	ec := &ejectionConfig{
+		failures:   5,
+		duration:   30 * time.Second,
+		maxPercent: 50,
+	}
+	if c.Failures > 0 {
+		ec.failures = c.Failures
+	}
+	if c.MaxPercent < 0 || c.MaxPercent > 100 {
+		return nil, errors.New("ejection.max_percent must be between 0 and 100")
+	}
+	if c.MaxPercent > 0 {
+		ec.maxPercent = c.MaxPercent
+	}
+
+	if c.Duration != "" {
+		var err error
+		ec.duration, err = time.ParseDuration(c.Duration)
+		if err != nil {
+			return nil, fmt.Errorf("ejection.duration: %w", err)
+		}
+	}
+
+	return ec, nil
+}
+
+// start resolves the DNS name, and starts the resolution and the health
+// checks in the background until stop.
+func (b *balancer) start(check func(ep *endpoint, timeout time.Duration) bool) error {
+	b.check = check
+
+	if b.resolve != nil {
+		err := b.lookup()
+		if err != nil {
+			return err
+		}
+		go b.run(b.resolve.interval, func() {
+			err := b.lookup()
+			if err != nil {
+				log.Warnf("%s: %s", b.name, err)
+			}
+		})
+	}
+
+	if b.health != nil {
+		go b.run(b.health.interval, b.checkAll)
+	}
+
+	return nil
+}
+
+func (b *balancer) stop() {
+	close(b.done)
+}
+
+func (b *balancer) run(interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			fn()
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// lookup updates the endpoints with the addresses of the DNS name.
+func (b *balancer) lookup() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, b.resolve.hostname)
+	if err != nil {
+		return fmt.Errorf("could not resolve %s: %w", b.resolve.hostname, err)
+	}
+	sort.Strings(addrs)
+
+	urls := []string{}
+	for _, addr := range addrs {
+		urls = append(urls, b.resolve.scheme+"://"+net.JoinHostPort(addr, b.resolve.port))
+	}
+	b.setEndpoints(urls, b.resolve.host)
+
+	return nil
+}
+
+// setEndpoints replaces the endpoints, keeping the state of the ones which
+// are still there.
+func (b *balancer) setEndpoints(urls []string, host string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	old := map[string]*endpoint{}
+	for _, ep := range b.endpoints {
+		old[ep.url] = ep
+	}
+
+	endpoints := []*endpoint{}
+	for _, u := range urls {
+		ep, ok := old[u]
+		if ok {
+			delete(old, u)
+		} else {
+			ep = &endpoint{url: u, host: host, healthy: true}
+			httpEndpointAvailable.WithLabelValues(b.name, u).Set(1)
+			if b.endpoints != nil {
+				log.Infof("%s: new target %s", b.name, u)
+			}
+		}
+		endpoints = append(endpoints, ep)
+	}
+
+	for u, ep := range old {
+		ep.removed = true
+		log.Infof("%s: removed target %s", b.name, u)
+		httpEndpointRequests.DeleteLabelValues(b.name, u)
+		httpEndpointFailures.DeleteLabelValues(b.name, u)
+		httpEndpointResponseTime.DeleteLabelValues(b.name, u)
+		httpEndpointInFlight.DeleteLabelValues(b.name, u)
+		httpEndpointAvailable.DeleteLabelValues(b.name, u)
+		httpEndpointEjections.DeleteLabelValues(b.name, u)
+	}
+
+	b.endpoints = endpoints
+
+	b.ring = b.ring[:0]
+	for _, ep := range endpoints {
+		for i := 0; i < hashReplicas; i++ {
+			b.ring = append(b.ring, ringPoint{
+				hash:     xxhash.Sum64String(ep.url + "#" + strconv.Itoa(i)),
+				endpoint: ep,
+			})
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool {
+		return b.ring[i].hash < b.ring[j].hash
+	})
+}
+
+// pick returns the endpoint to send the request to, release must be called
+// once it is sent.
+func (b *balancer) pick(req mirror.Request) (*endpoint, error) {
+	var hash uint64
+	if b.strategy == BalanceHash {
+		k, err := b.hashKey.Eval(req)
+		if err != nil {
+			return nil, fmt.Errorf("could not evaluate hash key: %w", err)
+		}
+		hash = xxhash.Sum64String(fmt.Sprint(k))
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	var ep *endpoint
+	switch b.strategy {
+	case BalanceRoundRobin:
+		for i := range b.endpoints {
+			idx := (b.next + i) % len(b.endpoints)
+			if b.availableLocked(b.endpoints[idx], now) {
+				ep = b.endpoints[idx]
+				b.next = idx + 1
+				break
+			}
+		}
+
+	case BalanceLeastInFlight:
+		// the search starts from a different endpoint each time, so that
+		// ties are spread
+		for i := range b.endpoints {
+			candidate := b.endpoints[(b.next+i)%len(b.endpoints)]
+			if b.availableLocked(candidate, now) && (ep == nil || candidate.inFlight < ep.inFlight) {
+				ep = candidate
+			}
+		}
+		b.next++
+
+	case BalanceHash:
+		// the request goes to the first available endpoint after its hash
+		// on the ring
+		i := sort.Search(len(b.ring), func(i int) bool {
+			return b.ring[i].hash >= hash
+		})
+		for j := 0; j < len(b.ring); j++ {
+			point := b.ring[(i+j)%len(b.ring)]
+			if b.availableLocked(point.endpoint, now) {
+				ep = point.endpoint
+				break
+			}
+		}
+	}
+
+	if ep == nil {
+		return nil, errNoEndpoint
+	}
+
+	ep.inFlight++
+	httpEndpointInFlight.WithLabelValues(b.name, ep.url).Set(float64(ep.inFlight))
+
+	return ep, nil
+}
+
+// release accounts the result of a request sent to the endpoint, the
+// endpoint is ejected after consecutive failures.
+func (b *balancer) release(ep *endpoint, success bool, latency time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// the metrics of a removed endpoint are deleted, they must not be
+	// created again
+	ep.inFlight--
+	if ep.removed {
+		return
+	}
+	httpEndpointInFlight.WithLabelValues(b.name, ep.url).Set(float64(ep.inFlight))
+	httpEndpointRequests.WithLabelValues(b.name, ep.url).Inc()
+	httpEndpointResponseTime.WithLabelValues(b.name, ep.url).Observe(latency.Seconds())
+	if !success {
+		httpEndpointFailures.WithLabelValues(b.name, ep.url).Inc()
+	}
+
+	if success {
+		ep.failures = 0
+		return
+	}
+
+	ep.failures++
+	if b.ejection == nil || ep.failures < b.ejection.failures || !ep.ejectedUntil.IsZero() {
+		return
+	}
+
+	// a part of the endpoints is kept even if they fail, so that a
+	// failure of the whole pool does not leave it without any endpoint
+	now := time.Now()
+	ejected := 0
+	for _, other := range b.endpoints {
+		if !other.ejectedUntil.IsZero() && now.Before(other.ejectedUntil) {
+			ejected++
+		}
+	}
+	if float64(ejected+1) > b.ejection.maxPercent/100*float64(len(b.endpoints)) {
+		return
+	}
+
+	ep.ejectedUntil = now.Add(b.ejection.duration)
+	ep.failures = 0
+	httpEndpointEjections.WithLabelValues(b.name, ep.url).Inc()
+	httpEndpointAvailable.WithLabelValues(b.name, ep.url).Set(0)
+	log.Warnf("%s: target %s ejected for %s after %d failures", b.name, ep.url, b.ejection.duration, b.ejection.failures)
+}
+
+// cancel releases an endpoint the request was not sent to.
+func (b *balancer) cancel(ep *endpoint) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	ep.inFlight--
+	if !ep.removed {
+		httpEndpointInFlight.WithLabelValues(b.name, ep.url).Set(float64(ep.inFlight))
+	}
+}
+
+// availableLocked returns whether the endpoint can receive requests, and
+// ends its ejection once it is over.
+func (b *balancer) availableLocked(ep *endpoint, now time.Time) bool {
+	if !ep.ejectedUntil.IsZero() {
+		if now.Before(ep.ejectedUntil) {
+			return false
+		}
+		ep.ejectedUntil = time.Time{}
+		b.updateAvailableLocked(ep)
+	}
+
+	return ep.healthy
+}
+
+func (b *balancer) updateAvailableLocked(ep *endpoint) {
+	available := 0.0
+	if ep.healthy && ep.ejectedUntil.IsZero() {
+		available = 1
+	}
+	httpEndpointAvailable.WithLabelValues(b.name, ep.url).Set(available)
+}
+
+// checkAll sends a health check to all the endpoints in parallel.
+func (b *balancer) checkAll() {
+	b.lock.Lock()
+	endpoints := b.endpoints
+	b.lock.Unlock()
+
+	results := make([]bool, len(endpoints))
+	wg := sync.WaitGroup{}
+	for i, ep := range endpoints {
+		wg.Add(1)
+		go func(i int, ep *endpoint) {
+			defer wg.Done()
+			results[i] = b.check(ep, b.health.timeout)
+		}(i, ep)
+	}
+	wg.Wait()
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for i, ep := range endpoints {
+		if ep.removed {
+			continue
+		}
+		if results[i] == ep.healthy {
+			ep.checks = 0
+			continue
+		}
+
+		ep.checks++
+		threshold := b.health.unhealthy
+		if results[i] {
+			threshold = b.health.healthy
+		}
+		if ep.checks < threshold {
+			continue
+		}
+
+		ep.healthy = results[i]
+		ep.checks = 0
+		b.updateAvailableLocked(ep)
+		if ep.healthy {
+			log.Infof("%s: target %s is healthy", b.name, ep.url)
+		} else {
+			log.Warnf("%s: target %s is unhealthy", b.name, ep.url)
+		}
+	}
+}
+
+// states returns the state of the endpoints which do not receive requests.
+func (b *balancer) states() map[string]string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	res := map[string]string{}
+	for _, ep := range b.endpoints {
+		switch {
+		case !ep.healthy:
+			res[ep.url] = "unhealthy"
+		case !ep.ejectedUntil.IsZero() && now.Before(ep.ejectedUntil):
+			res[ep.url] = "ejected"
+		}
+	}
+
+	return res
+}
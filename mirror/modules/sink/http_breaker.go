@@ -0,0 +1,289 @@
+package sink
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/log"
+)
+
+const (
+	breakerClosed = iota
+	breakerHalfOpen
+	breakerOpen
+
+	// breakerIdleTimeout is how long a closed breaker is kept without
+	// requests, templated targets would add breakers forever otherwise
+	breakerIdleTimeout = 5 * time.Minute
+)
+
+var (
+	breakerStateNames = []string{"closed", "half-open", "open"}
+
+	httpBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_breaker_state",
+		Help: "The state of the circuit breaker of a target: 0 closed, 1 half-open, 2 open",
+	}, []string{"module", "target"})
+
+	httpBreakerRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_breaker_rejected_total",
+		Help: "The total number of requests not sent because the circuit breaker was open",
+	}, []string{"module", "target"})
+)
+
+// HTTPBreakerConfig stops sending requests to a target after consecutive
+// failures.
+type HTTPBreakerConfig struct {
+	Failures         int    `json:"failures,omitempty"`
+	OpenTimeout      string `json:"open_timeout,omitempty"`
+	HalfOpenRequests int    `json:"half_open_requests,omitempty"`
+}
+
+type breakerConfig struct {
+	failures         int
+	openTimeout      time.Duration
+	halfOpenRequests int
+}
+
+func newBreakerConfig(c *HTTPBreakerConfig) (*breakerConfig, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	bc := &breakerConfig{
+		failures:         5,
+		openTimeout:      10 * time.Second,
+		halfOpenRequests: 1,
+	}
+	if c.Failures < 0 || c.HalfOpenRequests < 0 {
+		return nil, errors.New("circuit_breaker: failures and half_open_requests must be positive")
+	}
+	if c.Failures > 0 {
+		bc.failures = c.Failures
+	}
+	if c.HalfOpenRequests > 0 {
+		bc.halfOpenRequests = c.HalfOpenRequests
+	}
+
+	if c.OpenTimeout != "" {
+		var err error
+		bc.openTimeout, err = time.ParseDuration(c.OpenTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("circuit_breaker.open_timeout: %w", err)
+		}
+	}
+
+	return bc, nil
+}
+
+// breakers holds a circuit breaker by target URL. The closed breakers
+// without requests for idleTimeout are removed.
+type breakers struct {
+	name        string
+	cfg         *breakerConfig
+	idleTimeout time.Duration
+
+	lock      sync.Mutex
+	breakers  map[string]*breaker
+	lastSweep time.Time
+}
+
+func newBreakers(name string, cfg *breakerConfig) *breakers {
+	if cfg == nil {
+		return nil
+	}
+
+	return &breakers{
+		name:        name,
+		cfg:         cfg,
+		idleTimeout: breakerIdleTimeout,
+		breakers:    map[string]*breaker{},
+		lastSweep:   time.Now(),
+	}
+}
+
+// get returns the breaker of the target, nil if there are no breakers.
+func (b *breakers) get(target string) *breaker {
+	if b == nil {
+		return nil
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(b.lastSweep) >= b.idleTimeout {
+		b.sweepLocked(now)
+	}
+
+	br, ok := b.breakers[target]
+	if !ok {
+		br = &breaker{
+			name:   b.name,
+			target: target,
+			cfg:    b.cfg,
+		}
+		httpBreakerState.WithLabelValues(b.name, target).Set(breakerClosed)
+		b.breakers[target] = br
+	}
+	br.lastUsed = now
+
+	return br
+}
+
+// sweepLocked removes the closed breakers idle for idleTimeout, along with
+// their metrics.
+func (b *breakers) sweepLocked(now time.Time) {
+	for target, br := range b.breakers {
+		if br.idle(now.Add(-b.idleTimeout)) {
+			delete(b.breakers, target)
+			httpBreakerState.DeleteLabelValues(b.name, target)
+			httpBreakerRejected.DeleteLabelValues(b.name, target)
+		}
+	}
+	b.lastSweep = now
+}
+
+// states returns the state of the breakers which are not closed.
+func (b *breakers) states() map[string]string {
+	if b == nil {
+		return nil
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	res := map[string]string{}
+	for target, br := range b.breakers {
+		if state := br.getState(); state != breakerClosed {
+			res[target] = breakerStateNames[state]
+		}
+	}
+
+	return res
+}
+
+// breaker opens after cfg.failures consecutive failures, and rejects the
+// requests until cfg.openTimeout. It is then half-open: up to
+// cfg.halfOpenRequests requests are sent, it closes once they all succeed,
+// and opens again on the first failure.
+type breaker struct {
+	name   string
+	target string
+	cfg    *breakerConfig
+
+	lock     sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	probes   int
+	// successes counts the probes which succeeded
+	successes int
+	// generation changes with the state, the requests admitted in another
+	// state are not accounted
+	generation uint64
+	inFlight   int
+	// lastUsed is protected by the lock of the breakers
+	lastUsed time.Time
+}
+
+// allow returns whether a request can be sent, done must then be called
+// with its result and the generation returned.
+func (b *breaker) allow() (uint64, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.state == breakerOpen {
+		if time.Since(b.openedAt) < b.cfg.openTimeout {
+			httpBreakerRejected.WithLabelValues(b.name, b.target).Inc()
+			return 0, false
+		}
+		b.setStateLocked(breakerHalfOpen)
+	}
+
+	if b.state == breakerHalfOpen {
+		if b.probes >= b.cfg.halfOpenRequests {
+			httpBreakerRejected.WithLabelValues(b.name, b.target).Inc()
+			return 0, false
+		}
+		b.probes++
+	}
+
+	b.inFlight++
+	return b.generation, true
+}
+
+func (b *breaker) done(generation uint64, success bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.inFlight--
+	if generation != b.generation {
+		// e.g. a request sent while closed which ends once half-open
+		return
+	}
+
+	switch b.state {
+	case breakerClosed:
+		if success {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.cfg.failures {
+			b.setStateLocked(breakerOpen)
+		}
+
+	case breakerHalfOpen:
+		if !success {
+			b.setStateLocked(breakerOpen)
+			return
+		}
+		b.successes++
+		if b.successes >= b.cfg.halfOpenRequests {
+			b.setStateLocked(breakerClosed)
+		}
+
+	case breakerOpen:
+		// the requests are rejected while open, and the generation of the
+		// others changed when it opened
+	}
+}
+
+// idle returns whether the breaker is closed without requests since the
+// given time.
+func (b *breaker) idle(since time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.state == breakerClosed && b.inFlight == 0 && b.lastUsed.Before(since)
+}
+
+func (b *breaker) getState() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.state
+}
+
+func (b *breaker) setStateLocked(state int) {
+	b.state = state
+	b.generation++
+	b.failures = 0
+	b.probes = 0
+	b.successes = 0
+	if state == breakerOpen {
+		b.openedAt = time.Now()
+	}
+	httpBreakerState.WithLabelValues(b.name, b.target).Set(float64(state))
+
+	if state == breakerOpen {
+		log.Warnf("%s: circuit breaker of %s is open for %s", b.name, b.target, b.cfg.openTimeout)
+	} else {
+		log.Infof("%s: circuit breaker of %s is %s", b.name, b.target, breakerStateNames[state])
+	}
+}
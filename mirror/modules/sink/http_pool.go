@@ -0,0 +1,343 @@
+package sink
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/log"
+)
+
+const (
+	// aimdDecrease is the factor applied to the concurrency limit when the
+	// latency is above the target
+	aimdDecrease = 0.9
+)
+
+var (
+	httpInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_in_flight",
+		Help: "The number of requests being sent by the workers",
+	}, []string{"module"})
+
+	httpWorkers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_workers",
+		Help: "The number of workers sending requests",
+	}, []string{"module"})
+
+	httpConcurrencyLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_concurrency_limit",
+		Help: "The maximum number of workers, adjusted to the latency with adaptive concurrency",
+	}, []string{"module"})
+
+	httpQueueWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_queue_wait_seconds",
+		Help:    "Time spent by the requests waiting for a worker",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+	}, []string{"module"})
+)
+
+type poolConfig struct {
+	min         int
+	max         int
+	idleTimeout time.Duration
+	// targetLatency enables adaptive concurrency: the limit is increased
+	// while the average latency is below the target, and decreased
+	// otherwise
+	targetLatency time.Duration
+	interval      time.Duration
+}
+
+type poolTask struct {
+	req      mirror.Request
+	enqueued time.Time
+}
+
+// workerPool runs between min and limit workers, calling handle for each
+// request. handle returns the latency of the target. Workers are started
+// when no worker is idle, and stop after idleTimeout without requests.
+type workerPool struct {
+	name   string
+	cfg    poolConfig
+	handle func(mirror.Request) time.Duration
+	tasks  chan poolTask
+
+	lock     sync.Mutex
+	limit    int
+	workers  int
+	idle     int
+	inFlight int
+	// ready is signaled when submit may be able to start a worker: a
+	// worker stopped, the limit increased or no worker is idle anymore
+	ready chan struct{}
+	// wake is signaled to wake up a single idle worker when the pool is
+	// over the limit, the worker passes it on if it is still over it
+	wake chan struct{}
+
+	latencySum   time.Duration
+	latencyCount int
+
+	wg   sync.WaitGroup
+	done chan struct{}
+}
+
+func newWorkerPool(name string, cfg poolConfig, handle func(mirror.Request) time.Duration) *workerPool {
+	p := &workerPool{
+		name:   name,
+		cfg:    cfg,
+		handle: handle,
+		tasks:  make(chan poolTask),
+		limit:  cfg.max,
+		ready:  make(chan struct{}, 1),
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	httpConcurrencyLimit.WithLabelValues(name).Set(float64(p.limit))
+
+	return p
+}
+
+// start starts the minimum number of workers, and the adaptive concurrency.
+func (p *workerPool) start() {
+	p.lock.Lock()
+	for p.workers < p.cfg.min {
+		p.startWorkerLocked(nil)
+	}
+	p.lock.Unlock()
+
+	if p.cfg.targetLatency > 0 {
+		go p.adapt()
+	}
+}
+
+// submit blocks until a worker takes the request.
+func (p *workerPool) submit(r mirror.Request) {
+	t := poolTask{req: r, enqueued: time.Now()}
+
+	for {
+		p.lock.Lock()
+		if p.idle == 0 && p.workers < p.limit {
+			p.startWorkerLocked(&t)
+			p.lock.Unlock()
+			return
+		}
+		p.lock.Unlock()
+
+		select {
+		case p.tasks <- t:
+			return
+		case <-p.ready:
+		}
+	}
+}
+
+// close waits for the requests in flight once the last one is submitted.
+func (p *workerPool) close() {
+	close(p.tasks)
+	p.wg.Wait()
+	close(p.done)
+}
+
+// setLimits changes the minimum and maximum number of workers, the limit
+// of the adaptive concurrency starts over from the maximum.
+func (p *workerPool) setLimits(min, max int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.cfg.min = min
+	p.cfg.max = max
+	for p.workers < p.cfg.min {
+		p.startWorkerLocked(nil)
+	}
+	p.setLimitLocked(max)
+}
+
+func (p *workerPool) limits() (int, int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.cfg.min, p.cfg.max
+}
+
+func (p *workerPool) startWorkerLocked(t *poolTask) {
+	p.workers++
+	p.updateLocked()
+	p.wg.Add(1)
+	go p.worker(t)
+	log.Debugf("%s: Increase numWorkers to %d/%d", p.name, p.workers, p.limit)
+}
+
+func (p *workerPool) worker(t *poolTask) {
+	defer p.wg.Done()
+
+	if t != nil {
+		p.run(*t)
+	}
+
+	timeout := time.NewTimer(p.cfg.idleTimeout)
+	defer timeout.Stop()
+
+	for {
+		p.lock.Lock()
+		if p.workers > p.limit {
+			p.stopWorkerLocked("over the limit")
+			p.lock.Unlock()
+			return
+		}
+		p.idle++
+		p.lock.Unlock()
+
+		t, ok := p.next(timeout)
+		if !ok {
+			return
+		}
+
+		p.run(t)
+		// the timer may have fired during the request, a stale tick
+		// would stop the worker right away
+		if !timeout.Stop() {
+			select {
+			case <-timeout.C:
+			default:
+			}
+		}
+		timeout.Reset(p.cfg.idleTimeout)
+	}
+}
+
+// next waits for a request as an idle worker, the worker only stops being
+// idle when it takes a request or stops. It returns false if the worker
+// stopped.
+func (p *workerPool) next(timeout *time.Timer) (poolTask, bool) {
+	for {
+		select {
+		case t, ok := <-p.tasks:
+			p.lock.Lock()
+			defer p.lock.Unlock()
+
+			p.idle--
+			if !ok {
+				p.stopWorkerLocked("closed")
+				return poolTask{}, false
+			}
+			if p.idle == 0 {
+				signal(p.ready)
+			}
+			return t, true
+
+		case <-timeout.C:
+			p.lock.Lock()
+			if p.workers > p.cfg.min {
+				p.idle--
+				p.stopWorkerLocked("idle")
+				p.lock.Unlock()
+				return poolTask{}, false
+			}
+			p.lock.Unlock()
+			timeout.Reset(p.cfg.idleTimeout)
+
+		case <-p.wake:
+			p.lock.Lock()
+			if p.workers > p.limit {
+				p.idle--
+				p.stopWorkerLocked("over the limit")
+				p.lock.Unlock()
+				return poolTask{}, false
+			}
+			p.lock.Unlock()
+		}
+	}
+}
+
+func (p *workerPool) stopWorkerLocked(reason string) {
+	p.workers--
+	p.updateLocked()
+	signal(p.ready)
+	if p.workers > p.limit {
+		signal(p.wake)
+	}
+	log.Debugf("%s: %s, Decrease numWorkers to %d/%d", p.name, reason, p.workers, p.limit)
+}
+
+func (p *workerPool) run(t poolTask) {
+	httpQueueWait.WithLabelValues(p.name).Observe(time.Since(t.enqueued).Seconds())
+
+	p.lock.Lock()
+	p.inFlight++
+	httpInFlight.WithLabelValues(p.name).Set(float64(p.inFlight))
+	p.lock.Unlock()
+
+	latency := p.handle(t.req)
+
+	p.lock.Lock()
+	p.inFlight--
+	httpInFlight.WithLabelValues(p.name).Set(float64(p.inFlight))
+	p.latencySum += latency
+	p.latencyCount++
+	p.lock.Unlock()
+}
+
+// adapt adjusts the limit every interval: additive increase while the
+// average latency is below the target, multiplicative decrease otherwise.
+func (p *workerPool) adapt() {
+	ticker := time.NewTicker(p.cfg.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+
+		p.lock.Lock()
+		if p.latencyCount > 0 {
+			avg := p.latencySum / time.Duration(p.latencyCount)
+			limit := p.limit + 1
+			if avg > p.cfg.targetLatency {
+				limit = int(math.Min(float64(p.limit-1), math.Floor(float64(p.limit)*aimdDecrease)))
+			}
+			p.setLimitLocked(limit)
+		}
+		p.latencySum, p.latencyCount = 0, 0
+		p.lock.Unlock()
+	}
+}
+
+func (p *workerPool) setLimitLocked(limit int) {
+	if limit < p.cfg.min {
+		limit = p.cfg.min
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	if limit > p.cfg.max {
+		limit = p.cfg.max
+	}
+
+	if limit > p.limit {
+		signal(p.ready)
+	}
+	p.limit = limit
+	httpConcurrencyLimit.WithLabelValues(p.name).Set(float64(limit))
+	if p.workers > p.limit {
+		signal(p.wake)
+	}
+}
+
+// updateLocked updates the metrics of the workers.
+func (p *workerPool) updateLocked() {
+	httpWorkers.WithLabelValues(p.name).Set(float64(p.workers))
+}
+
+// signal notifies a single goroutine waiting on c, without blocking if a
+// notification is already pending.
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
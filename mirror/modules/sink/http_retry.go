@@ -0,0 +1,229 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// RetryConnect retries the requests which could not connect
+	RetryConnect = "connect"
+	// RetryReset retries the requests whose connection was closed
+	RetryReset = "reset"
+	// RetryTimeout retries the requests which timed out
+	RetryTimeout = "timeout"
+
+	// retryBudgetWindow is the period over which the retry budget is
+	// computed
+	retryBudgetWindow = 10 * time.Second
+)
+
+var (
+	httpRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_retries_total",
+		Help: "The total number of requests sent again",
+	}, []string{"module"})
+
+	httpRetryBudgetExhausted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_retry_budget_exhausted_total",
+		Help: "The total number of retries not sent because of the retry budget",
+	}, []string{"module"})
+)
+
+// HTTPRetryConfig sends again the requests which failed.
+type HTTPRetryConfig struct {
+	MaxAttempts int      `json:"max_attempts,omitempty"`
+	Statuses    []int    `json:"statuses,omitempty"`
+	Errors      []string `json:"errors,omitempty"`
+	Backoff     string   `json:"backoff,omitempty"`
+	MaxBackoff  string   `json:"max_backoff,omitempty"`
+	Budget      float64  `json:"budget,omitempty"`
+}
+
+type retryConfig struct {
+	maxAttempts int
+	statuses    map[int]bool
+	errors      map[string]bool
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	budget      *retryBudget
+}
+
+func newRetryConfig(c *HTTPRetryConfig) (*retryConfig, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	rc := &retryConfig{
+		maxAttempts: 3,
+		statuses:    map[int]bool{},
+		errors:      map[string]bool{},
+		backoff:     100 * time.Millisecond,
+		maxBackoff:  5 * time.Second,
+	}
+	if c.MaxAttempts < 0 {
+		return nil, errors.New("retry.max_attempts must be positive")
+	}
+	if c.MaxAttempts > 0 {
+		rc.maxAttempts = c.MaxAttempts
+	}
+
+	statuses := c.Statuses
+	if statuses == nil {
+		statuses = []int{502, 503, 504}
+	}
+	for _, s := range statuses {
+		rc.statuses[s] = true
+	}
+
+	errs := c.Errors
+	if errs == nil {
+		errs = []string{RetryConnect, RetryReset}
+	}
+	for _, e := range errs {
+		switch e {
+		case RetryConnect, RetryReset, RetryTimeout:
+			rc.errors[e] = true
+		default:
+			return nil, fmt.Errorf("retry.errors: unknown error %q", e)
+		}
+	}
+
+	var err error
+	if c.Backoff != "" {
+		rc.backoff, err = time.ParseDuration(c.Backoff)
+		if err != nil {
+			return nil, fmt.Errorf("retry.backoff: %w", err)
+		}
+	}
+	if c.MaxBackoff != "" {
+		rc.maxBackoff, err = time.ParseDuration(c.MaxBackoff)
+		if err != nil {
+			return nil, fmt.Errorf("retry.max_backoff: %w", err)
+		}
+	}
+
+	budget := 20.0
+	if c.Budget < 0 {
+		return nil, errors.New("retry.budget must be positive")
+	}
+	if c.Budget > 0 {
+		budget = c.Budget
+	}
+	rc.budget = &retryBudget{ratio: budget / 100}
+
+	return rc, nil
+}
+
+// retryStatus returns whether a response with the status code is retried.
+func (c *retryConfig) retryStatus(status int) bool {
+	return c.statuses[status]
+}
+
+// retryError returns whether a request which failed with err is retried.
+func (c *retryConfig) retryError(err error) bool {
+	return c.errors[errorKind(err)]
+}
+
+// wait returns the time to wait before the attempt, with exponential
+// backoff and full jitter.
+func (c *retryConfig) wait(attempt int) time.Duration {
+	d := c.backoff
+	for i := 2; i < attempt && d < c.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > c.maxBackoff {
+		d = c.maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// errorKind classifies the errors of the HTTP client, it returns an empty
+// string if the error is not known.
+func errorKind(err error) string {
+	if errors.Is(err, errTargetNotAllowed) {
+		return ""
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return RetryConnect
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return RetryTimeout
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return RetryReset
+	}
+
+	return ""
+}
+
+// retryBudget limits the retries to a ratio of the requests, over the
+// current and the previous window.
+type retryBudget struct {
+	ratio float64
+
+	lock        sync.Mutex
+	windowStart time.Time
+	requests    [2]int
+	retries     [2]int
+}
+
+// request accounts a new request.
+func (b *retryBudget) request() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.rotateLocked()
+	b.requests[1]++
+}
+
+// withdraw returns whether a retry can be sent, and accounts it.
+func (b *retryBudget) withdraw() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.rotateLocked()
+	requests := b.requests[0] + b.requests[1]
+	retries := b.retries[0] + b.retries[1]
+	if float64(retries) >= b.ratio*float64(requests) {
+		return false
+	}
+
+	b.retries[1]++
+	return true
+}
+
+func (b *retryBudget) rotateLocked() {
+	now := time.Now()
+	switch elapsed := now.Sub(b.windowStart); {
+	case elapsed < retryBudgetWindow:
+		return
+	case elapsed < 2*retryBudgetWindow:
+		b.requests = [2]int{b.requests[1], 0}
+		b.retries = [2]int{b.retries[1], 0}
+	default:
+		b.requests = [2]int{}
+		b.retries = [2]int{}
+	}
+	b.windowStart = now
+}
@@ -0,0 +1,387 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/prometheus/common/log"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// httpTarget sends requests to the target of an HTTPConfig and reads back
+// the response. It holds what is shared by the modules sending HTTP requests.
+// The errors are reported to the context of the module.
+type httpTarget struct {
+	ctx      *mirror.ModuleContext
+	name     string
+	cfg      HTTPConfig
+	clients  *httpClients
+	retry    *retryConfig
+	breakers *breakers
+	balancer *balancer
+	allow    *allowlist
+}
+
+func newHTTPTarget(ctx *mirror.ModuleContext, name string, c HTTPConfig) (*httpTarget, error) {
+	n := 0
+	for _, set := range []bool{c.TargetURL != nil, c.Targets != nil, c.Resolve != nil} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return nil, errors.New("one of target_url, targets or resolve is required")
+	}
+
+	b, err := newBalancer(name, c)
+	if err != nil {
+		return nil, err
+	}
+
+	// the resolved endpoints are addresses, their certificate is checked
+	// against the DNS name
+	if b != nil && b.resolve != nil {
+		tlsConfig := HTTPTLSConfig{}
+		if c.TLS != nil {
+			tlsConfig = *c.TLS
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = b.resolve.hostname
+		}
+		c.TLS = &tlsConfig
+	}
+
+	timeout, err := time.ParseDuration(c.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("timeout: %w", err)
+	}
+
+	// the templated targets come from the requests, they are restricted
+	// to the allowed ones
+	var allow *allowlist
+	if c.TargetURL != nil && !c.TargetURL.Static() {
+		allow, err = newAllowlist(name, c.Allow)
+		if err != nil {
+			return nil, err
+		}
+	} else if c.Allow != nil {
+		return nil, errors.New("allow is only used with a templated target_url")
+	}
+
+	clients, err := newHTTPClients(c, timeout, allow)
+	if err != nil {
+		return nil, err
+	}
+
+	retry, err := newRetryConfig(c.Retry)
+	if err != nil {
+		return nil, err
+	}
+
+	bc, err := newBreakerConfig(c.CircuitBreaker)
+	if err != nil {
+		return nil, err
+	}
+
+	return &httpTarget{
+		ctx:      ctx,
+		name:     name,
+		cfg:      c,
+		clients:  clients,
+		retry:    retry,
+		breakers: newBreakers(name, bc),
+		balancer: b,
+		allow:    allow,
+	}, nil
+}
+
+// start loads the TLS certificates and starts the balancer, it must be
+// called before sending requests.
+func (t *httpTarget) start() error {
+	err := t.clients.load()
+	if err != nil {
+		return err
+	}
+
+	if t.balancer != nil {
+		return t.balancer.start(t.check)
+	}
+	return nil
+}
+
+// stop stops the background work of the balancer, once the requests are
+// sent.
+func (t *httpTarget) stop() {
+	if t.balancer != nil {
+		t.balancer.stop()
+	}
+}
+
+// error reports an error to the module. With the restart policy, the
+// connections are closed and opened again by the next requests.
+func (t *httpTarget) error(err error) {
+	if t.ctx.Error(err) == mirror.ErrorPolicyRestart {
+		t.clients.closeIdleConnections()
+	}
+}
+
+// target is where an attempt of a request is sent.
+type target struct {
+	baseURL string
+	url     string
+	// host overrides the Host header, for the resolved endpoints
+	host     string
+	endpoint *endpoint
+	breaker  *breaker
+	// generation is the state of the breaker when the attempt was allowed
+	generation uint64
+}
+
+func (t *httpTarget) do(req mirror.Request) *mirror.Response {
+	tg, errRes := t.prepare(req)
+	if errRes != nil {
+		return errRes
+	}
+	if t.retry != nil {
+		t.retry.budget.request()
+	}
+
+	for attempt := 1; ; attempt++ {
+		res, latency, err := t.send(req, tg)
+		t.done(tg, err == nil && res.StatusCode < 500, latency)
+
+		// with several endpoints, the retry may go to another one
+		var next *target
+		if t.retryable(res, err, attempt) {
+			time.Sleep(t.retry.wait(attempt + 1))
+			next, _ = t.prepare(req)
+		}
+
+		if next == nil {
+			if err != nil {
+				// the rejected targets are logged by the allowlist
+				if !errors.Is(err, errTargetNotAllowed) {
+					t.error(fmt.Errorf("%s: %w", tg.url, err))
+				}
+				return &mirror.Response{
+					Latency: durationpb.New(latency),
+					Error:   err.Error(),
+				}
+			}
+
+			defer res.Body.Close()
+			return t.readResponse(res, latency)
+		}
+
+		if res != nil {
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+
+		httpRetries.WithLabelValues(t.name).Inc()
+		tg = next
+	}
+}
+
+// prepare chooses the target of an attempt. It returns the response to
+// give instead when the request cannot be sent.
+func (t *httpTarget) prepare(req mirror.Request) (*target, *mirror.Response) {
+	tg := &target{}
+	if t.balancer != nil {
+		ep, err := t.balancer.pick(req)
+		if err != nil {
+			return nil, &mirror.Response{Error: err.Error()}
+		}
+		tg.baseURL = ep.url
+		tg.host = ep.host
+		tg.endpoint = ep
+	} else {
+		baseURL, err := t.cfg.TargetURL.Eval(req)
+		if err != nil {
+			t.error(fmt.Errorf("could not evaluate target URL: %w", err))
+			return nil, &mirror.Response{Error: fmt.Sprintf("could not evaluate target URL: %s", err)}
+		}
+		if t.allow != nil {
+			err = t.allow.checkURL(baseURL)
+			if err != nil {
+				return nil, &mirror.Response{Error: err.Error()}
+			}
+		}
+		tg.baseURL = baseURL
+	}
+
+	tg.url = tg.baseURL + req.Path
+	if req.Query != "" {
+		tg.url += "?" + req.Query
+	}
+
+	tg.breaker = t.breakers.get(tg.baseURL)
+	if tg.breaker != nil {
+		generation, ok := tg.breaker.allow()
+		if !ok {
+			if tg.endpoint != nil {
+				t.balancer.cancel(tg.endpoint)
+			}
+			return nil, &mirror.Response{Error: fmt.Sprintf("circuit breaker of %s is open", tg.baseURL)}
+		}
+		tg.generation = generation
+	}
+
+	return tg, nil
+}
+
+// done accounts the result of an attempt.
+func (t *httpTarget) done(tg *target, success bool, latency time.Duration) {
+	if tg.breaker != nil {
+		tg.breaker.done(tg.generation, success)
+	}
+	if tg.endpoint != nil {
+		t.balancer.release(tg.endpoint, success, latency)
+	}
+}
+
+// retryable returns whether the request is sent again: the status or the
+// error of the attempt is retried, and the number of attempts and the retry
+// budget allow it.
+func (t *httpTarget) retryable(res *http.Response, err error, attempt int) bool {
+	if t.retry == nil || attempt >= t.retry.maxAttempts {
+		return false
+	}
+	if err != nil && !t.retry.retryError(err) || err == nil && !t.retry.retryStatus(res.StatusCode) {
+		return false
+	}
+
+	if !t.retry.budget.withdraw() {
+		httpRetryBudgetExhausted.WithLabelValues(t.name).Inc()
+		return false
+	}
+
+	return true
+}
+
+// check sends a health check to the endpoint, it returns whether it
+// succeeded.
+func (t *httpTarget) check(ep *endpoint, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	url := ep.url + t.balancer.health.path
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false
+	}
+	if ep.host != "" {
+		hreq.Host = ep.host
+	}
+
+	res, err := t.clients.get(mirror.Request{}, url).Do(hreq)
+	if err != nil {
+		log.Debugf("%s: health check of %s: %s", t.name, ep.url, err)
+		return false
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+
+	return res.StatusCode >= 200 && res.StatusCode < 400
+}
+
+// state adds the circuit breakers which are not closed and the endpoints
+// which do not receive requests to res.
+func (t *httpTarget) state(res map[string]string) {
+	for target, state := range t.breakers.states() {
+		res["breaker "+target] = state
+	}
+	if t.balancer != nil {
+		for endpoint, state := range t.balancer.states() {
+			res["target "+endpoint] = state
+		}
+	}
+}
+
+// send sends the request once, the body of the response must be closed.
+func (t *httpTarget) send(req mirror.Request, tg *target) (*http.Response, time.Duration, error) {
+	headers := http.Header{}
+	for name, vals := range req.Headers {
+		headers[name] = vals.Values
+	}
+
+	if t.cfg.RequestIDHeader != "" && req.Id != "" {
+		headers.Set(t.cfg.RequestIDHeader, req.Id)
+	}
+
+	hreq, err := http.NewRequest(
+		req.Method.String(),
+		tg.url,
+		ioutil.NopCloser(bytes.NewBuffer(req.Body)),
+	)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not create request: %w", err)
+	}
+	hreq.Header = headers
+	if t.cfg.PreserveHost {
+		hreq.Host = req.Authority
+	} else if tg.host != "" {
+		hreq.Host = tg.host
+	}
+
+	start := time.Now()
+	res, err := t.clients.get(req, tg.url).Do(hreq)
+	latency := time.Since(start)
+	if err != nil {
+		return nil, latency, err
+	}
+
+	httpResponseTime.WithLabelValues(t.name).Observe(latency.Seconds())
+	httpResponseTotal.WithLabelValues(t.name, strconv.Itoa(res.StatusCode)).Inc()
+
+	return res, latency, nil
+}
+
+func (t *httpTarget) readResponse(res *http.Response, latency time.Duration) *mirror.Response {
+	mres := &mirror.Response{
+		StatusCode: int32(res.StatusCode),
+		Latency:    durationpb.New(latency),
+	}
+
+	for _, name := range t.cfg.ResponseHeaders {
+		name = http.CanonicalHeaderKey(name)
+		if vals, ok := res.Header[name]; ok {
+			if mres.Headers == nil {
+				mres.Headers = map[string]*mirror.HeaderValue{}
+			}
+			mres.Headers[name] = &mirror.HeaderValue{Values: vals}
+		}
+	}
+
+	hash := sha256.New()
+	w := io.Writer(hash)
+
+	var body *bytes.Buffer
+	if t.cfg.ResponseBody {
+		body = &bytes.Buffer{}
+		w = io.MultiWriter(hash, body)
+	}
+
+	n, err := io.Copy(w, res.Body)
+	if err != nil {
+		mres.Error = fmt.Sprintf("could not read body: %s", err)
+	}
+
+	mres.BodySize = n
+	mres.BodyHash = hex.EncodeToString(hash.Sum(nil))
+	if body != nil {
+		mres.Body = body.Bytes()
+	}
+
+	return mres
+}
@@ -0,0 +1,257 @@
+package sink
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"golang.org/x/net/http2"
+)
+
+const (
+	// ProtocolAuto uses HTTP/2 when the target negotiates it with TLS, and
+	// HTTP/1.1 otherwise
+	ProtocolAuto = "auto"
+	// ProtocolHTTP1 always uses HTTP/1.1
+	ProtocolHTTP1 = "http1"
+	// ProtocolH2 uses HTTP/2 over TLS
+	ProtocolH2 = "h2"
+	// ProtocolH2C uses HTTP/2 without TLS, with prior knowledge
+	ProtocolH2C = "h2c"
+	// ProtocolMatch uses the version of the recorded request: HTTP/2 over
+	// TLS or h2c depending on the target URL, or HTTP/1.1
+	ProtocolMatch = "match"
+)
+
+// HTTPTLSConfig configures the certificates used with HTTPS targets.
+type HTTPTLSConfig struct {
+	CAFile     string `json:"ca_file,omitempty"`
+	CertFile   string `json:"cert_file,omitempty"`
+	KeyFile    string `json:"key_file,omitempty"`
+	Insecure   bool   `json:"insecure,omitempty"`
+	ServerName string `json:"server_name,omitempty"`
+}
+
+// HTTPTransportConfig tunes the connections to the target.
+type HTTPTransportConfig struct {
+	KeepAlive           string `json:"keep_alive,omitempty"`
+	DisableKeepAlives   bool   `json:"disable_keep_alives,omitempty"`
+	MaxIdleConns        int    `json:"max_idle_conns,omitempty"`
+	MaxIdleConnsPerHost int    `json:"max_idle_conns_per_host,omitempty"`
+	MaxConnsPerHost     int    `json:"max_conns_per_host,omitempty"`
+	IdleConnTimeout     string `json:"idle_conn_timeout,omitempty"`
+}
+
+// httpClients holds a client by protocol. The TLS certificates are only
+// loaded by load, the clients must not be used before.
+type httpClients struct {
+	protocol string
+	tls      *tls.Config
+	tlsFiles *HTTPTLSConfig
+	clients  map[string]*http.Client
+}
+
+// newHTTPClients returns the clients of the config. The addresses dialed
+// are checked by allow if it is not nil.
+func newHTTPClients(c HTTPConfig, timeout time.Duration, allow *allowlist) (*httpClients, error) {
+	protocol := c.Protocol
+	switch protocol {
+	case "":
+		protocol = ProtocolAuto
+	case ProtocolAuto, ProtocolHTTP1, ProtocolH2, ProtocolH2C, ProtocolMatch:
+	default:
+		return nil, fmt.Errorf("unknown protocol %q", c.Protocol)
+	}
+
+	tc := &tls.Config{}
+	if c.TLS != nil {
+		if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+			return nil, errors.New("tls: cert_file and key_file must be set together")
+		}
+		tc.InsecureSkipVerify = c.TLS.Insecure
+		tc.ServerName = c.TLS.ServerName
+	}
+
+	tr := HTTPTransportConfig{}
+	if c.Transport != nil {
+		tr = *c.Transport
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if allow != nil {
+		dialer.Control = allow.control
+	}
+	var err error
+	if tr.KeepAlive != "" {
+		dialer.KeepAlive, err = time.ParseDuration(tr.KeepAlive)
+		if err != nil {
+			return nil, fmt.Errorf("transport.keep_alive: %w", err)
+		}
+	}
+
+	idleConnTimeout := 90 * time.Second
+	if tr.IdleConnTimeout != "" {
+		idleConnTimeout, err = time.ParseDuration(tr.IdleConnTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("transport.idle_conn_timeout: %w", err)
+		}
+	}
+
+	newTransport := func(h2 bool) *http.Transport {
+		t := &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			TLSClientConfig:       tc,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: time.Second,
+			DisableKeepAlives:     tr.DisableKeepAlives,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   tr.MaxIdleConnsPerHost,
+			MaxConnsPerHost:       tr.MaxConnsPerHost,
+			IdleConnTimeout:       idleConnTimeout,
+			ForceAttemptHTTP2:     h2,
+		}
+		if tr.MaxIdleConns > 0 {
+			t.MaxIdleConns = tr.MaxIdleConns
+		}
+		if allow != nil {
+			// the allowlist checks the addresses dialed, a proxy would
+			// connect to the target in its place
+			t.Proxy = nil
+		}
+		if !h2 {
+			// a non-nil empty map disables HTTP/2
+			t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		}
+		return t
+	}
+
+	transports := map[string]http.RoundTripper{}
+	switch protocol {
+	case ProtocolAuto:
+		transports[ProtocolAuto] = newTransport(true)
+	case ProtocolHTTP1:
+		transports[ProtocolHTTP1] = newTransport(false)
+	case ProtocolH2:
+		transports[ProtocolH2] = newH2Transport(tc, dialer, idleConnTimeout, false)
+	case ProtocolH2C:
+		transports[ProtocolH2C] = newH2Transport(tc, dialer, idleConnTimeout, true)
+	case ProtocolMatch:
+		transports[ProtocolHTTP1] = newTransport(false)
+		transports[ProtocolH2] = newH2Transport(tc, dialer, idleConnTimeout, false)
+		transports[ProtocolH2C] = newH2Transport(tc, dialer, idleConnTimeout, true)
+	}
+
+	clients := map[string]*http.Client{}
+	for p, t := range transports {
+		client := &http.Client{
+			Transport: t,
+			Timeout:   timeout,
+		}
+		if !c.FollowRedirects {
+			client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			}
+		} else if allow != nil {
+			client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+				if len(via) >= 10 {
+					return errors.New("stopped after 10 redirects")
+				}
+				return allow.checkURL(req.URL.Scheme + "://" + req.URL.Host)
+			}
+		}
+		clients[p] = client
+	}
+
+	return &httpClients{
+		protocol: protocol,
+		tls:      tc,
+		tlsFiles: c.TLS,
+		clients:  clients,
+	}, nil
+}
+
+func newH2Transport(tc *tls.Config, dialer *net.Dialer, idleConnTimeout time.Duration, cleartext bool) *http2.Transport {
+	t := &http2.Transport{
+		TLSClientConfig: tc,
+		IdleConnTimeout: idleConnTimeout,
+	}
+
+	if cleartext {
+		t.AllowHTTP = true
+		t.DialTLSContext = func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+	} else {
+		t.DialTLSContext = func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			d := &tls.Dialer{NetDialer: dialer, Config: cfg}
+			return d.DialContext(ctx, network, addr)
+		}
+	}
+
+	return t
+}
+
+// load reads the CA and the client certificate.
+func (c *httpClients) load() error {
+	if c.tlsFiles == nil {
+		return nil
+	}
+
+	if c.tlsFiles.CAFile != "" {
+		b, err := os.ReadFile(c.tlsFiles.CAFile)
+		if err != nil {
+			return fmt.Errorf("tls.ca_file: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return fmt.Errorf("tls.ca_file: no certificate found in %s", c.tlsFiles.CAFile)
+		}
+		c.tls.RootCAs = pool
+	}
+
+	if c.tlsFiles.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.tlsFiles.CertFile, c.tlsFiles.KeyFile)
+		if err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
+		c.tls.Certificates = []tls.Certificate{cert}
+	}
+
+	return nil
+}
+
+// closeIdleConnections closes the connections of all the clients which are
+// not in use.
+func (c *httpClients) closeIdleConnections() {
+	for _, client := range c.clients {
+		client.CloseIdleConnections()
+	}
+}
+
+// get returns the client to send the request to the URL with.
+func (c *httpClients) get(req mirror.Request, url string) *http.Client {
+	if c.protocol != ProtocolMatch {
+		return c.clients[c.protocol]
+	}
+
+	if req.HttpVersion != mirror.HTTPVersion_HTTP2 {
+		return c.clients[ProtocolHTTP1]
+	}
+	if strings.HasPrefix(url, "https://") {
+		return c.clients[ProtocolH2]
+	}
+	return c.clients[ProtocolH2C]
+}
@@ -0,0 +1,177 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/criteo/traffic-mirroring/mirror/codec"
+	"github.com/criteo/traffic-mirroring/mirror/expr"
+	"github.com/criteo/traffic-mirroring/mirror/registry"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+const (
+	KafkaName = "sink.kafka"
+)
+
+var (
+	kafkaProducedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_produced_total",
+		Help: "The total number of records produced by result",
+	}, []string{"module", "result"})
+)
+
+func init() {
+	registry.Register(KafkaName, NewKafka)
+}
+
+type KafkaConfig struct {
+	Brokers []string         `json:"brokers"`
+	Topic   string           `json:"topic"`
+	Format  string           `json:"format,omitempty"`
+	Key     *expr.StringExpr `json:"key,omitempty"`
+}
+
+type Kafka struct {
+	ctx *mirror.ModuleContext
+	cfg KafkaConfig
+	out chan mirror.Request
+
+	// client is only set once started
+	lock   sync.Mutex
+	client *kgo.Client
+}
+
+func NewKafka(ctx *mirror.ModuleContext, cfg []byte) (mirror.Module, error) {
+	c := KafkaConfig{}
+	err := json.Unmarshal(cfg, &c)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.Brokers) == 0 {
+		return nil, errors.New("brokers are required")
+	}
+
+	if c.Topic == "" {
+		return nil, errors.New("topic is required")
+	}
+
+	if c.Format == "" {
+		c.Format = codec.FormatProto
+	}
+
+	err = codec.CheckFormat(c.Format, false)
+	if err != nil {
+		return nil, err
+	}
+
+	mod := &Kafka{
+		ctx: ctx,
+		cfg: c,
+		out: make(chan mirror.Request),
+	}
+
+	return mod, nil
+}
+
+func (m *Kafka) Context() *mirror.ModuleContext {
+	return m.ctx
+}
+
+func (m *Kafka) Children() [][]mirror.Module {
+	return nil
+}
+
+func (m *Kafka) Start() error {
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(m.cfg.Brokers...),
+		kgo.DefaultProduceTopic(m.cfg.Topic),
+	)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	m.client = client
+	m.lock.Unlock()
+
+	return nil
+}
+
+func (m *Kafka) startedClient() *kgo.Client {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.client
+}
+
+func (m *Kafka) Stop() {}
+
+func (m *Kafka) Output() <-chan mirror.Request {
+	return m.out
+}
+
+func (m *Kafka) SetInput(c <-chan mirror.Request) {
+	go func() {
+		for r := range c {
+			m.ctx.HandledRequest()
+
+			client := m.startedClient()
+			if client == nil {
+				kafkaProducedTotal.WithLabelValues(m.ctx.Name, "error").Inc()
+				m.ctx.Error(errors.New("not started"))
+				continue
+			}
+
+			rec, err := m.record(r)
+			if err != nil {
+				kafkaProducedTotal.WithLabelValues(m.ctx.Name, "error").Inc()
+				m.ctx.Error(err)
+				continue
+			}
+
+			client.Produce(context.Background(), rec, func(_ *kgo.Record, err error) {
+				if err != nil {
+					kafkaProducedTotal.WithLabelValues(m.ctx.Name, "error").Inc()
+					m.ctx.Error(err)
+					return
+				}
+				kafkaProducedTotal.WithLabelValues(m.ctx.Name, "success").Inc()
+			})
+		}
+
+		// Flush only returns once the callbacks of all records are done
+		if client := m.startedClient(); client != nil {
+			err := client.Flush(context.Background())
+			if err != nil {
+				m.ctx.Error(err)
+			}
+			client.Close()
+		}
+		close(m.out)
+	}()
+}
+
+func (m *Kafka) record(r mirror.Request) (*kgo.Record, error) {
+	value, err := codec.Marshal(m.cfg.Format, r)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &kgo.Record{Value: value}
+
+	if m.cfg.Key != nil {
+		key, err := m.cfg.Key.Eval(r)
+		if err != nil {
+			return nil, err
+		}
+		rec.Key = []byte(key)
+	}
+
+	return rec, nil
+}
@@ -0,0 +1,24 @@
+package sink
+
+import (
+	"testing"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKafkaNotStarted(t *testing.T) {
+	ctx := &mirror.ModuleContext{}
+	mod, err := NewKafka(ctx, []byte(`{"brokers": ["localhost:9092"], "topic": "requests"}`))
+	require.NoError(t, err)
+
+	in := make(chan mirror.Request, 1)
+	in <- mirror.Request{}
+	mod.SetInput(in)
+	close(in)
+
+	// the request is reported instead of produced with a nil client
+	_, ok := <-mod.Output()
+	require.False(t, ok)
+	require.Equal(t, uint64(1), ctx.Errors())
+}
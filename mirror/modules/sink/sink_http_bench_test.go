@@ -24,6 +24,13 @@ func BenchmarkHTTP(b *testing.B) {
 	in := make(chan mirror.Request)
 	mod.SetInput(in)
 
+	done := make(chan struct{})
+	go func() {
+		for range mod.Output() {
+		}
+		close(done)
+	}()
+
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
@@ -39,5 +46,5 @@ func BenchmarkHTTP(b *testing.B) {
 
 	close(in)
 
-	<-mod.Output()
+	<-done
 }
@@ -1,12 +1,32 @@
 package sink
 
 import (
-	"github.com/criteo/traffic-mirroring/mirror"
-	"github.com/stretchr/testify/assert"
-	"github.com/stretchr/testify/require"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/criteo/traffic-mirroring/mirror/expr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func TestHTTP(t *testing.T) {
@@ -34,7 +54,8 @@ func TestHTTP(t *testing.T) {
 	mod.SetInput(in)
 	close(in)
 
-	<-mod.Output()
+	for range mod.Output() {
+	}
 
 	require.Equal(t, 1, reqCount)
 }
@@ -55,7 +76,11 @@ func TestHTTP_dynamic_target(t *testing.T) {
 		reqCount2++
 	}))
 
-	mod, err := NewHTTP(&mirror.ModuleContext{}, []byte(`{"target_url": "{req.meta.target.string}", "timeout": "10s"}`))
+	mod, err := NewHTTP(&mirror.ModuleContext{}, []byte(`{
+		"target_url": "{req.meta.target.string}",
+		"timeout": "10s",
+		"allow": {"cidrs": ["127.0.0.0/8"]}
+	}`))
 	require.NoError(t, err)
 
 	in := make(chan mirror.Request, 2)
@@ -85,8 +110,979 @@ func TestHTTP_dynamic_target(t *testing.T) {
 	mod.SetInput(in)
 	close(in)
 
-	<-mod.Output()
+	for range mod.Output() {
+	}
 	require.Equal(t, 1, reqCount1)
 	require.Equal(t, 1, reqCount2)
 
 }
+
+func TestHTTP_response(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.Header().Set("X-Ignored", "value")
+		rw.WriteHeader(http.StatusTeapot)
+		rw.Write([]byte("hello"))
+	}))
+
+	mod, err := NewHTTP(&mirror.ModuleContext{}, []byte(`{
+		"target_url": "`+server.URL+`",
+		"timeout": "10s",
+		"response_headers": ["content-type"],
+		"response_body": true
+	}`))
+	require.NoError(t, err)
+
+	in := make(chan mirror.Request, 1)
+	in <- mirror.Request{
+		Method: mirror.Method_GET,
+		Path:   "/index.html",
+	}
+
+	mod.SetInput(in)
+	close(in)
+
+	out := []mirror.Request{}
+	for r := range mod.Output() {
+		out = append(out, r)
+	}
+
+	require.Len(t, out, 1)
+	require.Equal(t, "/index.html", out[0].Path)
+
+	res := out[0].Response
+	require.NotNil(t, res)
+	require.Equal(t, int32(http.StatusTeapot), res.StatusCode)
+	require.Equal(t, map[string]*mirror.HeaderValue{
+		"Content-Type": {Values: []string{"text/plain"}},
+	}, res.Headers)
+	require.Equal(t, int64(5), res.BodySize)
+	require.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", res.BodyHash)
+	require.Equal(t, []byte("hello"), res.Body)
+	require.Empty(t, res.Error)
+	require.NotNil(t, res.Latency)
+}
+
+func TestHTTP_error(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	server.Close()
+
+	mod, err := NewHTTP(&mirror.ModuleContext{}, []byte(`{"target_url": "`+server.URL+`", "timeout": "10s"}`))
+	require.NoError(t, err)
+
+	in := make(chan mirror.Request, 1)
+	in <- mirror.Request{Path: "/index.html"}
+
+	mod.SetInput(in)
+	close(in)
+
+	out := []mirror.Request{}
+	for r := range mod.Output() {
+		out = append(out, r)
+	}
+
+	require.Len(t, out, 1)
+	require.NotNil(t, out[0].Response)
+	require.Equal(t, int32(0), out[0].Response.StatusCode)
+	require.NotEmpty(t, out[0].Response.Error)
+}
+
+func TestHTTP_url(t *testing.T) {
+	reqCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/search", r.URL.Path)
+		assert.Equal(t, "q=mirror&page=2", r.URL.RawQuery)
+		assert.Equal(t, "www.example.com", r.Host)
+		assert.Equal(t, "42", r.Header.Get("X-Request-Id"))
+		reqCount++
+	}))
+
+	mod, err := NewHTTP(&mirror.ModuleContext{}, []byte(`{
+		"target_url": "`+server.URL+`",
+		"timeout": "10s",
+		"preserve_host": true,
+		"request_id_header": "X-Request-Id"
+	}`))
+	require.NoError(t, err)
+
+	in := make(chan mirror.Request, 1)
+	in <- mirror.Request{
+		Id:        "42",
+		Method:    mirror.Method_GET,
+		Authority: "www.example.com",
+		Path:      "/search",
+		Query:     "q=mirror&page=2",
+	}
+
+	mod.SetInput(in)
+	close(in)
+
+	for range mod.Output() {
+	}
+
+	require.Equal(t, 1, reqCount)
+}
+
+func TestHTTP_pool(t *testing.T) {
+	current, max := int32(0), int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&current, 1)
+		defer atomic.AddInt32(&current, -1)
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	name := t.Name()
+	mod, err := NewHTTP(&mirror.ModuleContext{Name: name}, []byte(`{
+		"target_url": "`+server.URL+`",
+		"timeout": "10s",
+		"parallel": 4,
+		"min_parallel": 1,
+		"idle_timeout": "10ms"
+	}`))
+	require.NoError(t, err)
+
+	in := make(chan mirror.Request)
+	mod.SetInput(in)
+	go func() {
+		for range mod.Output() {
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		in <- mirror.Request{Path: "/"}
+	}
+	require.Equal(t, int32(4), atomic.LoadInt32(&max))
+
+	// idle workers stop, down to the minimum
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(httpWorkers.WithLabelValues(name)) == 1
+	}, time.Second, time.Millisecond)
+	require.Equal(t, float64(0), testutil.ToFloat64(httpInFlight.WithLabelValues(name)))
+
+	close(in)
+}
+
+func TestHTTP_adaptive(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	name := t.Name()
+	mod, err := NewHTTP(&mirror.ModuleContext{Name: name}, []byte(`{
+		"target_url": "`+server.URL+`",
+		"timeout": "10s",
+		"parallel": 8,
+		"adaptive": {"target_latency": "1ms", "interval": "10ms"}
+	}`))
+	require.NoError(t, err)
+
+	in := make(chan mirror.Request)
+	mod.SetInput(in)
+	done := make(chan struct{})
+	go func() {
+		for range mod.Output() {
+		}
+		close(done)
+	}()
+
+	// the latency is always above the target
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case in <- mirror.Request{Path: "/"}:
+			case <-stop:
+				close(in)
+				return
+			}
+		}
+	}()
+
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(httpConcurrencyLimit.WithLabelValues(name)) == 1
+	}, 5*time.Second, time.Millisecond)
+	close(stop)
+	<-done
+}
+
+func TestHTTP_params(t *testing.T) {
+	mod, err := NewHTTP(&mirror.ModuleContext{Name: t.Name()}, []byte(`{"target_url": "http://127.0.0.1", "timeout": "1s"}`))
+	require.NoError(t, err)
+	tunable := mod.(mirror.Tunable)
+
+	require.NoError(t, tunable.SetParams([]byte(`{"parallel": 20}`)))
+	require.Equal(t, map[string]interface{}{"parallel": 20, "min_parallel": 0}, tunable.Params())
+	require.Error(t, tunable.SetParams([]byte(`{"parallel": 2, "min_parallel": 3}`)))
+	require.Error(t, tunable.SetParams([]byte(`{"parallel": 0}`)))
+}
+
+// writePEM writes the PEM block to a file of the test directory and returns
+// its path.
+func writePEM(t *testing.T, name, typ string, b []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), 0o600))
+	return path
+}
+
+// newClientCert returns a self-signed client certificate, and the paths of
+// the certificate and the key files.
+func newClientCert(t *testing.T) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mirror"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return cert, writePEM(t, "client.crt", "CERTIFICATE", der), writePEM(t, "client.key", "EC PRIVATE KEY", keyDer)
+}
+
+// sendOne sends the request with a new module and returns the response.
+func sendOne(t *testing.T, cfg string, req mirror.Request) *mirror.Response {
+	mod, err := NewHTTP(&mirror.ModuleContext{Name: t.Name()}, []byte(cfg))
+	require.NoError(t, err)
+	require.NoError(t, mod.Start())
+
+	in := make(chan mirror.Request, 1)
+	in <- req
+	mod.SetInput(in)
+	close(in)
+
+	out := []mirror.Request{}
+	for r := range mod.Output() {
+		out = append(out, r)
+	}
+	require.Len(t, out, 1)
+
+	return out[0].Response
+}
+
+func TestHTTP_tls(t *testing.T) {
+	clientCert, certFile, keyFile := newClientCert(t)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		assert.Len(t, r.TLS.PeerCertificates, 1)
+		assert.Equal(t, "mirror", r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := writePEM(t, "ca.crt", "CERTIFICATE", server.Certificate().Raw)
+
+	// the httptest certificate is valid for example.com
+	res := sendOne(t, `{
+		"target_url": "`+server.URL+`",
+		"timeout": "10s",
+		"tls": {
+			"ca_file": "`+caFile+`",
+			"cert_file": "`+certFile+`",
+			"key_file": "`+keyFile+`",
+			"server_name": "example.com"
+		}
+	}`, mirror.Request{Path: "/"})
+	require.Empty(t, res.Error)
+	require.Equal(t, int32(http.StatusOK), res.StatusCode)
+
+	// without client certificate
+	res = sendOne(t, `{
+		"target_url": "`+server.URL+`",
+		"timeout": "10s",
+		"tls": {"insecure": true}
+	}`, mirror.Request{Path: "/"})
+	require.NotEmpty(t, res.Error)
+
+	// unknown CA
+	res = sendOne(t, `{
+		"target_url": "`+server.URL+`",
+		"timeout": "10s",
+		"tls": {"cert_file": "`+certFile+`", "key_file": "`+keyFile+`"}
+	}`, mirror.Request{Path: "/"})
+	require.NotEmpty(t, res.Error)
+
+	_, err := NewHTTP(&mirror.ModuleContext{}, []byte(`{"target_url": "`+server.URL+`", "timeout": "10s", "tls": {"cert_file": "`+certFile+`"}}`))
+	require.Error(t, err)
+
+	mod, err := NewHTTP(&mirror.ModuleContext{}, []byte(`{"target_url": "`+server.URL+`", "timeout": "10s", "tls": {"ca_file": "/nonexistent"}}`))
+	require.NoError(t, err)
+	require.Error(t, mod.Start())
+}
+
+func TestHTTP_protocol(t *testing.T) {
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(200 + r.ProtoMajor)
+	})
+
+	h2cServer := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer h2cServer.Close()
+
+	tlsServer := httptest.NewUnstartedServer(handler)
+	tlsServer.EnableHTTP2 = true
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+
+	h1 := mirror.Request{Path: "/", HttpVersion: mirror.HTTPVersion_HTTP1_1}
+	h2 := mirror.Request{Path: "/", HttpVersion: mirror.HTTPVersion_HTTP2}
+
+	tests := []struct {
+		url      string
+		protocol string
+		req      mirror.Request
+		status   int32
+	}{
+		{h2cServer.URL, "", h2, 201},
+		{h2cServer.URL, "http1", h2, 201},
+		{h2cServer.URL, "h2c", h1, 202},
+		{h2cServer.URL, "match", h1, 201},
+		{h2cServer.URL, "match", h2, 202},
+		{tlsServer.URL, "", h1, 202},
+		{tlsServer.URL, "http1", h2, 201},
+		{tlsServer.URL, "h2", h1, 202},
+		{tlsServer.URL, "match", h1, 201},
+		{tlsServer.URL, "match", h2, 202},
+	}
+
+	for _, test := range tests {
+		res := sendOne(t, `{
+			"target_url": "`+test.url+`",
+			"timeout": "10s",
+			"protocol": "`+test.protocol+`",
+			"tls": {"insecure": true},
+			"transport": {"keep_alive": "10s", "max_idle_conns_per_host": 4, "idle_conn_timeout": "1m"}
+		}`, test.req)
+		require.Empty(t, res.Error, "%s %s", test.url, test.protocol)
+		require.Equal(t, test.status, res.StatusCode, "%s %s", test.url, test.protocol)
+	}
+
+	_, err := NewHTTP(&mirror.ModuleContext{}, []byte(`{"target_url": "http://127.0.0.1", "timeout": "10s", "protocol": "h3"}`))
+	require.Error(t, err)
+}
+
+func TestHTTP_retry(t *testing.T) {
+	count := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&count, 1) < 3 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	name := t.Name()
+	retriesBefore := testutil.ToFloat64(httpRetries.WithLabelValues(name))
+	cfg := `{
+		"target_url": "` + server.URL + `",
+		"timeout": "10s",
+		"retry": {"max_attempts": 3, "backoff": "1ms", "budget": 200}
+	}`
+
+	res := sendOne(t, cfg, mirror.Request{Path: "/"})
+	require.Empty(t, res.Error)
+	require.Equal(t, int32(http.StatusOK), res.StatusCode)
+	require.Equal(t, int32(3), atomic.LoadInt32(&count))
+	require.Equal(t, float64(2), testutil.ToFloat64(httpRetries.WithLabelValues(name))-retriesBefore)
+
+	// not retried
+	atomic.StoreInt32(&count, 0)
+	res = sendOne(t, `{
+		"target_url": "`+server.URL+`",
+		"timeout": "10s",
+		"retry": {"statuses": [500], "backoff": "1ms", "budget": 200}
+	}`, mirror.Request{Path: "/"})
+	require.Equal(t, int32(http.StatusServiceUnavailable), res.StatusCode)
+	require.Equal(t, int32(1), atomic.LoadInt32(&count))
+
+	// connection errors
+	server.Close()
+	res = sendOne(t, cfg, mirror.Request{Path: "/"})
+	require.NotEmpty(t, res.Error)
+	require.Equal(t, float64(4), testutil.ToFloat64(httpRetries.WithLabelValues(name))-retriesBefore)
+
+	_, err := NewHTTP(&mirror.ModuleContext{}, []byte(`{"target_url": "http://127.0.0.1", "timeout": "10s", "retry": {"errors": ["dns"]}}`))
+	require.Error(t, err)
+}
+
+func TestHTTP_retry_budget(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	name := t.Name()
+	retriesBefore := testutil.ToFloat64(httpRetries.WithLabelValues(name))
+	exhaustedBefore := testutil.ToFloat64(httpRetryBudgetExhausted.WithLabelValues(name))
+
+	mod, err := NewHTTP(&mirror.ModuleContext{Name: name}, []byte(`{
+		"target_url": "`+server.URL+`",
+		"timeout": "10s",
+		"parallel": 1,
+		"retry": {"max_attempts": 2, "backoff": "1ms", "budget": 10}
+	}`))
+	require.NoError(t, err)
+
+	in := make(chan mirror.Request, 20)
+	for i := 0; i < 20; i++ {
+		in <- mirror.Request{Path: "/"}
+	}
+	close(in)
+	mod.SetInput(in)
+	for range mod.Output() {
+	}
+
+	// one retry for every ten requests
+	require.Equal(t, float64(2), testutil.ToFloat64(httpRetries.WithLabelValues(name))-retriesBefore)
+	require.Equal(t, float64(18), testutil.ToFloat64(httpRetryBudgetExhausted.WithLabelValues(name))-exhaustedBefore)
+}
+
+func TestHTTP_breaker(t *testing.T) {
+	fail := int32(1)
+	count := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		if atomic.LoadInt32(&fail) == 1 {
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	name := t.Name()
+	mod, err := NewHTTP(&mirror.ModuleContext{Name: name}, []byte(`{
+		"target_url": "`+server.URL+`",
+		"timeout": "10s",
+		"parallel": 1,
+		"circuit_breaker": {"failures": 3, "open_timeout": "50ms", "half_open_requests": 2}
+	}`))
+	require.NoError(t, err)
+
+	in := make(chan mirror.Request)
+	out := make(chan *mirror.Response)
+	mod.SetInput(in)
+	go func() {
+		for r := range mod.Output() {
+			out <- r.Response
+		}
+		close(out)
+	}()
+	send := func() *mirror.Response {
+		in <- mirror.Request{Path: "/"}
+		return <-out
+	}
+	state := func() float64 {
+		return testutil.ToFloat64(httpBreakerState.WithLabelValues(name, server.URL))
+	}
+	rejectedBefore := testutil.ToFloat64(httpBreakerRejected.WithLabelValues(name, server.URL))
+
+	for i := 0; i < 3; i++ {
+		require.Equal(t, int32(http.StatusInternalServerError), send().StatusCode)
+	}
+	require.Equal(t, float64(breakerOpen), state())
+	require.Equal(t, map[string]string{"breaker " + server.URL: "open"}, mod.(mirror.StateReporter).State())
+
+	// the requests are shed while open
+	res := send()
+	require.Contains(t, res.Error, "circuit breaker")
+	require.Equal(t, int32(3), atomic.LoadInt32(&count))
+	require.Equal(t, float64(1), testutil.ToFloat64(httpBreakerRejected.WithLabelValues(name, server.URL))-rejectedBefore)
+
+	// a failed probe opens it again
+	time.Sleep(60 * time.Millisecond)
+	require.Equal(t, int32(http.StatusInternalServerError), send().StatusCode)
+	require.Equal(t, float64(breakerOpen), state())
+
+	// it closes once the probes succeed
+	atomic.StoreInt32(&fail, 0)
+	time.Sleep(60 * time.Millisecond)
+	require.Equal(t, int32(http.StatusOK), send().StatusCode)
+	require.Equal(t, float64(breakerHalfOpen), state())
+	require.Equal(t, int32(http.StatusOK), send().StatusCode)
+	require.Equal(t, float64(breakerClosed), state())
+	require.Empty(t, mod.(mirror.StateReporter).State())
+
+	close(in)
+	for range out {
+	}
+}
+
+func TestBreakerProbes(t *testing.T) {
+	b := newBreakers(t.Name(), &breakerConfig{failures: 1, openTimeout: 10 * time.Millisecond, halfOpenRequests: 1})
+	br := b.get("http://target")
+
+	// a request sent while closed, which ends once half-open
+	slow, ok := br.allow()
+	require.True(t, ok)
+	gen, ok := br.allow()
+	require.True(t, ok)
+	br.done(gen, false)
+	require.Equal(t, breakerOpen, br.getState())
+	time.Sleep(20 * time.Millisecond)
+	probe, ok := br.allow()
+	require.True(t, ok)
+	require.Equal(t, breakerHalfOpen, br.getState())
+
+	// only the probe closes the breaker
+	br.done(slow, true)
+	require.Equal(t, breakerHalfOpen, br.getState())
+	br.done(probe, true)
+	require.Equal(t, breakerClosed, br.getState())
+}
+
+func TestBreakersEviction(t *testing.T) {
+	name := t.Name()
+	b := newBreakers(name, &breakerConfig{failures: 1, openTimeout: time.Minute, halfOpenRequests: 1})
+	b.idleTimeout = 10 * time.Millisecond
+
+	idle := b.get("http://idle")
+	gen, _ := idle.allow()
+	idle.done(gen, true)
+
+	open := b.get("http://open")
+	gen, _ = open.allow()
+	open.done(gen, false)
+
+	busy := b.get("http://busy")
+	busy.allow()
+
+	time.Sleep(20 * time.Millisecond)
+	b.get("http://new")
+
+	// only the closed breakers without requests are removed, with their
+	// metrics
+	b.lock.Lock()
+	targets := []string{}
+	for target := range b.breakers {
+		targets = append(targets, target)
+	}
+	b.lock.Unlock()
+	require.ElementsMatch(t, []string{"http://open", "http://busy", "http://new"}, targets)
+	require.False(t, httpBreakerState.DeleteLabelValues(name, "http://idle"))
+	require.True(t, httpBreakerState.DeleteLabelValues(name, "http://open"))
+}
+
+// countingServers starts n servers counting their requests, the handler
+// gives the status of each request.
+func countingServers(t *testing.T, n int, status func(i int, r *http.Request) int) ([]string, []int32) {
+	urls := make([]string, n)
+	counts := make([]int32, n)
+	for i := 0; i < n; i++ {
+		i := i
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/health" {
+				atomic.AddInt32(&counts[i], 1)
+			}
+			rw.WriteHeader(status(i, r))
+		}))
+		t.Cleanup(server.Close)
+		urls[i] = server.URL
+	}
+	return urls, counts
+}
+
+func sendAll(t *testing.T, cfg string, reqs []mirror.Request) {
+	mod, err := NewHTTP(&mirror.ModuleContext{Name: t.Name()}, []byte(cfg))
+	require.NoError(t, err)
+	require.NoError(t, mod.Start())
+
+	in := make(chan mirror.Request, len(reqs))
+	for _, r := range reqs {
+		in <- r
+	}
+	close(in)
+	mod.SetInput(in)
+	for range mod.Output() {
+	}
+}
+
+func repeat(r mirror.Request, n int) []mirror.Request {
+	reqs := []mirror.Request{}
+	for i := 0; i < n; i++ {
+		reqs = append(reqs, r)
+	}
+	return reqs
+}
+
+func TestHTTP_targets(t *testing.T) {
+	urls, counts := countingServers(t, 3, func(int, *http.Request) int { return 200 })
+
+	sendAll(t, `{
+		"targets": ["`+urls[0]+`", "`+urls[1]+`", "`+urls[2]+`"],
+		"timeout": "10s",
+		"parallel": 1
+	}`, repeat(mirror.Request{Path: "/"}, 6))
+	require.Equal(t, []int32{2, 2, 2}, counts)
+	require.Equal(t, float64(2), testutil.ToFloat64(httpEndpointRequests.WithLabelValues(t.Name(), urls[0])))
+
+	for _, cfg := range []string{
+		`{"target_url": "http://127.0.0.1", "targets": ["http://127.0.0.1"], "timeout": "1s"}`,
+		`{"timeout": "1s"}`,
+		`{"targets": ["127.0.0.1"], "timeout": "1s"}`,
+		`{"targets": ["http://127.0.0.1"], "balance": "hash", "timeout": "1s"}`,
+		`{"target_url": "http://127.0.0.1", "balance": "round_robin", "timeout": "1s"}`,
+	} {
+		_, err := NewHTTP(&mirror.ModuleContext{}, []byte(cfg))
+		require.Error(t, err, cfg)
+	}
+}
+
+func TestBalancerLeastInFlight(t *testing.T) {
+	b, err := newBalancer(t.Name(), HTTPConfig{
+		Targets: []string{"http://a", "http://b", "http://c"},
+		Balance: BalanceLeastInFlight,
+	})
+	require.NoError(t, err)
+
+	picked := map[string]bool{}
+	eps := []*endpoint{}
+	for i := 0; i < 3; i++ {
+		ep, err := b.pick(mirror.Request{})
+		require.NoError(t, err)
+		picked[ep.url] = true
+		eps = append(eps, ep)
+	}
+	require.Len(t, picked, 3)
+
+	// only a is not busy anymore
+	for _, ep := range eps {
+		if ep.url == "http://a" {
+			b.release(ep, true, 0)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		ep, err := b.pick(mirror.Request{})
+		require.NoError(t, err)
+		require.Equal(t, "http://a", ep.url)
+		b.release(ep, true, 0)
+	}
+}
+
+func TestBalancerHash(t *testing.T) {
+	var key expr.AnyExpr
+	require.NoError(t, json.Unmarshal([]byte(`"{req.path}"`), &key))
+
+	targets := []string{"http://a", "http://b", "http://c", "http://d"}
+	b, err := newBalancer(t.Name(), HTTPConfig{Targets: targets, Balance: BalanceHash, HashKey: &key})
+	require.NoError(t, err)
+
+	pick := func(path string) string {
+		ep, err := b.pick(mirror.Request{Path: path})
+		require.NoError(t, err)
+		b.release(ep, true, 0)
+		return ep.url
+	}
+
+	before := map[string]string{}
+	used := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		path := fmt.Sprintf("/%d", i)
+		before[path] = pick(path)
+		used[before[path]] = true
+		require.Equal(t, before[path], pick(path))
+	}
+	require.Len(t, used, 4)
+
+	// only the keys of the removed endpoint move
+	b.setEndpoints(targets[:3], "")
+	for path, url := range before {
+		if url != "http://d" {
+			require.Equal(t, url, pick(path))
+		}
+	}
+}
+
+func TestHTTP_health_check(t *testing.T) {
+	unhealthy := int32(1)
+	urls, counts := countingServers(t, 2, func(i int, r *http.Request) int {
+		if i == 0 && r.URL.Path == "/health" && atomic.LoadInt32(&unhealthy) == 1 {
+			return http.StatusServiceUnavailable
+		}
+		return 200
+	})
+
+	name := t.Name()
+	mod, err := NewHTTP(&mirror.ModuleContext{Name: name}, []byte(`{
+		"targets": ["`+urls[0]+`", "`+urls[1]+`"],
+		"timeout": "10s",
+		"parallel": 1,
+		"health_check": {"path": "/health", "interval": "5ms", "unhealthy_threshold": 2}
+	}`))
+	require.NoError(t, err)
+	require.NoError(t, mod.Start())
+	defer func() {
+		in := make(chan mirror.Request)
+		mod.SetInput(in)
+		close(in)
+		for range mod.Output() {
+		}
+	}()
+
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(httpEndpointAvailable.WithLabelValues(name, urls[0])) == 0
+	}, time.Second, time.Millisecond)
+	require.Equal(t, map[string]string{"target " + urls[0]: "unhealthy"}, mod.(mirror.StateReporter).State())
+
+	h := mod.(*HTTP)
+	for i := 0; i < 4; i++ {
+		require.Equal(t, int32(200), h.target.do(mirror.Request{Path: "/"}).StatusCode)
+	}
+	require.Equal(t, []int32{0, 4}, []int32{atomic.LoadInt32(&counts[0]), atomic.LoadInt32(&counts[1])})
+
+	atomic.StoreInt32(&unhealthy, 0)
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(httpEndpointAvailable.WithLabelValues(name, urls[0])) == 1
+	}, time.Second, time.Millisecond)
+}
+
+func TestHTTP_ejection(t *testing.T) {
+	urls, counts := countingServers(t, 3, func(i int, r *http.Request) int {
+		if i < 2 {
+			return http.StatusInternalServerError
+		}
+		return 200
+	})
+
+	name := t.Name()
+	sendAll(t, `{
+		"targets": ["`+urls[0]+`", "`+urls[1]+`", "`+urls[2]+`"],
+		"timeout": "10s",
+		"parallel": 1,
+		"ejection": {"failures": 2, "duration": "1m", "max_percent": 34}
+	}`, repeat(mirror.Request{Path: "/"}, 30))
+
+	// only one of the failing endpoints is ejected
+	require.Equal(t, int32(2), atomic.LoadInt32(&counts[0]))
+	require.Equal(t, float64(1), testutil.ToFloat64(httpEndpointEjections.WithLabelValues(name, urls[0])))
+	require.Equal(t, float64(0), testutil.ToFloat64(httpEndpointEjections.WithLabelValues(name, urls[1])))
+	require.Equal(t, int32(14), atomic.LoadInt32(&counts[1]))
+	require.Equal(t, int32(14), atomic.LoadInt32(&counts[2]))
+}
+
+func TestBalancerRemovedEndpoint(t *testing.T) {
+	name := t.Name()
+	b, err := newBalancer(name, HTTPConfig{Targets: []string{"http://a"}})
+	require.NoError(t, err)
+
+	first, err := b.pick(mirror.Request{})
+	require.NoError(t, err)
+	second, err := b.pick(mirror.Request{})
+	require.NoError(t, err)
+	third, err := b.pick(mirror.Request{})
+	require.NoError(t, err)
+	b.release(third, false, 0)
+	b.setEndpoints([]string{"http://b"}, "")
+
+	// the metrics of a are deleted, and the requests in flight to it do
+	// not bring them back
+	b.release(first, false, 0)
+	b.cancel(second)
+	require.False(t, httpEndpointRequests.DeleteLabelValues(name, "http://a"))
+	require.False(t, httpEndpointFailures.DeleteLabelValues(name, "http://a"))
+	require.False(t, httpEndpointResponseTime.DeleteLabelValues(name, "http://a"))
+	require.False(t, httpEndpointInFlight.DeleteLabelValues(name, "http://a"))
+	require.False(t, httpEndpointAvailable.DeleteLabelValues(name, "http://a"))
+}
+
+func TestBalancerResolve(t *testing.T) {
+	b, err := newBalancer(t.Name(), HTTPConfig{Resolve: &HTTPResolveConfig{URL: "http://localhost:8002"}})
+	require.NoError(t, err)
+	require.NoError(t, b.start(nil))
+	defer b.stop()
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	urls := []string{}
+	for _, ep := range b.endpoints {
+		require.Equal(t, "localhost:8002", ep.host)
+		urls = append(urls, ep.url)
+	}
+	require.Contains(t, urls, "http://127.0.0.1:8002")
+}
+
+func TestHTTP_allow(t *testing.T) {
+	count := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+	}))
+	defer server.Close()
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+
+	target := func(u string) mirror.Request {
+		return mirror.Request{
+			Path: "/",
+			Meta: map[string]*mirror.MetaValue{
+				"target": {Value: &mirror.MetaValue_String_{String_: u}},
+			},
+		}
+	}
+
+	tests := []struct {
+		allow  string
+		target string
+		reason string
+	}{
+		{`{"cidrs": ["127.0.0.0/8"]}`, "ftp://127.0.0.1", "scheme"},
+		{`{"cidrs": ["127.0.0.0/8"]}`, server.URL, ""},
+		{`{"hosts": ["*.example.com"]}`, server.URL, "host"},
+		{`{"hosts": ["*"]}`, "http://169.254.169.254", "host"},
+		{`{"cidrs": ["10.0.0.0/8"]}`, server.URL, "host"},
+		{`{"schemes": ["https"], "cidrs": ["127.0.0.0/8"]}`, server.URL, "scheme"},
+		// the hosts are also checked once resolved, private addresses are
+		// denied unless they are in the CIDRs
+		{`{"hosts": ["localhost"]}`, "http://localhost:" + port, "private address"},
+		{`{"hosts": ["localhost"], "cidrs": ["127.0.0.0/8"]}`, "http://localhost:" + port, ""},
+		{`{"hosts": ["*.example.com"]}`, "http://localhost:" + port, "host"},
+		{`{"hosts": ["*.example.com"]}`, "http://evil-example.com", "host"},
+	}
+
+	for _, test := range tests {
+		name := t.Name()
+		cfg := `{"target_url": "{req.meta.target.string}", "timeout": "10s", "retry": {}, "allow": ` + test.allow + `}`
+
+		before := atomic.LoadInt32(&count)
+		rejectedBefore := testutil.ToFloat64(httpTargetRejected.WithLabelValues(name, test.reason))
+
+		res := sendOne(t, cfg, target(test.target))
+		if test.reason == "" {
+			require.Empty(t, res.Error, "%s %s", test.allow, test.target)
+			require.Equal(t, before+1, atomic.LoadInt32(&count))
+			continue
+		}
+
+		require.Contains(t, res.Error, "target not allowed", "%s %s", test.allow, test.target)
+		require.Equal(t, before, atomic.LoadInt32(&count))
+		// a host may resolve to several addresses, each one rejected
+		require.GreaterOrEqual(t, testutil.ToFloat64(httpTargetRejected.WithLabelValues(name, test.reason))-rejectedBefore, float64(1), "%s %s", test.allow, test.target)
+	}
+
+	for _, cfg := range []string{
+		`{"target_url": "http://127.0.0.1", "timeout": "1s", "allow": {"cidrs": ["127.0.0.0/8"]}}`,
+		`{"target_url": "{req.meta.target.string}", "timeout": "1s"}`,
+		`{"target_url": "{req.meta.target.string}", "timeout": "1s", "allow": {"schemes": ["https"]}}`,
+		`{"target_url": "{req.meta.target.string}", "timeout": "1s", "allow": {"cidrs": ["10.0.0.0"]}}`,
+		`{"target_url": "{req.meta.target.string}", "timeout": "1s", "allow": {"hosts": ["a.*.com"]}}`,
+	} {
+		_, err := NewHTTP(&mirror.ModuleContext{}, []byte(cfg))
+		require.Error(t, err, cfg)
+	}
+}
+
+func TestHTTP_allow_private(t *testing.T) {
+	a, err := newAllowlist(t.Name(), &HTTPAllowConfig{Hosts: []string{"*"}, CIDRs: []string{"10.1.0.0/16"}})
+	require.NoError(t, err)
+
+	for addr, allowed := range map[string]bool{
+		"93.184.216.34":   true,
+		"10.2.0.1":        false,
+		"10.1.0.1":        true,
+		"198.18.0.1":      false,
+		"192.0.0.170":     false,
+		"100.64.0.1":      false,
+		"2606:2800::1":    true,
+		"::ffff:10.2.0.1": false,
+		// NAT64 and 6to4 addresses are checked with the embedded address
+		"64:ff9b::5db8:d822": true,
+		"64:ff9b::a9fe:a9fe": false,
+		"64:ff9b::a01:1":     true,
+		"2002:5db8:d822::1":  true,
+		"2002:7f00:1::1":     false,
+		"2002:a01:1::1":      true,
+	} {
+		err := a.control("tcp", net.JoinHostPort(addr, "80"), nil)
+		if allowed {
+			require.NoError(t, err, addr)
+		} else {
+			require.Error(t, err, addr)
+		}
+	}
+}
+
+func TestHTTP_allow_redirect(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		http.Redirect(rw, r, "http://169.254.169.254/latest/meta-data", http.StatusFound)
+	}))
+	defer server.Close()
+
+	res := sendOne(t, `{
+		"target_url": "{req.meta.target.string}",
+		"timeout": "10s",
+		"follow_redirects": true,
+		"allow": {"cidrs": ["127.0.0.0/8"]}
+	}`, mirror.Request{
+		Path: "/",
+		Meta: map[string]*mirror.MetaValue{
+			"target": {Value: &mirror.MetaValue_String_{String_: server.URL}},
+		},
+	})
+	require.Contains(t, res.Error, "target not allowed")
+}
+
+func TestHTTP_allow_proxy(t *testing.T) {
+	// the proxy is not used with an allowlist, since the addresses dialed
+	// would be the ones of the proxy
+	for _, test := range []struct {
+		cfg   string
+		proxy bool
+	}{
+		{`{"target_url": "http://127.0.0.1", "timeout": "1s"}`, true},
+		{`{"target_url": "{req.meta.target.string}", "timeout": "1s", "allow": {"hosts": ["*.example.com"]}}`, false},
+		{`{"target_url": "{req.meta.target.string}", "timeout": "1s", "protocol": "match", "allow": {"hosts": ["*.example.com"]}}`, false},
+	} {
+		mod, err := NewHTTP(&mirror.ModuleContext{}, []byte(test.cfg))
+		require.NoError(t, err)
+
+		for _, client := range mod.(*HTTP).target.clients.clients {
+			if tr, ok := client.Transport.(*http.Transport); ok {
+				require.Equal(t, test.proxy, tr.Proxy != nil, test.cfg)
+			}
+		}
+	}
+}
+
+func TestHTTP_pool_idle(t *testing.T) {
+	name := t.Name()
+	handled := make(chan struct{})
+	p := newWorkerPool(name, poolConfig{max: 8, idleTimeout: time.Minute}, func(mirror.Request) time.Duration {
+		handled <- struct{}{}
+		return 0
+	})
+	p.start()
+
+	idle := func() bool {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		return p.idle == 1
+	}
+
+	// the idle worker takes all the requests sent one at a time
+	for i := 0; i < 20; i++ {
+		p.submit(mirror.Request{})
+		<-handled
+		require.Eventually(t, idle, time.Second, time.Millisecond)
+	}
+	require.Equal(t, float64(1), testutil.ToFloat64(httpWorkers.WithLabelValues(name)))
+
+	p.close()
+}
@@ -0,0 +1,220 @@
+package source
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/criteo/traffic-mirroring/mirror/codec"
+	"github.com/criteo/traffic-mirroring/mirror/registry"
+)
+
+const (
+	FileName = "source.file"
+
+	// fileEmptyBackoff is the initial wait after a pass over the files
+	// which read nothing, when looping forever
+	fileEmptyBackoff    = time.Second
+	fileMaxEmptyBackoff = time.Minute
+)
+
+var errStopped = errors.New("stopped")
+
+func init() {
+	registry.Register(FileName, NewFile)
+}
+
+type FileConfig struct {
+	Path   string `json:"path,omitempty"`
+	Format string `json:"format,omitempty"`
+	Loop   int    `json:"loop,omitempty"`
+}
+
+type File struct {
+	cfg FileConfig
+	ctx *mirror.ModuleContext
+	out chan mirror.Request
+
+	lock    sync.Mutex
+	started bool
+	stopped bool
+	stop    chan struct{}
+}
+
+func NewFile(ctx *mirror.ModuleContext, cfg []byte) (mirror.Module, error) {
+	mod := &File{
+		ctx:  ctx,
+		out:  make(chan mirror.Request),
+		stop: make(chan struct{}),
+	}
+
+	err := json.Unmarshal(cfg, &mod.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(mod.cfg.Path) == 0 {
+		return nil, errors.New("path is required")
+	}
+
+	err = codec.CheckFormat(mod.cfg.Format, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// the files are listed again on each pass, this only reports a wrong
+	// path early
+	paths, err := filepath.Glob(mod.cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no file matches %q", mod.cfg.Path)
+	}
+
+	return mod, nil
+}
+
+func (m *File) Context() *mirror.ModuleContext {
+	return m.ctx
+}
+
+func (m *File) Children() [][]mirror.Module {
+	return nil
+}
+
+func (m *File) Start() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// the output is already closed
+	if m.stopped {
+		return nil
+	}
+
+	m.started = true
+	go m.run()
+	return nil
+}
+
+func (m *File) Stop() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.stopped {
+		return
+	}
+	m.stopped = true
+	close(m.stop)
+
+	// without run, nothing else closes the output
+	if !m.started {
+		close(m.out)
+	}
+}
+
+func (m *File) Output() <-chan mirror.Request {
+	return m.out
+}
+
+func (m *File) SetInput(c <-chan mirror.Request) {
+	m.ctx.Error(fmt.Errorf("%s cannot accept input", FileName))
+	go func() {
+		for range c {
+		}
+	}()
+}
+
+func (m *File) run() {
+	loops := 1
+	if m.cfg.Loop != 0 {
+		loops = m.cfg.Loop
+	}
+
+	defer close(m.out)
+
+	backoff := fileEmptyBackoff
+	for i := 0; loops < 0 || i < loops; i++ {
+		// files may have been added or removed since the last pass
+		paths, _ := filepath.Glob(m.cfg.Path)
+
+		read := 0
+		for _, path := range paths {
+			n, err := m.readFile(path)
+			read += n
+			if err == errStopped {
+				return
+			}
+			if err != nil {
+				m.ctx.Error(fmt.Errorf("%s: %s", path, err))
+			}
+		}
+
+		if read > 0 || loops > 0 {
+			backoff = fileEmptyBackoff
+			continue
+		}
+
+		// looping forever over nothing would spin, wait for new files
+		m.ctx.Error(fmt.Errorf("no request read from %q, retrying in %s", m.cfg.Path, backoff))
+		select {
+		case <-m.stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > fileMaxEmptyBackoff {
+			backoff = fileMaxEmptyBackoff
+		}
+	}
+}
+
+// readFile sends the requests of the file, it returns the number of requests
+// read.
+func (m *File) readFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	format := m.cfg.Format
+	if format == "" || format == codec.FormatAuto {
+		format = codec.FormatFromPath(path)
+	}
+
+	dec, err := codec.NewDecoder(bufio.NewReader(f), format)
+	if err != nil {
+		return 0, err
+	}
+
+	read := 0
+	for {
+		select {
+		case <-m.stop:
+			return read, errStopped
+		default:
+		}
+
+		req := mirror.Request{}
+		err := dec.Decode(&req)
+		if err == io.EOF {
+			return read, nil
+		}
+		if err != nil {
+			return read, err
+		}
+
+		read++
+		m.ctx.HandledRequest()
+		m.out <- req
+	}
+}
@@ -0,0 +1,197 @@
+package source
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/criteo/traffic-mirroring/mirror/modules/sink"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var fileTestRequests = []mirror.Request{
+	{
+		Time:        &timestamppb.Timestamp{Seconds: 1600000000},
+		Method:      mirror.Method_GET,
+		Path:        "/index.html",
+		HttpVersion: mirror.HTTPVersion_HTTP1_1,
+		Headers: map[string]*mirror.HeaderValue{
+			"Host": {Values: []string{"127.0.0.1:10080"}},
+		},
+		Meta: map[string]*mirror.MetaValue{
+			"string": {Value: &mirror.MetaValue_String_{String_: "value"}},
+			"int":    {Value: &mirror.MetaValue_Int{Int: 42}},
+			"bool":   {Value: &mirror.MetaValue_Bool{Bool: true}},
+		},
+	},
+	{
+		Time:        &timestamppb.Timestamp{Seconds: 1600000001},
+		Method:      mirror.Method_POST,
+		Path:        "/form",
+		HttpVersion: mirror.HTTPVersion_HTTP1_1,
+		Body:        []byte("HEY"),
+	},
+}
+
+func writeTestFile(t *testing.T, path string, format string) {
+	mod, err := sink.NewFile(&mirror.ModuleContext{}, []byte(`{"path": "`+path+`", "format": "`+format+`"}`))
+	require.NoError(t, err)
+
+	in := make(chan mirror.Request, len(fileTestRequests))
+	for _, r := range fileTestRequests {
+		in <- r
+	}
+
+	mod.SetInput(in)
+	close(in)
+
+	<-mod.Output()
+}
+
+func readAll(mod mirror.Module) []mirror.Request {
+	res := []mirror.Request{}
+	for r := range mod.Output() {
+		res = append(res, r)
+	}
+	return res
+}
+
+func requireRequestsEqual(t *testing.T, expected, actual []mirror.Request) {
+	require.Equal(t, len(expected), len(actual))
+	for i := range expected {
+		require.True(t, proto.Equal(&expected[i], &actual[i]), "request %d: expected %v, got %v", i, &expected[i], &actual[i])
+	}
+}
+
+func TestFile(t *testing.T) {
+	for _, format := range []string{"json", "proto"} {
+		for _, readFormat := range []string{format, "auto"} {
+			for _, name := range []string{"requests", "requests." + format} {
+				t.Run(format+"/"+readFormat+"/"+name, func(t *testing.T) {
+					dir, err := ioutil.TempDir("/tmp", "http-mirror-test")
+					require.NoError(t, err)
+					defer os.RemoveAll(dir)
+
+					path := filepath.Join(dir, name)
+					writeTestFile(t, path, format)
+
+					mod, err := NewFile(&mirror.ModuleContext{}, []byte(`{"path": "`+path+`", "format": "`+readFormat+`"}`))
+					require.NoError(t, err)
+					require.NoError(t, mod.Start())
+
+					requireRequestsEqual(t, fileTestRequests, readAll(mod))
+				})
+			}
+		}
+	}
+}
+
+func TestFileStop(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "http-mirror-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "requests")
+	writeTestFile(t, path, "proto")
+
+	mod, err := NewFile(&mirror.ModuleContext{}, []byte(`{"path": "`+path+`", "loop": -1}`))
+	require.NoError(t, err)
+	require.NoError(t, mod.Start())
+
+	for i := 0; i < 10; i++ {
+		<-mod.Output()
+	}
+
+	mod.Stop()
+	for range mod.Output() {
+	}
+}
+
+func TestFileStopBeforeStart(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "http-mirror-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "requests")
+	writeTestFile(t, path, "proto")
+
+	mod, err := NewFile(&mirror.ModuleContext{}, []byte(`{"path": "`+path+`"}`))
+	require.NoError(t, err)
+
+	mod.Stop()
+	require.NoError(t, mod.Start())
+	require.Empty(t, readAll(mod))
+}
+
+func TestFileGlobLoop(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "http-mirror-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeTestFile(t, filepath.Join(dir, "1.json"), "json")
+	writeTestFile(t, filepath.Join(dir, "2.proto"), "proto")
+
+	mod, err := NewFile(&mirror.ModuleContext{}, []byte(`{"path": "`+dir+`/*", "loop": 2}`))
+	require.NoError(t, err)
+	require.NoError(t, mod.Start())
+
+	expected := []mirror.Request{}
+	for i := 0; i < 4; i++ {
+		expected = append(expected, fileTestRequests...)
+	}
+
+	requireRequestsEqual(t, expected, readAll(mod))
+}
+
+func TestFileGlobEachLoop(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "http-mirror-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeTestFile(t, filepath.Join(dir, "1.json"), "json")
+
+	mod, err := NewFile(&mirror.ModuleContext{}, []byte(`{"path": "`+dir+`/*", "loop": 2}`))
+	require.NoError(t, err)
+	require.NoError(t, mod.Start())
+
+	// the first pass is still sending the second request of the first
+	// file, the new file is only read by the second pass
+	<-mod.Output()
+	writeTestFile(t, filepath.Join(dir, "2.json"), "json")
+
+	require.Len(t, readAll(mod), 1+2*len(fileTestRequests))
+}
+
+func TestFileLoopEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "http-mirror-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "requests")
+	require.NoError(t, ioutil.WriteFile(path, nil, 0644))
+
+	ctx := &mirror.ModuleContext{}
+	mod, err := NewFile(ctx, []byte(`{"path": "`+path+`", "loop": -1}`))
+	require.NoError(t, err)
+	require.NoError(t, mod.Start())
+
+	// the empty passes are reported and spaced out instead of spinning
+	require.Eventually(t, func() bool {
+		return ctx.Errors() == 1
+	}, time.Second, time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, uint64(1), ctx.Errors())
+
+	mod.Stop()
+	require.Empty(t, readAll(mod))
+}
+
+func TestFileNoMatch(t *testing.T) {
+	_, err := NewFile(&mirror.ModuleContext{}, []byte(`{"path": "/nonexistent/*.json"}`))
+	require.Error(t, err)
+}
@@ -6,18 +6,20 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	spoe "github.com/criteo/haproxy-spoe-go"
 	"github.com/criteo/traffic-mirroring/mirror"
 	"github.com/criteo/traffic-mirroring/mirror/registry"
-	log "github.com/sirupsen/logrus"
 )
 
 const (
 	HAProxySPOEName        = "source.haproxy_spoe"
 	DefaultSpoeIdleTimeout = 30
+
+	spoeRestartDelay = time.Second
 )
 
 func init() {
@@ -27,11 +29,16 @@ func init() {
 type mappingFunc func(req *mirror.Request, value interface{}) error
 
 var defaultMappingConfig = map[string]string{
-	"method":  "method",
-	"ver":     "ver",
-	"path":    "path",
-	"headers": "headers",
-	"body":    "body",
+	"method":      "method",
+	"ver":         "ver",
+	"path":        "path",
+	"query":       "query",
+	"authority":   "authority",
+	"scheme":      "scheme",
+	"remote_addr": "remote_addr",
+	"id":          "id",
+	"headers":     "headers",
+	"body":        "body",
 }
 
 type HAProxySPOEConfig struct {
@@ -46,6 +53,14 @@ type HAProxySPOE struct {
 	out         chan mirror.Request
 	mapping     map[string]mappingFunc
 	idleTimeout time.Duration
+
+	listener net.Listener
+	// handlers tracks the messages being handled, which must be sent before
+	// the output is closed
+	handlers sync.WaitGroup
+	started  bool
+	stopped  bool
+	stopLock sync.RWMutex
 }
 
 func NewHAProxySPOE(ctx *mirror.ModuleContext, cfg []byte) (mirror.Module, error) {
@@ -87,6 +102,16 @@ func NewHAProxySPOE(ctx *mirror.ModuleContext, cfg []byte) (mirror.Module, error
 			mod.mapping[k] = mapVer
 		case "path":
 			mod.mapping[k] = mapPath
+		case "query":
+			mod.mapping[k] = mapQuery
+		case "authority":
+			mod.mapping[k] = mapAuthority
+		case "scheme":
+			mod.mapping[k] = mapScheme
+		case "remote_addr":
+			mod.mapping[k] = mapRemoteAddr
+		case "id":
+			mod.mapping[k] = mapID
 		case "headers":
 			mod.mapping[k] = mapHeaders
 		case "body":
@@ -100,11 +125,6 @@ func NewHAProxySPOE(ctx *mirror.ModuleContext, cfg []byte) (mirror.Module, error
 		}
 	}
 
-	err = mod.start()
-	if err != nil {
-		return nil, err
-	}
-
 	return mod, nil
 }
 
@@ -121,10 +141,21 @@ func (m *HAProxySPOE) Output() <-chan mirror.Request {
 }
 
 func (m *HAProxySPOE) SetInput(c <-chan mirror.Request) {
-	log.Fatalf("%s: connot accept input", HAProxySPOEName)
+	m.ctx.Error(fmt.Errorf("%s cannot accept input", HAProxySPOEName))
+	go func() {
+		for range c {
+		}
+	}()
 }
 
-func (m *HAProxySPOE) start() error {
+func (m *HAProxySPOE) Start() error {
+	m.stopLock.Lock()
+	defer m.stopLock.Unlock()
+
+	// the output is already closed
+	if m.stopped {
+		return nil
+	}
 
 	agent := spoe.NewWithConfig(m.handleMessage, spoe.Config{
 		ReadTimeout:  time.Second,
@@ -132,55 +163,165 @@ func (m *HAProxySPOE) start() error {
 		IdleTimeout:  m.idleTimeout,
 	})
 
-	var l net.Listener
-	var err error
-	if m.cfg.ListenAddr[0] == '@' {
-		syscall.Unlink(m.cfg.ListenAddr[1:])
-		l, err = net.Listen("unix", m.cfg.ListenAddr[1:])
-	} else {
-		l, err = net.Listen("tcp", m.cfg.ListenAddr)
-	}
+	l, err := m.newListener()
 	if err != nil {
 		return err
 	}
+	m.listener = l
+	m.started = true
 
 	go func() {
-		err := agent.Serve(l)
-		if err != nil {
-			log.Errorf("%s: %s", HAProxySPOEName, err)
+		defer close(m.out)
+
+		for {
+			err := agent.Serve(m.currentListener())
+			if m.isStopped() {
+				break
+			}
+
+			// with the restart policy, listen again until it works or
+			// the module is stopped
+			if m.ctx.Error(err) != mirror.ErrorPolicyRestart {
+				m.Stop()
+				break
+			}
+
+			for !m.isStopped() {
+				time.Sleep(spoeRestartDelay)
+				err = m.listen()
+				if err == nil {
+					break
+				}
+				m.ctx.Error(err)
+			}
 		}
-		close(m.out)
+
+		m.handlers.Wait()
 	}()
 
 	return nil
 }
 
+func (m *HAProxySPOE) newListener() (net.Listener, error) {
+	if m.cfg.ListenAddr[0] == '@' {
+		syscall.Unlink(m.cfg.ListenAddr[1:])
+		l, err := net.Listen("unix", m.cfg.ListenAddr[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		// on reload, the module replaced is stopped after this one
+		// listens on the same path
+		l.(*net.UnixListener).SetUnlinkOnClose(false)
+		return l, nil
+	}
+	return net.Listen("tcp", m.cfg.ListenAddr)
+}
+
+// listen replaces the listener which failed, unless the module was stopped
+// in the meantime.
+func (m *HAProxySPOE) listen() error {
+	l, err := m.newListener()
+	if err != nil {
+		return err
+	}
+
+	m.stopLock.Lock()
+	defer m.stopLock.Unlock()
+
+	if m.stopped {
+		l.Close()
+		return nil
+	}
+	m.listener = l
+
+	return nil
+}
+
+func (m *HAProxySPOE) currentListener() net.Listener {
+	m.stopLock.RLock()
+	defer m.stopLock.RUnlock()
+	return m.listener
+}
+
+// Stop closes the listener. Messages received afterwards on the open
+// connections are ignored.
+func (m *HAProxySPOE) Stop() {
+	m.stopLock.Lock()
+	defer m.stopLock.Unlock()
+
+	if m.stopped {
+		return
+	}
+	m.stopped = true
+
+	// without listener, nothing else closes the output
+	if !m.started {
+		close(m.out)
+		return
+	}
+	m.listener.Close()
+}
+
+// Restartable listens again when the listener fails, with the restart
+// policy.
+func (m *HAProxySPOE) Restartable() {}
+
+func (m *HAProxySPOE) isStopped() bool {
+	m.stopLock.RLock()
+	defer m.stopLock.RUnlock()
+	return m.stopped
+}
+
 func (m *HAProxySPOE) handleMessage(msgs *spoe.MessageIterator) ([]spoe.Action, error) {
+	m.stopLock.RLock()
+	if m.stopped {
+		m.stopLock.RUnlock()
+		return nil, nil
+	}
+	m.handlers.Add(1)
+	m.stopLock.RUnlock()
+	defer m.handlers.Done()
+
 	for msgs.Next() {
 		msg := msgs.Message
 
 		req := mirror.Request{}
+		valid := true
 
 		for msg.Args.Next() {
 			arg := msg.Args.Arg
 
-			m, ok := m.mapping[arg.Name]
+			mapArg, ok := m.mapping[arg.Name]
 			if !ok {
 				continue
 			}
 
-			err := m(&req, arg.Value)
+			err := mapArg(&req, arg.Value)
 			if err != nil {
-				log.Errorf("%s: bad message: %s", HAProxySPOEName, err)
+				m.ctx.Error(fmt.Errorf("bad message: %s", err))
+				valid = false
 			}
 		}
 
+		if !valid {
+			continue
+		}
+
+		if req.Authority == "" {
+			req.Authority = firstHeader(req.Headers, "Host")
+		}
+
+		if req.Id == "" {
+			req.Id = mirror.NewRequestID()
+		}
+
 		m.ctx.HandledRequest()
 		m.out <- req
 	}
 
 	if err := msgs.Error(); err != nil {
-		log.Errorf("%s: error handling message: %s", HAProxySPOEName, err)
+		m.ctx.Error(fmt.Errorf("error handling message: %s", err))
 	}
 
 	return nil, nil
@@ -207,7 +348,65 @@ func mapPath(req *mirror.Request, value interface{}) error {
 		return fmt.Errorf("bad type %T received for path, expected string", value)
 	}
 
+	// HAProxy's url contains the query string
+	path, query, found := strings.Cut(path, "?")
 	req.Path = path
+	if found {
+		req.Query = query
+	}
+	return nil
+}
+
+func mapQuery(req *mirror.Request, value interface{}) error {
+	query, ok := value.(string)
+	if !ok {
+		return fmt.Errorf("bad type %T received for query, expected string", value)
+	}
+
+	req.Query = query
+	return nil
+}
+
+func mapAuthority(req *mirror.Request, value interface{}) error {
+	authority, ok := value.(string)
+	if !ok {
+		return fmt.Errorf("bad type %T received for authority, expected string", value)
+	}
+
+	req.Authority = authority
+	return nil
+}
+
+func mapScheme(req *mirror.Request, value interface{}) error {
+	scheme, ok := value.(string)
+	if !ok {
+		return fmt.Errorf("bad type %T received for scheme, expected string", value)
+	}
+
+	req.Scheme = scheme
+	return nil
+}
+
+func mapRemoteAddr(req *mirror.Request, value interface{}) error {
+	switch t := value.(type) {
+	case string:
+		req.RemoteAddr = t
+	case net.IP:
+		req.RemoteAddr = t.String()
+	default:
+		return fmt.Errorf("bad type %T received for remote address, expected string or ip", value)
+	}
+
+	return nil
+}
+
+func mapID(req *mirror.Request, value interface{}) error {
+	id, ok := value.(string)
+	if !ok {
+		return fmt.Errorf("bad type %T received for id, expected string", value)
+	}
+
+	req.Id = id
 	return nil
 }
 
@@ -229,6 +428,16 @@ func mapVer(req *mirror.Request, value interface{}) error {
 	return nil
 }
 
+func firstHeader(headers map[string]*mirror.HeaderValue, name string) string {
+	for k, v := range headers {
+		if strings.EqualFold(k, name) && len(v.GetValues()) > 0 {
+			return v.Values[0]
+		}
+	}
+
+	return ""
+}
+
 func mapHeaders(req *mirror.Request, value interface{}) error {
 	rawHeaders, ok := value.([]byte)
 	if !ok {
@@ -41,6 +41,7 @@ var spoeTestCases = []spoeTestCase{
 			Method:      mirror.Method_GET,
 			Path:        "/the/path",
 			HttpVersion: mirror.HTTPVersion_HTTP1_1,
+			Authority:   "127.0.0.1:10080",
 			Headers: map[string]*mirror.HeaderValue{
 				"Host":       {Values: []string{"127.0.0.1:10080"}},
 				"User-Agent": {Values: []string{"curl/7.64.0"}},
@@ -68,6 +69,7 @@ var spoeTestCases = []spoeTestCase{
 			Method:      mirror.Method_POST,
 			Path:        "/",
 			HttpVersion: mirror.HTTPVersion_HTTP1_1,
+			Authority:   "127.0.0.1:10080",
 			Headers: map[string]*mirror.HeaderValue{
 				"Host":           {Values: []string{"127.0.0.1:10080"}},
 				"User-Agent":     {Values: []string{"curl/7.64.0"}},
@@ -97,6 +99,7 @@ var spoeCustomMappingTestCase = []spoeTestCase{
 			Method:      mirror.Method_GET,
 			Path:        "/",
 			HttpVersion: mirror.HTTPVersion_HTTP1_1,
+			Authority:   "127.0.0.1:10080",
 			Headers: map[string]*mirror.HeaderValue{
 				"Host":       {Values: []string{"127.0.0.1:10080"}},
 				"User-Agent": {Values: []string{"curl/7.64.0"}},
@@ -121,6 +124,7 @@ func TestHAProxySPOE(t *testing.T) {
 
 			mod, err := NewHAProxySPOE(&mirror.ModuleContext{}, []byte(`{"listen_addr": "@`+name+`spoe.sock"}`))
 			require.NoError(t, err)
+			require.NoError(t, mod.Start())
 
 			go func() {
 				conn, err := net.Dial("unix", name+"spoe.sock")
@@ -131,11 +135,34 @@ func TestHAProxySPOE(t *testing.T) {
 			}()
 
 			req := <-mod.Output()
+			require.NotEmpty(t, req.Id)
+			req.Id = ""
 			require.Equal(t, testCase.expected, req)
+
+			mod.Stop()
+			for range mod.Output() {
+			}
 		})
 	}
 }
 
+func TestHAProxySPOEStopBeforeStart(t *testing.T) {
+	name, err := ioutil.TempDir("/tmp", "http-mirror-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(name)
+
+	mod, err := NewHAProxySPOE(&mirror.ModuleContext{}, []byte(`{"listen_addr": "@`+name+`spoe.sock"}`))
+	require.NoError(t, err)
+
+	mod.Stop()
+	require.NoError(t, mod.Start())
+	_, ok := <-mod.Output()
+	require.False(t, ok)
+
+	_, err = os.Stat(name + "spoe.sock")
+	require.True(t, os.IsNotExist(err), "the socket must not be created")
+}
+
 func TestHAProxySPOECustomMapping(t *testing.T) {
 	for _, testCase := range spoeCustomMappingTestCase {
 		t.Run(testCase.name, func(t *testing.T) {
@@ -153,6 +180,7 @@ func TestHAProxySPOECustomMapping(t *testing.T) {
 				}
 			`))
 			require.NoError(t, err)
+			require.NoError(t, mod.Start())
 
 			go func() {
 				conn, err := net.Dial("unix", name+"spoe.sock")
@@ -163,7 +191,25 @@ func TestHAProxySPOECustomMapping(t *testing.T) {
 			}()
 
 			req := <-mod.Output()
+			require.NotEmpty(t, req.Id)
+			req.Id = ""
 			require.Equal(t, testCase.expected, req)
 		})
 	}
 }
+
+func TestHAProxySPOEMapping(t *testing.T) {
+	req := mirror.Request{}
+
+	require.NoError(t, mapPath(&req, "/search?q=mirror"))
+	require.Equal(t, "/search", req.Path)
+	require.Equal(t, "q=mirror", req.Query)
+
+	require.NoError(t, mapRemoteAddr(&req, net.ParseIP("10.0.0.1")))
+	require.Equal(t, "10.0.0.1", req.RemoteAddr)
+
+	require.NoError(t, mapRemoteAddr(&req, "10.0.0.2:4242"))
+	require.Equal(t, "10.0.0.2:4242", req.RemoteAddr)
+
+	require.Error(t, mapScheme(&req, 42))
+}
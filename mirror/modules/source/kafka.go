@@ -0,0 +1,186 @@
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/criteo/traffic-mirroring/mirror/codec"
+	"github.com/criteo/traffic-mirroring/mirror/registry"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+const (
+	KafkaName = "source.kafka"
+)
+
+var (
+	kafkaConsumedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_consumed_total",
+		Help: "The total number of records consumed by result",
+	}, []string{"module", "result"})
+)
+
+func init() {
+	registry.Register(KafkaName, NewKafka)
+}
+
+type KafkaConfig struct {
+	Brokers []string `json:"brokers"`
+	Topic   string   `json:"topic"`
+	Group   string   `json:"group"`
+	Format  string   `json:"format,omitempty"`
+}
+
+type Kafka struct {
+	cfg    KafkaConfig
+	ctx    *mirror.ModuleContext
+	out    chan mirror.Request
+	client *kgo.Client
+
+	runCtx context.Context
+	cancel context.CancelFunc
+
+	lock    sync.Mutex
+	started bool
+	stopped bool
+}
+
+func NewKafka(ctx *mirror.ModuleContext, cfg []byte) (mirror.Module, error) {
+	mod := &Kafka{
+		ctx: ctx,
+		out: make(chan mirror.Request),
+	}
+	mod.runCtx, mod.cancel = context.WithCancel(context.Background())
+
+	err := json.Unmarshal(cfg, &mod.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(mod.cfg.Brokers) == 0 {
+		return nil, errors.New("brokers are required")
+	}
+
+	if mod.cfg.Topic == "" {
+		return nil, errors.New("topic is required")
+	}
+
+	if mod.cfg.Group == "" {
+		return nil, errors.New("group is required")
+	}
+
+	err = codec.CheckFormat(mod.cfg.Format, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return mod, nil
+}
+
+func (m *Kafka) Context() *mirror.ModuleContext {
+	return m.ctx
+}
+
+func (m *Kafka) Children() [][]mirror.Module {
+	return nil
+}
+
+func (m *Kafka) Start() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// the output is already closed
+	if m.stopped {
+		return nil
+	}
+
+	// offsets are only committed once requests are handed to the next
+	// module, so that nothing is lost on restart
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(m.cfg.Brokers...),
+		kgo.ConsumerGroup(m.cfg.Group),
+		kgo.ConsumeTopics(m.cfg.Topic),
+		kgo.AutoCommitMarks(),
+	)
+	if err != nil {
+		return err
+	}
+
+	m.client = client
+	m.started = true
+	go m.run()
+
+	return nil
+}
+
+func (m *Kafka) Stop() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.stopped {
+		return
+	}
+	m.stopped = true
+	m.cancel()
+
+	// without run, nothing else closes the output
+	if !m.started {
+		close(m.out)
+	}
+}
+
+func (m *Kafka) Output() <-chan mirror.Request {
+	return m.out
+}
+
+func (m *Kafka) SetInput(c <-chan mirror.Request) {
+	m.ctx.Error(fmt.Errorf("%s cannot accept input", KafkaName))
+	go func() {
+		for range c {
+		}
+	}()
+}
+
+func (m *Kafka) run() {
+	defer close(m.out)
+
+	for {
+		fetches := m.client.PollFetches(m.runCtx)
+		if m.runCtx.Err() != nil {
+			break
+		}
+
+		fetches.EachError(func(topic string, partition int32, err error) {
+			m.ctx.Error(fmt.Errorf("%s[%d]: %s", topic, partition, err))
+		})
+
+		fetches.EachRecord(func(rec *kgo.Record) {
+			req := mirror.Request{}
+			err := codec.Unmarshal(m.cfg.Format, rec.Value, &req)
+			if err != nil {
+				kafkaConsumedTotal.WithLabelValues(m.ctx.Name, "error").Inc()
+				m.ctx.Error(fmt.Errorf("%s[%d]@%d: %s", rec.Topic, rec.Partition, rec.Offset, err))
+			} else {
+				kafkaConsumedTotal.WithLabelValues(m.ctx.Name, "success").Inc()
+				m.ctx.HandledRequest()
+				m.out <- req
+			}
+
+			m.client.MarkCommitRecords(rec)
+		})
+	}
+
+	// the requests handed to the next module are committed before leaving
+	// the group
+	err := m.client.CommitMarkedOffsets(context.Background())
+	if err != nil {
+		m.ctx.Error(fmt.Errorf("could not commit offsets: %s", err))
+	}
+	m.client.Close()
+}
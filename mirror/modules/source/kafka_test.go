@@ -0,0 +1,81 @@
+package source
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/criteo/traffic-mirroring/mirror/modules/sink"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestKafka(t *testing.T) {
+	for _, format := range []string{"proto", "json"} {
+		t.Run(format, func(t *testing.T) {
+			c, err := kfake.NewCluster(kfake.NumBrokers(1), kfake.SeedTopics(1, "requests"))
+			require.NoError(t, err)
+			defer c.Close()
+
+			brokers := `["` + strings.Join(c.ListenAddrs(), `","`) + `"]`
+
+			out, err := sink.NewKafka(&mirror.ModuleContext{}, []byte(`{
+				"brokers": `+brokers+`,
+				"topic": "requests",
+				"format": "`+format+`",
+				"key": "{req.path}"
+			}`))
+			require.NoError(t, err)
+			require.NoError(t, out.Start())
+
+			in := make(chan mirror.Request, len(fileTestRequests))
+			for _, r := range fileTestRequests {
+				in <- r
+			}
+			out.SetInput(in)
+			close(in)
+			<-out.Output()
+
+			mod, err := NewKafka(&mirror.ModuleContext{}, []byte(`{
+				"brokers": `+brokers+`,
+				"topic": "requests",
+				"group": "test"
+			}`))
+			require.NoError(t, err)
+			require.NoError(t, mod.Start())
+
+			for _, expected := range fileTestRequests {
+				select {
+				case r := <-mod.Output():
+					require.True(t, proto.Equal(&expected, &r), "expected %v, got %v", &expected, &r)
+				case <-time.After(10 * time.Second):
+					t.Fatal("timeout waiting for requests")
+				}
+			}
+
+			mod.Stop()
+			for range mod.Output() {
+			}
+		})
+	}
+}
+
+func TestKafkaStopBeforeStart(t *testing.T) {
+	mod, err := NewKafka(&mirror.ModuleContext{}, []byte(`{"brokers": ["localhost:9092"], "topic": "requests", "group": "test"}`))
+	require.NoError(t, err)
+
+	mod.Stop()
+	require.NoError(t, mod.Start())
+	_, ok := <-mod.Output()
+	require.False(t, ok)
+}
+
+func TestKafkaConfig(t *testing.T) {
+	_, err := NewKafka(&mirror.ModuleContext{}, []byte(`{"topic": "requests", "group": "test"}`))
+	require.Error(t, err)
+
+	_, err = NewKafka(&mirror.ModuleContext{}, []byte(`{"brokers": ["localhost:9092"], "topic": "requests", "group": "test", "format": "xml"}`))
+	require.Error(t, err)
+}
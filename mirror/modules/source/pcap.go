@@ -8,72 +8,76 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/criteo/traffic-mirroring/mirror"
 	"github.com/criteo/traffic-mirroring/mirror/registry"
-	"github.com/golang/protobuf/ptypes"
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/tcpassembly"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 const (
 	PCapName = "source.pcap"
+
+	defaultFlowTimeout = 2 * time.Minute
+)
+
+var (
+	pcapFlowsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pcap_flows_total",
+		Help: "The total number of reassembled TCP flows",
+	}, []string{"module"})
+
+	pcapFlowsTimedOutTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pcap_flows_timed_out_total",
+		Help: "The total number of TCP flows closed because they were idle",
+	}, []string{"module"})
+
+	pcapUnparsedBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pcap_unparsed_bytes_total",
+		Help: "The total number of captured bytes that could not be parsed as HTTP requests",
+	}, []string{"module"})
 )
 
 func init() {
 	registry.Register(PCapName, NewPCap)
 }
 
-type blockingReader struct {
-	buf  bytes.Buffer
-	cond *sync.Cond
-}
-
-func newBlockingReader() *blockingReader {
-	m := sync.Mutex{}
-	return &blockingReader{
-		cond: sync.NewCond(&m),
-		buf:  bytes.Buffer{},
-	}
-}
-
-func (br *blockingReader) Write(b []byte) (ln int, err error) {
-	ln, err = br.buf.Write(b)
-	br.cond.Broadcast()
-	return
-}
-
-func (br *blockingReader) Read(b []byte) (ln int, err error) {
-	ln, err = br.buf.Read(b)
-	if err == io.EOF {
-		br.cond.L.Lock()
-		br.cond.Wait()
-		br.cond.L.Unlock()
-		ln, err = br.buf.Read(b)
-	}
-	return
-}
-
 type PCapConfig struct {
-	Interface string `json:"interface,omitempty"`
-	Port      int    `json:"port,omitempty"`
+	Interface   string `json:"interface,omitempty"`
+	File        string `json:"file,omitempty"`
+	Port        int    `json:"port,omitempty"`
+	FlowTimeout string `json:"flow_timeout,omitempty"`
 }
 
 type PCap struct {
-	cfg  PCapConfig
-	ctx  *mirror.ModuleContext
-	out  chan mirror.Request
-	buff *bytes.Buffer
+	cfg         PCapConfig
+	ctx         *mirror.ModuleContext
+	out         chan mirror.Request
+	flowTimeout time.Duration
+	streams     sync.WaitGroup
+
+	lock    sync.Mutex
+	handle  *pcap.Handle
+	started bool
+	stopped bool
 }
 
 func NewPCap(ctx *mirror.ModuleContext, cfg []byte) (mirror.Module, error) {
 	mod := &PCap{
-		ctx:  ctx,
-		out:  make(chan mirror.Request),
-		buff: &bytes.Buffer{},
+		ctx:         ctx,
+		out:         make(chan mirror.Request),
+		flowTimeout: defaultFlowTimeout,
 	}
 
 	err := json.Unmarshal(cfg, &mod.cfg)
@@ -81,13 +85,23 @@ func NewPCap(ctx *mirror.ModuleContext, cfg []byte) (mirror.Module, error) {
 		return nil, err
 	}
 
-	if len(mod.cfg.Interface) == 0 {
-		return nil, errors.New("interface is required")
+	if len(mod.cfg.Interface) == 0 && len(mod.cfg.File) == 0 {
+		return nil, errors.New("interface or file is required")
 	}
 
-	err = mod.start()
-	if err != nil {
-		return nil, err
+	if len(mod.cfg.Interface) != 0 && len(mod.cfg.File) != 0 {
+		return nil, errors.New("interface and file are mutually exclusive")
+	}
+
+	if mod.cfg.Port < 1 || mod.cfg.Port > 65535 {
+		return nil, errors.New("port must be between 1 and 65535")
+	}
+
+	if mod.cfg.FlowTimeout != "" {
+		mod.flowTimeout, err = time.ParseDuration(mod.cfg.FlowTimeout)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return mod, nil
@@ -106,11 +120,29 @@ func (m *PCap) Output() <-chan mirror.Request {
 }
 
 func (m *PCap) SetInput(c <-chan mirror.Request) {
-	log.Fatalf("%s: connot accept input", PCapName)
+	m.ctx.Error(fmt.Errorf("%s cannot accept input", PCapName))
+	go func() {
+		for range c {
+		}
+	}()
 }
 
-func (m *PCap) start() error {
-	handle, err := pcap.OpenLive(m.cfg.Interface, 65536, true, pcap.BlockForever)
+func (m *PCap) Start() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// the output is already closed
+	if m.stopped {
+		return nil
+	}
+
+	var handle *pcap.Handle
+	var err error
+	if m.cfg.File != "" {
+		handle, err = pcap.OpenOffline(m.cfg.File)
+	} else {
+		handle, err = pcap.OpenLive(m.cfg.Interface, 65536, true, pcap.BlockForever)
+	}
 	if err != nil {
 		return err
 	}
@@ -118,61 +150,279 @@ func (m *PCap) start() error {
 	filter := fmt.Sprintf("tcp and dst port %d", m.cfg.Port)
 	err = handle.SetBPFFilter(filter)
 	if err != nil {
+		handle.Close()
 		return err
 	}
 
 	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-	log.Infof("%s: capturing on %q with filter %q", PCapName, m.cfg.Interface, filter)
-
-	reader := newBlockingReader()
-	bufReader := bufio.NewReader(reader)
+	if m.cfg.File != "" {
+		log.Infof("%s: reading %q with filter %q", PCapName, m.cfg.File, filter)
+	} else {
+		log.Infof("%s: capturing on %q with filter %q", PCapName, m.cfg.Interface, filter)
+	}
 
+	m.handle = handle
+	m.started = true
 	go func() {
-		for packet := range packetSource.Packets() {
-			appLayer := packet.ApplicationLayer()
-			if appLayer == nil {
+		m.run(packetSource.Packets(), m.cfg.File != "")
+		handle.Close()
+	}()
+
+	return nil
+}
+
+// Stop closes the capture, which closes the packet channel and then the
+// output once the flows are parsed.
+func (m *PCap) Stop() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.stopped {
+		return
+	}
+	m.stopped = true
+
+	// without capture, nothing else closes the output
+	if !m.started {
+		close(m.out)
+		return
+	}
+	m.handle.Close()
+}
+
+// run reassembles the TCP flows of the packets, and closes the output once
+// the packet channel is closed and all the flows are parsed. When offline,
+// flow timeouts are based on the packet timestamps instead of the clock.
+func (m *PCap) run(packets <-chan gopacket.Packet, offline bool) {
+	assembler := tcpassembly.NewAssembler(tcpassembly.NewStreamPool(m))
+
+	flush := func(now time.Time) {
+		_, closed := assembler.FlushOlderThan(now.Add(-m.flowTimeout))
+		pcapFlowsTimedOutTotal.WithLabelValues(m.ctx.Name).Add(float64(closed))
+	}
+
+	var tick <-chan time.Time
+	if !offline {
+		ticker := time.NewTicker(m.flowTimeout / 2)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var nextFlush time.Time
+
+	for {
+		select {
+		case packet, ok := <-packets:
+			if !ok {
+				assembler.FlushAll()
+				m.streams.Wait()
+				close(m.out)
+				return
+			}
+
+			network := packet.NetworkLayer()
+			tcp, isTCP := packet.TransportLayer().(*layers.TCP)
+			if network == nil || !isTCP {
 				continue
 			}
 
-			reader.Write(appLayer.Payload())
+			ts := packet.Metadata().Timestamp
+			assembler.AssembleWithTimestamp(network.NetworkFlow(), tcp, ts)
+
+			if offline && ts.After(nextFlush) {
+				flush(ts)
+				nextFlush = ts.Add(m.flowTimeout / 2)
+			}
+		case now := <-tick:
+			flush(now)
 		}
-	}()
+	}
+}
+
+// New implements tcpassembly.StreamFactory, each flow is parsed in its own
+// goroutine.
+func (m *PCap) New(netFlow, tcpFlow gopacket.Flow) tcpassembly.Stream {
+	pcapFlowsTotal.WithLabelValues(m.ctx.Name).Inc()
+
+	s := &pcapStream{
+		chunks: make(chan pcapChunk),
+	}
 
+	m.streams.Add(1)
 	go func() {
+		defer m.streams.Done()
+		m.parseStream(net.JoinHostPort(netFlow.Src().String(), tcpFlow.Src().String()), s)
+	}()
+
+	return s
+}
+
+func (m *PCap) parseStream(remoteAddr string, s *pcapStream) {
+	reader := bufio.NewReader(s)
+
+	for {
+		// wait for the beginning of the next request to know when it was
+		// captured
+		_, err := reader.Peek(1)
+		if err == io.EOF {
+			return
+		}
+
+		start := s.read - int64(reader.Buffered())
+
+		req, err := m.readRequest(reader, s.seen, remoteAddr)
+		if err != nil {
+			m.ctx.Error(fmt.Errorf("%s: %s", remoteAddr, err))
+
+			// skip to the next line which looks like the beginning of a
+			// request
+			ok := resync(reader)
+			pcapUnparsedBytesTotal.WithLabelValues(m.ctx.Name).Add(float64(s.read - int64(reader.Buffered()) - start))
+			if !ok {
+				return
+			}
+			continue
+		}
+
+		m.ctx.HandledRequest()
+		m.out <- req
+	}
+}
+
+// resync discards the lines of the reader until one looks like a request
+// line, it returns false if the flow ends before.
+func resync(reader *bufio.Reader) bool {
+	for {
+		line, err := peekLine(reader)
+		if err == nil && isRequestLine(line) {
+			return true
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			io.Copy(ioutil.Discard, reader)
+			return false
+		}
+
+		// the line may be longer than the buffer
 		for {
-			req, err := m.readRequest(bufReader)
-			if err != nil {
-				log.Errorf("%s: %s", PCapName, err)
-				continue
+			_, err = reader.ReadSlice('\n')
+			if err != bufio.ErrBufferFull {
+				break
 			}
+		}
+		if err != nil {
+			return false
+		}
+	}
+}
 
-			m.ctx.HandledRequest()
-			m.out <- req
+// peekLine returns the next line of the reader without consuming it, or
+// bufio.ErrBufferFull if it does not fit in the buffer.
+func peekLine(reader *bufio.Reader) ([]byte, error) {
+	for n := 1; n <= reader.Size(); n = reader.Buffered() + 1 {
+		b, err := reader.Peek(n)
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			return b[:i], nil
 		}
-	}()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, bufio.ErrBufferFull
+}
 
-	return nil
+// isRequestLine returns whether the line is a HTTP/1 request line with a
+// known method.
+func isRequestLine(line []byte) bool {
+	parts := strings.Split(strings.TrimSuffix(string(line), "\r"), " ")
+	if len(parts) != 3 || parts[1] == "" {
+		return false
+	}
+
+	_, ok := mirror.Method_value[parts[0]]
+	return ok && strings.HasPrefix(parts[2], "HTTP/1.")
 }
 
-func (m *PCap) readRequest(reader *bufio.Reader) (mirror.Request, error) {
+func (m *PCap) readRequest(reader *bufio.Reader, seen time.Time, remoteAddr string) (mirror.Request, error) {
 	req, err := http.ReadRequest(reader)
 	if err != nil {
 		return mirror.Request{}, err
 	}
 
-	body, _ := ioutil.ReadAll(req.Body)
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return mirror.Request{}, err
+	}
 
 	mreq := mirror.Request{
-		Time:    ptypes.TimestampNow(),
-		Method:  mirror.Method(mirror.Method_value[req.Method]),
-		Path:    req.URL.Path,
-		Body:    body,
-		Headers: map[string]*mirror.HeaderValue{},
+		Id:         mirror.NewRequestID(),
+		Time:       timestamppb.New(seen),
+		Method:     mirror.Method(mirror.Method_value[req.Method]),
+		Scheme:     "http",
+		Authority:  req.Host,
+		Path:       req.URL.Path,
+		Query:      req.URL.RawQuery,
+		RemoteAddr: remoteAddr,
+		Body:       body,
+		Headers:    map[string]*mirror.HeaderValue{},
 	}
 
 	for name, values := range req.Header {
 		mreq.Headers[name] = &mirror.HeaderValue{Values: values}
 	}
 
+	// ReadRequest moves the Host header to req.Host
+	if req.Host != "" {
+		mreq.Headers["Host"] = &mirror.HeaderValue{Values: []string{req.Host}}
+	}
+
 	return mreq, nil
 }
+
+type pcapChunk struct {
+	data []byte
+	seen time.Time
+}
+
+// pcapStream is a tcpassembly.Stream exposing the reassembled flow as an
+// io.Reader, along with the capture time of the last chunk read and the
+// number of bytes read so far.
+type pcapStream struct {
+	chunks chan pcapChunk
+
+	current []byte
+	seen    time.Time
+	read    int64
+}
+
+func (s *pcapStream) Reassembled(rs []tcpassembly.Reassembly) {
+	for _, r := range rs {
+		if len(r.Bytes) == 0 {
+			continue
+		}
+
+		// the assembler reuses the buffers once this function returns
+		data := make([]byte, len(r.Bytes))
+		copy(data, r.Bytes)
+
+		s.chunks <- pcapChunk{data: data, seen: r.Seen}
+	}
+}
+
+func (s *pcapStream) ReassemblyComplete() {
+	close(s.chunks)
+}
+
+func (s *pcapStream) Read(b []byte) (int, error) {
+	if len(s.current) == 0 {
+		chunk, ok := <-s.chunks
+		if !ok {
+			return 0, io.EOF
+		}
+		s.current = chunk.data
+		s.seen = chunk.seen
+	}
+
+	n := copy(b, s.current)
+	s.current = s.current[n:]
+	s.read += int64(n)
+	return n, nil
+}
@@ -0,0 +1,220 @@
+package source
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+var pcapTestStart = time.Unix(1600000000, 0).UTC()
+
+// tcpFlow builds the packets of a client to server TCP flow.
+type tcpFlow struct {
+	t       *testing.T
+	srcPort layers.TCPPort
+	seq     uint32
+}
+
+func newTCPFlow(t *testing.T, srcPort int) *tcpFlow {
+	return &tcpFlow{t: t, srcPort: layers.TCPPort(srcPort), seq: 1000}
+}
+
+func (f *tcpFlow) packet(at time.Duration, payload string, syn, fin bool) gopacket.Packet {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.IPv4(10, 0, 0, 1),
+		DstIP:    net.IPv4(10, 0, 0, 2),
+	}
+	tcp := &layers.TCP{
+		SrcPort: f.srcPort,
+		DstPort: 80,
+		Seq:     f.seq,
+		SYN:     syn,
+		FIN:     fin,
+		ACK:     !syn,
+		Window:  65535,
+	}
+	require.NoError(f.t, tcp.SetNetworkLayerForChecksum(ip))
+
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 1},
+			DstMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 2},
+			EthernetType: layers.EthernetTypeIPv4,
+		}, ip, tcp, gopacket.Payload(payload))
+	require.NoError(f.t, err)
+
+	f.seq += uint32(len(payload))
+	if syn || fin {
+		f.seq++
+	}
+
+	p := gopacket.NewPacket(buf.Bytes(), layers.LinkTypeEthernet, gopacket.Default)
+	p.Metadata().Timestamp = pcapTestStart.Add(at)
+	p.Metadata().CaptureLength = len(buf.Bytes())
+	p.Metadata().Length = len(buf.Bytes())
+	return p
+}
+
+func runPCap(t *testing.T, packets []gopacket.Packet) []mirror.Request {
+	mod := &PCap{
+		ctx:         &mirror.ModuleContext{Name: t.Name()},
+		out:         make(chan mirror.Request),
+		flowTimeout: defaultFlowTimeout,
+	}
+
+	c := make(chan gopacket.Packet, len(packets))
+	for _, p := range packets {
+		c <- p
+	}
+	close(c)
+
+	go mod.run(c, true)
+
+	return readAll(mod)
+}
+
+func TestPCapFlows(t *testing.T) {
+	a := newTCPFlow(t, 40001)
+	b := newTCPFlow(t, 40002)
+
+	aSyn := a.packet(0, "", true, false)
+	bSyn := b.packet(0, "", true, false)
+	a1 := a.packet(time.Second, "GET /a HTTP/1.1\r\nHo", false, false)
+	a2 := a.packet(2*time.Second, "st: a\r\n\r\n", false, false)
+	b1 := b.packet(3*time.Second, "POST /b HTTP/1.1\r\nHost: b\r\nContent-Length: 3\r\n\r\n", false, false)
+	b2 := b.packet(4*time.Second, "HEY", false, false)
+	a3 := a.packet(5*time.Second, "GET /a2?x=1 HTTP/1.1\r\nHost: a\r\n\r\n", false, false)
+
+	// the flows are interleaved, and the second segment of each flow is
+	// captured before the first one
+	out := runPCap(t, []gopacket.Packet{aSyn, bSyn, a2, b2, a1, b1, a3})
+
+	require.Len(t, out, 3)
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Path < out[j].Path
+	})
+
+	require.Equal(t, mirror.Method_GET, out[0].Method)
+	require.Equal(t, "/a", out[0].Path)
+	require.Equal(t, pcapTestStart.Add(time.Second), out[0].Time.AsTime())
+
+	require.Equal(t, "/a2", out[1].Path)
+	require.Equal(t, "x=1", out[1].Query)
+	require.Equal(t, "a", out[1].Authority)
+	require.Equal(t, []string{"a"}, out[1].Headers["Host"].Values)
+	require.Equal(t, "10.0.0.1:40001", out[1].RemoteAddr)
+	require.NotEmpty(t, out[1].Id)
+	require.Equal(t, pcapTestStart.Add(5*time.Second), out[1].Time.AsTime())
+
+	require.Equal(t, mirror.Method_POST, out[2].Method)
+	require.Equal(t, "/b", out[2].Path)
+	require.Equal(t, []byte("HEY"), out[2].Body)
+}
+
+func TestPCapUnparsed(t *testing.T) {
+	a := newTCPFlow(t, 40001)
+	b := newTCPFlow(t, 40002)
+
+	unparsed := pcapUnparsedBytesTotal.WithLabelValues(t.Name())
+	before := testutil.ToFloat64(unparsed)
+
+	out := runPCap(t, []gopacket.Packet{
+		a.packet(0, "", true, false),
+		b.packet(0, "", true, false),
+		a.packet(time.Second, "NOT HTTP\r\n\r\n", false, false),
+		a.packet(time.Second, "GET /a HTTP/1.1\r\n\r\n", false, false),
+		a.packet(time.Second, "GET /bad HTTP/1.1\r\nBad Header\r\n\r\nbody\r\n", false, false),
+		a.packet(time.Second, "GET /a2 HTTP/1.1\r\n\r\n", false, false),
+		b.packet(time.Second, "GET /b HTTP/1.1\r\nHost: b\r\n\r\n", false, false),
+	})
+
+	// the parsing resumes at the next request line
+	require.Len(t, out, 3)
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Path < out[j].Path
+	})
+	require.Equal(t, "/a", out[0].Path)
+	require.Equal(t, "/a2", out[1].Path)
+	require.Equal(t, "/b", out[2].Path)
+	require.Equal(t, float64(len("NOT HTTP\r\n\r\n")+len("GET /bad HTTP/1.1\r\nBad Header\r\n\r\nbody\r\n")), testutil.ToFloat64(unparsed)-before)
+}
+
+func TestPCapFile(t *testing.T) {
+	a := newTCPFlow(t, 40001)
+	b := newTCPFlow(t, 40002)
+
+	packets := []gopacket.Packet{
+		a.packet(0, "", true, false),
+		a.packet(time.Second, "GET /a HTTP/1.1\r\nHost: a\r\n\r\nGET /partial HTTP/1.1\r\n", false, false),
+		// the first flow times out before this one starts
+		b.packet(10*time.Minute, "", true, false),
+		b.packet(10*time.Minute+time.Second, "GET /b HTTP/1.1\r\nHost: b\r\n\r\n", false, false),
+	}
+
+	f, err := ioutil.TempFile("/tmp", "http-mirror-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	w := pcapgo.NewWriter(f)
+	require.NoError(t, w.WriteFileHeader(65536, layers.LinkTypeEthernet))
+	for _, p := range packets {
+		require.NoError(t, w.WritePacket(p.Metadata().CaptureInfo, p.Data()))
+	}
+	require.NoError(t, f.Close())
+
+	timedOut := pcapFlowsTimedOutTotal.WithLabelValues(t.Name())
+	before := testutil.ToFloat64(timedOut)
+
+	mod, err := NewPCap(&mirror.ModuleContext{Name: t.Name()}, []byte(`{"file": "`+f.Name()+`", "port": 80, "flow_timeout": "1m"}`))
+	require.NoError(t, err)
+	require.NoError(t, mod.Start())
+
+	out := readAll(mod)
+	require.Len(t, out, 2)
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Path < out[j].Path
+	})
+	require.Equal(t, "/a", out[0].Path)
+	require.Equal(t, pcapTestStart.Add(time.Second), out[0].Time.AsTime())
+	require.Equal(t, "/b", out[1].Path)
+	require.Equal(t, pcapTestStart.Add(10*time.Minute+time.Second), out[1].Time.AsTime())
+	require.Equal(t, float64(1), testutil.ToFloat64(timedOut)-before)
+}
+
+func TestPCapConfig(t *testing.T) {
+	_, err := NewPCap(&mirror.ModuleContext{}, []byte(`{"port": 80}`))
+	require.Error(t, err)
+
+	_, err = NewPCap(&mirror.ModuleContext{}, []byte(`{"interface": "lo"}`))
+	require.Error(t, err)
+
+	_, err = NewPCap(&mirror.ModuleContext{}, []byte(`{"interface": "lo", "port": 65536}`))
+	require.Error(t, err)
+
+	_, err = NewPCap(&mirror.ModuleContext{}, []byte(`{"interface": "lo", "file": "capture.pcap"}`))
+	require.Error(t, err)
+}
+
+func TestPCapStopBeforeStart(t *testing.T) {
+	// the file does not exist, it must not be opened
+	mod, err := NewPCap(&mirror.ModuleContext{}, []byte(`{"file": "/nonexistent/capture.pcap", "port": 80}`))
+	require.NoError(t, err)
+
+	mod.Stop()
+	require.NoError(t, mod.Start())
+	require.Empty(t, readAll(mod))
+}
@@ -0,0 +1,120 @@
+package source
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/criteo/traffic-mirroring/mirror/pubsub"
+	"github.com/criteo/traffic-mirroring/mirror/registry"
+)
+
+const (
+	SubscribeName = "source.subscribe"
+)
+
+func init() {
+	registry.Register(SubscribeName, NewSubscribe)
+}
+
+type SubscribeConfig struct {
+	Topic string `json:"topic"`
+}
+
+type Subscribe struct {
+	cfg SubscribeConfig
+	ctx *mirror.ModuleContext
+	out chan mirror.Request
+
+	lock    sync.Mutex
+	sub     *pubsub.Subscription
+	started bool
+	stopped bool
+}
+
+func NewSubscribe(ctx *mirror.ModuleContext, cfg []byte) (mirror.Module, error) {
+	mod := &Subscribe{
+		ctx: ctx,
+		out: make(chan mirror.Request),
+	}
+
+	err := json.Unmarshal(cfg, &mod.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if mod.cfg.Topic == "" {
+		return nil, errors.New("topic is required")
+	}
+
+	return mod, nil
+}
+
+func (m *Subscribe) Context() *mirror.ModuleContext {
+	return m.ctx
+}
+
+func (m *Subscribe) Children() [][]mirror.Module {
+	return nil
+}
+
+func (m *Subscribe) SubscribedTopic() string {
+	return m.cfg.Topic
+}
+
+func (m *Subscribe) Output() <-chan mirror.Request {
+	return m.out
+}
+
+func (m *Subscribe) SetInput(c <-chan mirror.Request) {
+	m.ctx.Error(fmt.Errorf("%s cannot accept input", SubscribeName))
+	go func() {
+		for range c {
+		}
+	}()
+}
+
+// Start subscribes to the topic, the requests published before are not
+// received.
+func (m *Subscribe) Start() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.stopped {
+		return nil
+	}
+
+	m.started = true
+	m.sub = pubsub.Get(m.cfg.Topic).Subscribe()
+	go func() {
+		for r := range m.sub.C() {
+			m.ctx.HandledRequest()
+			m.out <- r
+		}
+		close(m.out)
+	}()
+
+	return nil
+}
+
+// Stop ends the subscription right away, the requests published after are
+// not received. When the process stops, the pipelines subscribed to a topic
+// are only stopped once its publishers are done.
+func (m *Subscribe) Stop() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.stopped {
+		return
+	}
+	m.stopped = true
+
+	// without subscription, nothing else closes the output
+	if !m.started {
+		close(m.out)
+		return
+	}
+	m.sub.Close()
+}
@@ -0,0 +1,18 @@
+package source
+
+import (
+	"testing"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribeStopBeforeStart(t *testing.T) {
+	mod, err := NewSubscribe(&mirror.ModuleContext{}, []byte(`{"topic": "`+t.Name()+`"}`))
+	require.NoError(t, err)
+
+	mod.Stop()
+	require.NoError(t, mod.Start())
+	_, ok := <-mod.Output()
+	require.False(t, ok)
+}
@@ -0,0 +1,172 @@
+// Package pubsub holds the in-memory topics connecting pipelines, through
+// the control.publish and source.subscribe modules.
+package pubsub
+
+import (
+	"sync"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	publishedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubsub_published_total",
+		Help: "The total number of requests published on the topic",
+	}, []string{"topic"})
+
+	droppedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pubsub_dropped_total",
+		Help: "The total number of requests published while the topic had no subscriptions",
+	}, []string{"topic"})
+
+	subscribersGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pubsub_subscribers",
+		Help: "The number of subscriptions to the topic",
+	}, []string{"topic"})
+
+	topics     = map[string]*Topic{}
+	topicsLock sync.Mutex
+)
+
+// Publisher is implemented by the modules publishing on a topic.
+type Publisher interface {
+	PublishedTopic() string
+}
+
+// Subscriber is implemented by the modules subscribed to a topic.
+type Subscriber interface {
+	SubscribedTopic() string
+}
+
+// Topic sends the requests of its publishers to all its subscribers.
+// Publishing blocks until every subscriber received the request.
+type Topic struct {
+	name string
+
+	lock          sync.RWMutex
+	subscriptions map[*Subscription]bool
+	publishers    int
+}
+
+// Get returns the topic with the given name, creating it if needed.
+func Get(name string) *Topic {
+	topicsLock.Lock()
+	defer topicsLock.Unlock()
+
+	t, ok := topics[name]
+	if !ok {
+		t = &Topic{
+			name:          name,
+			subscriptions: map[*Subscription]bool{},
+		}
+		topics[name] = t
+	}
+
+	return t
+}
+
+func (t *Topic) Name() string {
+	return t.name
+}
+
+// AddPublisher registers a publisher until RemovePublisher is called, so
+// that subscribers know when the requests in flight are all published.
+func (t *Topic) AddPublisher() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.publishers++
+}
+
+func (t *Topic) RemovePublisher() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.publishers--
+}
+
+// Publishers returns the number of publishers still running.
+func (t *Topic) Publishers() int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.publishers
+}
+
+// Publish sends the request to all the subscriptions. It is dropped when
+// there are none.
+func (t *Topic) Publish(r mirror.Request) {
+	// the requests are sent without the lock, so that a slow subscription
+	// does not block the others from subscribing or closing
+	t.lock.RLock()
+	subs := make([]*Subscription, 0, len(t.subscriptions))
+	for s := range t.subscriptions {
+		s.sending.Add(1)
+		subs = append(subs, s)
+	}
+	t.lock.RUnlock()
+
+	publishedTotal.WithLabelValues(t.name).Inc()
+	if len(subs) == 0 {
+		droppedTotal.WithLabelValues(t.name).Inc()
+		return
+	}
+
+	for _, s := range subs {
+		select {
+		case s.c <- r:
+		case <-s.done:
+		}
+		s.sending.Done()
+	}
+}
+
+func (t *Topic) Subscribe() *Subscription {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	s := &Subscription{
+		topic: t,
+		c:     make(chan mirror.Request),
+		done:  make(chan struct{}),
+	}
+	t.subscriptions[s] = true
+	subscribersGauge.WithLabelValues(t.name).Set(float64(len(t.subscriptions)))
+
+	return s
+}
+
+type Subscription struct {
+	topic *Topic
+	c     chan mirror.Request
+	done  chan struct{}
+	once  sync.Once
+	// sending counts the publishers sending to the subscription, c is
+	// only closed once they are done
+	sending sync.WaitGroup
+}
+
+// C returns the requests published on the topic, it is closed once the
+// subscription is.
+func (s *Subscription) C() <-chan mirror.Request {
+	return s.c
+}
+
+// Close stops the subscription. A publisher blocked on it gives up the
+// request.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		close(s.done)
+
+		t := s.topic
+		t.lock.Lock()
+		delete(t.subscriptions, s)
+		subscribersGauge.WithLabelValues(t.name).Set(float64(len(t.subscriptions)))
+		t.lock.Unlock()
+
+		s.sending.Wait()
+		close(s.c)
+	})
+}
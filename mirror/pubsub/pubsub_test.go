@@ -0,0 +1,66 @@
+package pubsub
+
+import (
+	"testing"
+	"time"
+
+	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishDropped(t *testing.T) {
+	topic := Get(t.Name())
+	dropped := droppedTotal.WithLabelValues(t.Name())
+	before := testutil.ToFloat64(dropped)
+
+	topic.Publish(mirror.Request{})
+	require.Equal(t, 1.0, testutil.ToFloat64(dropped)-before)
+
+	sub := topic.Subscribe()
+	go topic.Publish(mirror.Request{Path: "/a"})
+	require.Equal(t, "/a", (<-sub.C()).Path)
+	require.Equal(t, 1.0, testutil.ToFloat64(dropped)-before)
+	sub.Close()
+}
+
+func TestSubscribeWhilePublishing(t *testing.T) {
+	topic := Get(t.Name())
+	slow := topic.Subscribe()
+
+	published := make(chan struct{})
+	go func() {
+		topic.Publish(mirror.Request{})
+		close(published)
+	}()
+
+	// the publisher is blocked by the slow subscription, which must not
+	// prevent a new one
+	subscribed := make(chan *Subscription)
+	go func() {
+		subscribed <- topic.Subscribe()
+	}()
+
+	var sub *Subscription
+	select {
+	case sub = <-subscribed:
+	case <-time.After(time.Second):
+		t.Fatal("Subscribe blocked by Publish")
+	}
+	go func() {
+		for range sub.C() {
+		}
+	}()
+
+	// closing the slow subscription releases the publisher
+	slow.Close()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("Publish blocked by a closed subscription")
+	}
+
+	_, ok := <-slow.C()
+	require.False(t, ok)
+	sub.Close()
+}
@@ -33,7 +33,7 @@ func (r *Registry) Create(moduleType string, ctx *mirror.ModuleContext, cfg []by
 
 	m, err := c(ctx, cfg)
 	if err != nil {
-		return nil, fmt.Errorf("error creating module %q: %s", moduleType, err)
+		return nil, fmt.Errorf("error creating module %q: %w", moduleType, err)
 	}
 
 	return m, nil
@@ -1,7 +1,7 @@
 // Code generated by protoc-gen-go. DO NOT EDIT.
 // versions:
-// 	protoc-gen-go v1.25.0-devel
-// 	protoc        v3.14.0
+// 	protoc-gen-go v1.36.6
+// 	protoc        (unknown)
 // source: request.proto
 
 package mirror
@@ -9,9 +9,11 @@ package mirror
 import (
 	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
 	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	durationpb "google.golang.org/protobuf/types/known/durationpb"
 	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
 	reflect "reflect"
 	sync "sync"
+	unsafe "unsafe"
 )
 
 const (
@@ -138,20 +140,17 @@ func (HTTPVersion) EnumDescriptor() ([]byte, []int) {
 }
 
 type HeaderValue struct {
-	state         protoimpl.MessageState
-	sizeCache     protoimpl.SizeCache
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Values        []string               `protobuf:"bytes,2,rep,name=values,proto3" json:"values,omitempty"`
 	unknownFields protoimpl.UnknownFields
-
-	Values []string `protobuf:"bytes,2,rep,name=values,proto3" json:"values,omitempty"`
+	sizeCache     protoimpl.SizeCache
 }
 
 func (x *HeaderValue) Reset() {
 	*x = HeaderValue{}
-	if protoimpl.UnsafeEnabled {
-		mi := &file_request_proto_msgTypes[0]
-		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
-		ms.StoreMessageInfo(mi)
-	}
+	mi := &file_request_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
 }
 
 func (x *HeaderValue) String() string {
@@ -162,7 +161,7 @@ func (*HeaderValue) ProtoMessage() {}
 
 func (x *HeaderValue) ProtoReflect() protoreflect.Message {
 	mi := &file_request_proto_msgTypes[0]
-	if protoimpl.UnsafeEnabled && x != nil {
+	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
 			ms.StoreMessageInfo(mi)
@@ -185,24 +184,22 @@ func (x *HeaderValue) GetValues() []string {
 }
 
 type MetaValue struct {
-	state         protoimpl.MessageState
-	sizeCache     protoimpl.SizeCache
-	unknownFields protoimpl.UnknownFields
-
-	// Types that are assignable to Value:
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Value:
+	//
 	//	*MetaValue_String_
 	//	*MetaValue_Int
 	//	*MetaValue_Bool
-	Value isMetaValue_Value `protobuf_oneof:"value"`
+	Value         isMetaValue_Value `protobuf_oneof:"value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
 }
 
 func (x *MetaValue) Reset() {
 	*x = MetaValue{}
-	if protoimpl.UnsafeEnabled {
-		mi := &file_request_proto_msgTypes[1]
-		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
-		ms.StoreMessageInfo(mi)
-	}
+	mi := &file_request_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
 }
 
 func (x *MetaValue) String() string {
@@ -213,7 +210,7 @@ func (*MetaValue) ProtoMessage() {}
 
 func (x *MetaValue) ProtoReflect() protoreflect.Message {
 	mi := &file_request_proto_msgTypes[1]
-	if protoimpl.UnsafeEnabled && x != nil {
+	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
 			ms.StoreMessageInfo(mi)
@@ -228,30 +225,36 @@ func (*MetaValue) Descriptor() ([]byte, []int) {
 	return file_request_proto_rawDescGZIP(), []int{1}
 }
 
-func (m *MetaValue) GetValue() isMetaValue_Value {
-	if m != nil {
-		return m.Value
+func (x *MetaValue) GetValue() isMetaValue_Value {
+	if x != nil {
+		return x.Value
 	}
 	return nil
 }
 
 func (x *MetaValue) GetString_() string {
-	if x, ok := x.GetValue().(*MetaValue_String_); ok {
-		return x.String_
+	if x != nil {
+		if x, ok := x.Value.(*MetaValue_String_); ok {
+			return x.String_
+		}
 	}
 	return ""
 }
 
 func (x *MetaValue) GetInt() int64 {
-	if x, ok := x.GetValue().(*MetaValue_Int); ok {
-		return x.Int
+	if x != nil {
+		if x, ok := x.Value.(*MetaValue_Int); ok {
+			return x.Int
+		}
 	}
 	return 0
 }
 
 func (x *MetaValue) GetBool() bool {
-	if x, ok := x.GetValue().(*MetaValue_Bool); ok {
-		return x.Bool
+	if x != nil {
+		if x, ok := x.Value.(*MetaValue_Bool); ok {
+			return x.Bool
+		}
 	}
 	return false
 }
@@ -278,27 +281,125 @@ func (*MetaValue_Int) isMetaValue_Value() {}
 
 func (*MetaValue_Bool) isMetaValue_Value() {}
 
-type Request struct {
-	state         protoimpl.MessageState
-	sizeCache     protoimpl.SizeCache
+type Response struct {
+	state         protoimpl.MessageState  `protogen:"open.v1"`
+	StatusCode    int32                   `protobuf:"varint,1,opt,name=status_code,json=statusCode,proto3" json:"status_code,omitempty"`
+	Latency       *durationpb.Duration    `protobuf:"bytes,2,opt,name=latency,proto3" json:"latency,omitempty"`
+	Headers       map[string]*HeaderValue `protobuf:"bytes,3,rep,name=headers,proto3" json:"headers,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	BodySize      int64                   `protobuf:"varint,4,opt,name=body_size,json=bodySize,proto3" json:"body_size,omitempty"`
+	BodyHash      string                  `protobuf:"bytes,5,opt,name=body_hash,json=bodyHash,proto3" json:"body_hash,omitempty"`
+	Body          []byte                  `protobuf:"bytes,6,opt,name=body,proto3" json:"body,omitempty"`
+	Error         string                  `protobuf:"bytes,7,opt,name=error,proto3" json:"error,omitempty"`
 	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Response) Reset() {
+	*x = Response{}
+	mi := &file_request_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Response) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Response) ProtoMessage() {}
+
+func (x *Response) ProtoReflect() protoreflect.Message {
+	mi := &file_request_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Response.ProtoReflect.Descriptor instead.
+func (*Response) Descriptor() ([]byte, []int) {
+	return file_request_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Response) GetStatusCode() int32 {
+	if x != nil {
+		return x.StatusCode
+	}
+	return 0
+}
+
+func (x *Response) GetLatency() *durationpb.Duration {
+	if x != nil {
+		return x.Latency
+	}
+	return nil
+}
+
+func (x *Response) GetHeaders() map[string]*HeaderValue {
+	if x != nil {
+		return x.Headers
+	}
+	return nil
+}
 
+func (x *Response) GetBodySize() int64 {
+	if x != nil {
+		return x.BodySize
+	}
+	return 0
+}
+
+func (x *Response) GetBodyHash() string {
+	if x != nil {
+		return x.BodyHash
+	}
+	return ""
+}
+
+func (x *Response) GetBody() []byte {
+	if x != nil {
+		return x.Body
+	}
+	return nil
+}
+
+func (x *Response) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+type Request struct {
+	state       protoimpl.MessageState  `protogen:"open.v1"`
 	Time        *timestamppb.Timestamp  `protobuf:"bytes,1,opt,name=time,proto3" json:"time,omitempty"`
 	Method      Method                  `protobuf:"varint,2,opt,name=method,proto3,enum=mirror.Method" json:"method,omitempty"`
 	Path        string                  `protobuf:"bytes,3,opt,name=path,proto3" json:"path,omitempty"`
 	HttpVersion HTTPVersion             `protobuf:"varint,4,opt,name=http_version,json=httpVersion,proto3,enum=mirror.HTTPVersion" json:"http_version,omitempty"`
-	Headers     map[string]*HeaderValue `protobuf:"bytes,5,rep,name=headers,proto3" json:"headers,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	Headers     map[string]*HeaderValue `protobuf:"bytes,5,rep,name=headers,proto3" json:"headers,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
 	Body        []byte                  `protobuf:"bytes,6,opt,name=body,proto3" json:"body,omitempty"`
-	Meta        map[string]*MetaValue   `protobuf:"bytes,7,rep,name=meta,proto3" json:"meta,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	Meta        map[string]*MetaValue   `protobuf:"bytes,7,rep,name=meta,proto3" json:"meta,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Response    *Response               `protobuf:"bytes,8,opt,name=response,proto3" json:"response,omitempty"`
+	// query string, without the leading '?'
+	Query string `protobuf:"bytes,9,opt,name=query,proto3" json:"query,omitempty"`
+	// host and optional port, from the request line or the Host header
+	Authority string `protobuf:"bytes,10,opt,name=authority,proto3" json:"authority,omitempty"`
+	Scheme    string `protobuf:"bytes,11,opt,name=scheme,proto3" json:"scheme,omitempty"`
+	// address of the client, as ip or ip:port
+	RemoteAddr    string `protobuf:"bytes,12,opt,name=remote_addr,json=remoteAddr,proto3" json:"remote_addr,omitempty"`
+	Id            string `protobuf:"bytes,13,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
 }
 
 func (x *Request) Reset() {
 	*x = Request{}
-	if protoimpl.UnsafeEnabled {
-		mi := &file_request_proto_msgTypes[2]
-		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
-		ms.StoreMessageInfo(mi)
-	}
+	mi := &file_request_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
 }
 
 func (x *Request) String() string {
@@ -308,8 +409,8 @@ func (x *Request) String() string {
 func (*Request) ProtoMessage() {}
 
 func (x *Request) ProtoReflect() protoreflect.Message {
-	mi := &file_request_proto_msgTypes[2]
-	if protoimpl.UnsafeEnabled && x != nil {
+	mi := &file_request_proto_msgTypes[3]
+	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
 			ms.StoreMessageInfo(mi)
@@ -321,7 +422,7 @@ func (x *Request) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Request.ProtoReflect.Descriptor instead.
 func (*Request) Descriptor() ([]byte, []int) {
-	return file_request_proto_rawDescGZIP(), []int{2}
+	return file_request_proto_rawDescGZIP(), []int{3}
 }
 
 func (x *Request) GetTime() *timestamppb.Timestamp {
@@ -373,99 +474,154 @@ func (x *Request) GetMeta() map[string]*MetaValue {
 	return nil
 }
 
-var File_request_proto protoreflect.FileDescriptor
+func (x *Request) GetResponse() *Response {
+	if x != nil {
+		return x.Response
+	}
+	return nil
+}
+
+func (x *Request) GetQuery() string {
+	if x != nil {
+		return x.Query
+	}
+	return ""
+}
+
+func (x *Request) GetAuthority() string {
+	if x != nil {
+		return x.Authority
+	}
+	return ""
+}
+
+func (x *Request) GetScheme() string {
+	if x != nil {
+		return x.Scheme
+	}
+	return ""
+}
+
+func (x *Request) GetRemoteAddr() string {
+	if x != nil {
+		return x.RemoteAddr
+	}
+	return ""
+}
 
-var file_request_proto_rawDesc = []byte{
-	0x0a, 0x0d, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12,
-	0x06, 0x6d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x1a, 0x1f, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2f,
-	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2f, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61,
-	0x6d, 0x70, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0x25, 0x0a, 0x0b, 0x48, 0x65, 0x61, 0x64,
-	0x65, 0x72, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x76, 0x61, 0x6c, 0x75, 0x65,
-	0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x09, 0x52, 0x06, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x73, 0x22,
-	0x58, 0x0a, 0x09, 0x4d, 0x65, 0x74, 0x61, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x12, 0x18, 0x0a, 0x06,
-	0x73, 0x74, 0x72, 0x69, 0x6e, 0x67, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x48, 0x00, 0x52, 0x06,
-	0x73, 0x74, 0x72, 0x69, 0x6e, 0x67, 0x12, 0x12, 0x0a, 0x03, 0x69, 0x6e, 0x74, 0x18, 0x02, 0x20,
-	0x01, 0x28, 0x03, 0x48, 0x00, 0x52, 0x03, 0x69, 0x6e, 0x74, 0x12, 0x14, 0x0a, 0x04, 0x62, 0x6f,
-	0x6f, 0x6c, 0x18, 0x03, 0x20, 0x01, 0x28, 0x08, 0x48, 0x00, 0x52, 0x04, 0x62, 0x6f, 0x6f, 0x6c,
-	0x42, 0x07, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x22, 0xc5, 0x03, 0x0a, 0x07, 0x52, 0x65,
-	0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x2e, 0x0a, 0x04, 0x74, 0x69, 0x6d, 0x65, 0x18, 0x01, 0x20,
-	0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f,
-	0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52,
-	0x04, 0x74, 0x69, 0x6d, 0x65, 0x12, 0x26, 0x0a, 0x06, 0x6d, 0x65, 0x74, 0x68, 0x6f, 0x64, 0x18,
-	0x02, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x0e, 0x2e, 0x6d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x2e, 0x4d,
-	0x65, 0x74, 0x68, 0x6f, 0x64, 0x52, 0x06, 0x6d, 0x65, 0x74, 0x68, 0x6f, 0x64, 0x12, 0x12, 0x0a,
-	0x04, 0x70, 0x61, 0x74, 0x68, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x70, 0x61, 0x74,
-	0x68, 0x12, 0x36, 0x0a, 0x0c, 0x68, 0x74, 0x74, 0x70, 0x5f, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f,
-	0x6e, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x13, 0x2e, 0x6d, 0x69, 0x72, 0x72, 0x6f, 0x72,
-	0x2e, 0x48, 0x54, 0x54, 0x50, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x52, 0x0b, 0x68, 0x74,
-	0x74, 0x70, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x36, 0x0a, 0x07, 0x68, 0x65, 0x61,
-	0x64, 0x65, 0x72, 0x73, 0x18, 0x05, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1c, 0x2e, 0x6d, 0x69, 0x72,
-	0x72, 0x6f, 0x72, 0x2e, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x2e, 0x48, 0x65, 0x61, 0x64,
-	0x65, 0x72, 0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x07, 0x68, 0x65, 0x61, 0x64, 0x65, 0x72,
-	0x73, 0x12, 0x12, 0x0a, 0x04, 0x62, 0x6f, 0x64, 0x79, 0x18, 0x06, 0x20, 0x01, 0x28, 0x0c, 0x52,
-	0x04, 0x62, 0x6f, 0x64, 0x79, 0x12, 0x2d, 0x0a, 0x04, 0x6d, 0x65, 0x74, 0x61, 0x18, 0x07, 0x20,
-	0x03, 0x28, 0x0b, 0x32, 0x19, 0x2e, 0x6d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x2e, 0x52, 0x65, 0x71,
-	0x75, 0x65, 0x73, 0x74, 0x2e, 0x4d, 0x65, 0x74, 0x61, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x04,
-	0x6d, 0x65, 0x74, 0x61, 0x1a, 0x4f, 0x0a, 0x0c, 0x48, 0x65, 0x61, 0x64, 0x65, 0x72, 0x73, 0x45,
-	0x6e, 0x74, 0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28,
-	0x09, 0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x29, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18,
-	0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x13, 0x2e, 0x6d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x2e, 0x48,
-	0x65, 0x61, 0x64, 0x65, 0x72, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75,
-	0x65, 0x3a, 0x02, 0x38, 0x01, 0x1a, 0x4a, 0x0a, 0x09, 0x4d, 0x65, 0x74, 0x61, 0x45, 0x6e, 0x74,
-	0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52,
-	0x03, 0x6b, 0x65, 0x79, 0x12, 0x27, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02, 0x20,
-	0x01, 0x28, 0x0b, 0x32, 0x11, 0x2e, 0x6d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x2e, 0x4d, 0x65, 0x74,
-	0x61, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38,
-	0x01, 0x2a, 0x6a, 0x0a, 0x06, 0x4d, 0x65, 0x74, 0x68, 0x6f, 0x64, 0x12, 0x07, 0x0a, 0x03, 0x47,
-	0x45, 0x54, 0x10, 0x00, 0x12, 0x08, 0x0a, 0x04, 0x48, 0x45, 0x41, 0x44, 0x10, 0x01, 0x12, 0x08,
-	0x0a, 0x04, 0x50, 0x4f, 0x53, 0x54, 0x10, 0x02, 0x12, 0x07, 0x0a, 0x03, 0x50, 0x55, 0x54, 0x10,
-	0x03, 0x12, 0x09, 0x0a, 0x05, 0x50, 0x41, 0x54, 0x43, 0x48, 0x10, 0x04, 0x12, 0x0a, 0x0a, 0x06,
-	0x44, 0x45, 0x4c, 0x45, 0x54, 0x45, 0x10, 0x05, 0x12, 0x0b, 0x0a, 0x07, 0x43, 0x4f, 0x4e, 0x4e,
-	0x45, 0x43, 0x54, 0x10, 0x06, 0x12, 0x0b, 0x0a, 0x07, 0x4f, 0x50, 0x54, 0x49, 0x4f, 0x4e, 0x53,
-	0x10, 0x07, 0x12, 0x09, 0x0a, 0x05, 0x54, 0x52, 0x41, 0x43, 0x45, 0x10, 0x08, 0x2a, 0x32, 0x0a,
-	0x0b, 0x48, 0x54, 0x54, 0x50, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x0b, 0x0a, 0x07,
-	0x48, 0x54, 0x54, 0x50, 0x31, 0x5f, 0x30, 0x10, 0x00, 0x12, 0x0b, 0x0a, 0x07, 0x48, 0x54, 0x54,
-	0x50, 0x31, 0x5f, 0x31, 0x10, 0x01, 0x12, 0x09, 0x0a, 0x05, 0x48, 0x54, 0x54, 0x50, 0x32, 0x10,
-	0x02, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+func (x *Request) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
 }
 
+var File_request_proto protoreflect.FileDescriptor
+
+const file_request_proto_rawDesc = "" +
+	"\n" +
+	"\rrequest.proto\x12\x06mirror\x1a\x1egoogle/protobuf/duration.proto\x1a\x1fgoogle/protobuf/timestamp.proto\"%\n" +
+	"\vHeaderValue\x12\x16\n" +
+	"\x06values\x18\x02 \x03(\tR\x06values\"X\n" +
+	"\tMetaValue\x12\x18\n" +
+	"\x06string\x18\x01 \x01(\tH\x00R\x06string\x12\x12\n" +
+	"\x03int\x18\x02 \x01(\x03H\x00R\x03int\x12\x14\n" +
+	"\x04bool\x18\x03 \x01(\bH\x00R\x04boolB\a\n" +
+	"\x05value\"\xce\x02\n" +
+	"\bResponse\x12\x1f\n" +
+	"\vstatus_code\x18\x01 \x01(\x05R\n" +
+	"statusCode\x123\n" +
+	"\alatency\x18\x02 \x01(\v2\x19.google.protobuf.DurationR\alatency\x127\n" +
+	"\aheaders\x18\x03 \x03(\v2\x1d.mirror.Response.HeadersEntryR\aheaders\x12\x1b\n" +
+	"\tbody_size\x18\x04 \x01(\x03R\bbodySize\x12\x1b\n" +
+	"\tbody_hash\x18\x05 \x01(\tR\bbodyHash\x12\x12\n" +
+	"\x04body\x18\x06 \x01(\fR\x04body\x12\x14\n" +
+	"\x05error\x18\a \x01(\tR\x05error\x1aO\n" +
+	"\fHeadersEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12)\n" +
+	"\x05value\x18\x02 \x01(\v2\x13.mirror.HeaderValueR\x05value:\x028\x01\"\xf0\x04\n" +
+	"\aRequest\x12.\n" +
+	"\x04time\x18\x01 \x01(\v2\x1a.google.protobuf.TimestampR\x04time\x12&\n" +
+	"\x06method\x18\x02 \x01(\x0e2\x0e.mirror.MethodR\x06method\x12\x12\n" +
+	"\x04path\x18\x03 \x01(\tR\x04path\x126\n" +
+	"\fhttp_version\x18\x04 \x01(\x0e2\x13.mirror.HTTPVersionR\vhttpVersion\x126\n" +
+	"\aheaders\x18\x05 \x03(\v2\x1c.mirror.Request.HeadersEntryR\aheaders\x12\x12\n" +
+	"\x04body\x18\x06 \x01(\fR\x04body\x12-\n" +
+	"\x04meta\x18\a \x03(\v2\x19.mirror.Request.MetaEntryR\x04meta\x12,\n" +
+	"\bresponse\x18\b \x01(\v2\x10.mirror.ResponseR\bresponse\x12\x14\n" +
+	"\x05query\x18\t \x01(\tR\x05query\x12\x1c\n" +
+	"\tauthority\x18\n" +
+	" \x01(\tR\tauthority\x12\x16\n" +
+	"\x06scheme\x18\v \x01(\tR\x06scheme\x12\x1f\n" +
+	"\vremote_addr\x18\f \x01(\tR\n" +
+	"remoteAddr\x12\x0e\n" +
+	"\x02id\x18\r \x01(\tR\x02id\x1aO\n" +
+	"\fHeadersEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12)\n" +
+	"\x05value\x18\x02 \x01(\v2\x13.mirror.HeaderValueR\x05value:\x028\x01\x1aJ\n" +
+	"\tMetaEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12'\n" +
+	"\x05value\x18\x02 \x01(\v2\x11.mirror.MetaValueR\x05value:\x028\x01*j\n" +
+	"\x06Method\x12\a\n" +
+	"\x03GET\x10\x00\x12\b\n" +
+	"\x04HEAD\x10\x01\x12\b\n" +
+	"\x04POST\x10\x02\x12\a\n" +
+	"\x03PUT\x10\x03\x12\t\n" +
+	"\x05PATCH\x10\x04\x12\n" +
+	"\n" +
+	"\x06DELETE\x10\x05\x12\v\n" +
+	"\aCONNECT\x10\x06\x12\v\n" +
+	"\aOPTIONS\x10\a\x12\t\n" +
+	"\x05TRACE\x10\b*2\n" +
+	"\vHTTPVersion\x12\v\n" +
+	"\aHTTP1_0\x10\x00\x12\v\n" +
+	"\aHTTP1_1\x10\x01\x12\t\n" +
+	"\x05HTTP2\x10\x02B,Z*github.com/criteo/traffic-mirroring/mirrorb\x06proto3"
+
 var (
 	file_request_proto_rawDescOnce sync.Once
-	file_request_proto_rawDescData = file_request_proto_rawDesc
+	file_request_proto_rawDescData []byte
 )
 
 func file_request_proto_rawDescGZIP() []byte {
 	file_request_proto_rawDescOnce.Do(func() {
-		file_request_proto_rawDescData = protoimpl.X.CompressGZIP(file_request_proto_rawDescData)
+		file_request_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_request_proto_rawDesc), len(file_request_proto_rawDesc)))
 	})
 	return file_request_proto_rawDescData
 }
 
 var file_request_proto_enumTypes = make([]protoimpl.EnumInfo, 2)
-var file_request_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
-var file_request_proto_goTypes = []interface{}{
+var file_request_proto_msgTypes = make([]protoimpl.MessageInfo, 7)
+var file_request_proto_goTypes = []any{
 	(Method)(0),                   // 0: mirror.Method
 	(HTTPVersion)(0),              // 1: mirror.HTTPVersion
 	(*HeaderValue)(nil),           // 2: mirror.HeaderValue
 	(*MetaValue)(nil),             // 3: mirror.MetaValue
-	(*Request)(nil),               // 4: mirror.Request
-	nil,                           // 5: mirror.Request.HeadersEntry
-	nil,                           // 6: mirror.Request.MetaEntry
-	(*timestamppb.Timestamp)(nil), // 7: google.protobuf.Timestamp
+	(*Response)(nil),              // 4: mirror.Response
+	(*Request)(nil),               // 5: mirror.Request
+	nil,                           // 6: mirror.Response.HeadersEntry
+	nil,                           // 7: mirror.Request.HeadersEntry
+	nil,                           // 8: mirror.Request.MetaEntry
+	(*durationpb.Duration)(nil),   // 9: google.protobuf.Duration
+	(*timestamppb.Timestamp)(nil), // 10: google.protobuf.Timestamp
 }
 var file_request_proto_depIdxs = []int32{
-	7, // 0: mirror.Request.time:type_name -> google.protobuf.Timestamp
-	0, // 1: mirror.Request.method:type_name -> mirror.Method
-	1, // 2: mirror.Request.http_version:type_name -> mirror.HTTPVersion
-	5, // 3: mirror.Request.headers:type_name -> mirror.Request.HeadersEntry
-	6, // 4: mirror.Request.meta:type_name -> mirror.Request.MetaEntry
-	2, // 5: mirror.Request.HeadersEntry.value:type_name -> mirror.HeaderValue
-	3, // 6: mirror.Request.MetaEntry.value:type_name -> mirror.MetaValue
-	7, // [7:7] is the sub-list for method output_type
-	7, // [7:7] is the sub-list for method input_type
-	7, // [7:7] is the sub-list for extension type_name
-	7, // [7:7] is the sub-list for extension extendee
-	0, // [0:7] is the sub-list for field type_name
+	9,  // 0: mirror.Response.latency:type_name -> google.protobuf.Duration
+	6,  // 1: mirror.Response.headers:type_name -> mirror.Response.HeadersEntry
+	10, // 2: mirror.Request.time:type_name -> google.protobuf.Timestamp
+	0,  // 3: mirror.Request.method:type_name -> mirror.Method
+	1,  // 4: mirror.Request.http_version:type_name -> mirror.HTTPVersion
+	7,  // 5: mirror.Request.headers:type_name -> mirror.Request.HeadersEntry
+	8,  // 6: mirror.Request.meta:type_name -> mirror.Request.MetaEntry
+	4,  // 7: mirror.Request.response:type_name -> mirror.Response
+	2,  // 8: mirror.Response.HeadersEntry.value:type_name -> mirror.HeaderValue
+	2,  // 9: mirror.Request.HeadersEntry.value:type_name -> mirror.HeaderValue
+	3,  // 10: mirror.Request.MetaEntry.value:type_name -> mirror.MetaValue
+	11, // [11:11] is the sub-list for method output_type
+	11, // [11:11] is the sub-list for method input_type
+	11, // [11:11] is the sub-list for extension type_name
+	11, // [11:11] is the sub-list for extension extendee
+	0,  // [0:11] is the sub-list for field type_name
 }
 
 func init() { file_request_proto_init() }
@@ -473,45 +629,7 @@ func file_request_proto_init() {
 	if File_request_proto != nil {
 		return
 	}
-	if !protoimpl.UnsafeEnabled {
-		file_request_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*HeaderValue); i {
-			case 0:
-				return &v.state
-			case 1:
-				return &v.sizeCache
-			case 2:
-				return &v.unknownFields
-			default:
-				return nil
-			}
-		}
-		file_request_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*MetaValue); i {
-			case 0:
-				return &v.state
-			case 1:
-				return &v.sizeCache
-			case 2:
-				return &v.unknownFields
-			default:
-				return nil
-			}
-		}
-		file_request_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*Request); i {
-			case 0:
-				return &v.state
-			case 1:
-				return &v.sizeCache
-			case 2:
-				return &v.unknownFields
-			default:
-				return nil
-			}
-		}
-	}
-	file_request_proto_msgTypes[1].OneofWrappers = []interface{}{
+	file_request_proto_msgTypes[1].OneofWrappers = []any{
 		(*MetaValue_String_)(nil),
 		(*MetaValue_Int)(nil),
 		(*MetaValue_Bool)(nil),
@@ -520,9 +638,9 @@ func file_request_proto_init() {
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
-			RawDescriptor: file_request_proto_rawDesc,
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_request_proto_rawDesc), len(file_request_proto_rawDesc)),
 			NumEnums:      2,
-			NumMessages:   5,
+			NumMessages:   7,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
@@ -532,7 +650,6 @@ func file_request_proto_init() {
 		MessageInfos:      file_request_proto_msgTypes,
 	}.Build()
 	File_request_proto = out.File
-	file_request_proto_rawDesc = nil
 	file_request_proto_goTypes = nil
 	file_request_proto_depIdxs = nil
 }
@@ -1,10 +1,13 @@
 package server
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"os"
 
 	"github.com/criteo/traffic-mirroring/mirror"
+	"github.com/criteo/traffic-mirroring/mirror/config"
 	"github.com/criteo/traffic-mirroring/mirror/graph"
 	_ "github.com/criteo/traffic-mirroring/mirror/server/statik"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -15,16 +18,23 @@ import (
 type Server struct {
 	listenAddr string
 	pipeline   mirror.Module
+	reloader   *config.Reloader
 }
 
-func New(listenAddr string, pipeline mirror.Module) *Server {
+func New(listenAddr string, pipeline mirror.Module, reloader *config.Reloader) *Server {
 	return &Server{
 		listenAddr: listenAddr,
 		pipeline:   pipeline,
+		reloader:   reloader,
 	}
 }
 
 func (s *Server) Run() error {
+	log.Infof("%s: listening on %s", os.Args[0], s.listenAddr)
+	return http.ListenAndServe(s.listenAddr, s.handler())
+}
+
+func (s *Server) handler() http.Handler {
 	mux := http.NewServeMux()
 
 	statikFS, err := fs.New()
@@ -42,13 +52,127 @@ func (s *Server) Run() error {
 	}))
 	mux.Handle("/web/", http.StripPrefix("/web/", http.FileServer(statikFS)))
 	mux.Handle("/api/graph", http.HandlerFunc(s.graphHandler))
+	mux.Handle("/api/reload", http.HandlerFunc(s.reloadHandler))
+	mux.Handle("/api/modules/{name}/params", http.HandlerFunc(s.paramsHandler))
 
-	log.Infof("%s: listening on %s", os.Args[0], s.listenAddr)
-	return http.ListenAndServe(s.listenAddr, mux)
+	return mux
 }
 
 func (s *Server) graphHandler(rw http.ResponseWriter, r *http.Request) {
-	g := graph.FromModule(s.pipeline)
 	rw.Header().Add("Content-Type", "text/plain")
-	rw.Write([]byte(g.String()))
+	rw.Write([]byte(s.graph()))
+}
+
+func (s *Server) graph() string {
+	return graph.FromModule(s.pipeline).String()
+}
+
+// reloadHandler returns the status of the config reloads, and reloads the
+// config file on POST.
+func (s *Server) reloadHandler(rw http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		err := s.reloader.Reload()
+		if err != nil {
+			log.Errorf("config reload failed:\n%s", err)
+			status = http.StatusBadRequest
+		}
+	default:
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rw.Header().Add("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(s.reloader.Status())
+}
+
+// paramsHandler returns the parameters of a module, and changes them on PUT.
+// Besides the parameters of the tunable modules, any module can be paused.
+func (s *Server) paramsHandler(rw http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	var mod mirror.Module
+	mirror.Walk(s.pipeline, func(m mirror.Module) {
+		if mod == nil && m.Context().Name == name && m.Context().Role() != "virtual" {
+			mod = m
+		}
+	})
+	if mod == nil {
+		http.Error(rw, fmt.Sprintf("unknown module %q", name), http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		err := setParams(mod, r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rw.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(params(mod))
+}
+
+func params(mod mirror.Module) map[string]interface{} {
+	res := map[string]interface{}{}
+	if t, ok := mod.(mirror.Tunable); ok {
+		res = t.Params()
+	}
+	res["paused"] = mod.Context().Paused()
+
+	return res
+}
+
+func setParams(mod mirror.Module, r *http.Request) error {
+	ctx := mod.Context()
+
+	p := map[string]json.RawMessage{}
+	err := json.NewDecoder(r.Body).Decode(&p)
+	if err != nil {
+		return fmt.Errorf("invalid params: %w", err)
+	}
+
+	var paused *bool
+	if raw, ok := p["paused"]; ok {
+		paused = new(bool)
+		err = json.Unmarshal(raw, paused)
+		if err != nil {
+			return fmt.Errorf("paused: %w", err)
+		}
+		delete(p, "paused")
+	}
+
+	if len(p) > 0 {
+		t, ok := mod.(mirror.Tunable)
+		if !ok {
+			return fmt.Errorf("%s has no tunable parameters", ctx.Type)
+		}
+
+		b, _ := json.Marshal(p)
+		err = t.SetParams(b)
+		if err != nil {
+			return err
+		}
+		log.Infof("%s: params changed to %s", ctx.Name, b)
+	}
+
+	if paused != nil && *paused != ctx.Paused() {
+		ctx.SetPaused(*paused)
+		if *paused {
+			log.Infof("%s: paused", ctx.Name)
+		} else {
+			log.Infof("%s: resumed", ctx.Name)
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/criteo/traffic-mirroring/mirror/config"
+	_ "github.com/criteo/traffic-mirroring/mirror/modules/control"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParams(t *testing.T) {
+	cfg, err := config.Create(strings.NewReader(`{
+		"pipeline": [
+			{"type": "control.rate_limit", "name": "limit", "config": {"rps": 100}},
+			{"type": "control.identity", "name": "identity", "config": {}}
+		]
+	}`))
+	require.NoError(t, err)
+
+	s := New("", cfg.Root(), config.NewReloader("", cfg))
+	h := s.handler()
+
+	do := func(method, path, body string) (int, map[string]interface{}) {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(method, path, strings.NewReader(body)))
+
+		res := map[string]interface{}{}
+		json.Unmarshal(rw.Body.Bytes(), &res)
+		return rw.Code, res
+	}
+
+	status, params := do(http.MethodPut, "/api/modules/limit/params", `{"rps": 500, "paused": true}`)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, float64(500), params["rps"])
+	require.Equal(t, true, params["paused"])
+	require.Contains(t, s.graph(), "Paused")
+
+	status, params = do(http.MethodGet, "/api/modules/limit/params", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, float64(500), params["rps"])
+
+	// nothing is changed when a parameter is invalid
+	status, _ = do(http.MethodPut, "/api/modules/limit/params", `{"rps": 1000, "burst": -1}`)
+	require.Equal(t, http.StatusBadRequest, status)
+	status, _ = do(http.MethodPut, "/api/modules/limit/params", `{"unknown": 1}`)
+	require.Equal(t, http.StatusBadRequest, status)
+	_, params = do(http.MethodGet, "/api/modules/limit/params", "")
+	require.Equal(t, float64(500), params["rps"])
+
+	// modules without parameters can only be paused
+	status, _ = do(http.MethodPut, "/api/modules/identity/params", `{"rps": 1}`)
+	require.Equal(t, http.StatusBadRequest, status)
+	status, params = do(http.MethodPut, "/api/modules/identity/params", `{"paused": true}`)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, map[string]interface{}{"paused": true}, params)
+
+	status, _ = do(http.MethodGet, "/api/modules/unknown/params", "")
+	require.Equal(t, http.StatusNotFound, status)
+	status, _ = do(http.MethodPost, "/api/modules/limit/params", "{}")
+	require.Equal(t, http.StatusMethodNotAllowed, status)
+}